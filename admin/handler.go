@@ -0,0 +1,66 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+
+	"go-chat/api"
+)
+
+type response struct {
+	Message string `json:"message,omitempty"`
+}
+
+type Handler struct {
+	DeadLettersMgr interface {
+		List(queue string, limit int) ([]api.DeadLetterResponse, *api.APIError)
+		Replay(queue string, limit int) (api.ReplayResponse, *api.APIError)
+	}
+}
+
+// ListDeadLetters - returns the messages of a queue that exhausted their retries
+func (h Handler) ListDeadLetters(c echo.Context) error {
+	limit, ok := parseLimit(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	letters, err := h.DeadLettersMgr.List(c.Param("queue"), limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, letters)
+}
+
+// ReplayDeadLetters - moves the dead-lettered messages back to their queue
+func (h Handler) ReplayDeadLetters(c echo.Context) error {
+	limit, ok := parseLimit(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	replayed, err := h.DeadLettersMgr.Replay(c.Param("queue"), limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, replayed)
+}
+
+func parseLimit(c echo.Context) (int, bool) {
+	limit := DefaultLimit
+	if value := c.QueryParam("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return 0, false
+		}
+		limit = parsed
+	}
+	if limit > MaxLimit {
+		limit = MaxLimit
+	}
+	return limit, true
+}
@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"net/http"
+
+	"go-chat/api"
+	"go-chat/events"
+)
+
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+
+	unknownQueueMsg = "unknown queue"
+)
+
+type (
+	deadLetterQueue interface {
+		DeadLetters(channelName string, limit int) ([]events.DeadLetter, error)
+		Replay(channelName string, limit int) (int, error)
+	}
+
+	// DeadLettersMgr inspects and replays the messages dead-lettered by the consumers.
+	DeadLettersMgr struct {
+		Queue  deadLetterQueue
+		queues map[string]bool
+	}
+)
+
+// NewDeadLettersMgr only gives access to the dead-letter queues of the given queues.
+func NewDeadLettersMgr(queue deadLetterQueue, queues ...string) *DeadLettersMgr {
+	known := make(map[string]bool, len(queues))
+	for _, q := range queues {
+		known[q] = true
+	}
+	return &DeadLettersMgr{
+		Queue:  queue,
+		queues: known,
+	}
+}
+
+// List returns up to limit dead-lettered messages of the queue without removing them.
+func (m *DeadLettersMgr) List(queue string, limit int) ([]api.DeadLetterResponse, *api.APIError) {
+	if !m.queues[queue] {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: unknownQueueMsg}
+	}
+	letters, err := m.Queue.DeadLetters(queue, limit)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Msg: err.Error()}
+	}
+
+	response := make([]api.DeadLetterResponse, 0, len(letters))
+	for _, letter := range letters {
+		response = append(response, api.DeadLetterResponse{
+			Queue:     letter.Queue,
+			Body:      string(letter.Body),
+			Retries:   letter.Retries,
+			LastError: letter.LastError,
+			Timestamp: letter.Timestamp,
+		})
+	}
+	return response, nil
+}
+
+// Replay sends up to limit dead-lettered messages back to the queue.
+func (m *DeadLettersMgr) Replay(queue string, limit int) (api.ReplayResponse, *api.APIError) {
+	if !m.queues[queue] {
+		return api.ReplayResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: unknownQueueMsg}
+	}
+	replayed, err := m.Queue.Replay(queue, limit)
+	if err != nil {
+		return api.ReplayResponse{}, &api.APIError{HTTPStatusCode: http.StatusServiceUnavailable, Msg: err.Error()}
+	}
+	return api.ReplayResponse{Queue: queue, Replayed: replayed}, nil
+}
@@ -0,0 +1,18 @@
+package api
+
+import "time"
+
+type (
+	DeadLetterResponse struct {
+		Queue     string    `json:"queue"`
+		Body      string    `json:"body"`
+		Retries   int       `json:"retries"`
+		LastError string    `json:"last_error,omitempty"`
+		Timestamp time.Time `json:"timestamp,omitempty"`
+	}
+
+	ReplayResponse struct {
+		Queue    string `json:"queue"`
+		Replayed int    `json:"replayed"`
+	}
+)
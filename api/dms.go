@@ -0,0 +1,46 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxDirectParticipants is the largest group a direct conversation can have, the caller included.
+const MaxDirectParticipants = 8
+
+type (
+	// OpenDirectRequest names the other participants, the caller always takes part.
+	OpenDirectRequest struct {
+		NickNames []string `json:"nick_names"`
+	}
+
+	ParticipantResponse struct {
+		UserID   uuid.UUID `json:"user_id"`
+		NickName string    `json:"nick_name"`
+	}
+
+	// DirectResponse is a direct conversation, its ID is the one of the room to open the websocket of.
+	DirectResponse struct {
+		ID           string                `json:"id"`
+		Title        string                `json:"title"`
+		Participants []ParticipantResponse `json:"participants"`
+		CreatedAt    time.Time             `json:"created_at"`
+	}
+)
+
+func (c *OpenDirectRequest) Check() error {
+	switch {
+	case len(c.NickNames) == 0:
+		return errors.New("nick_names is required")
+	case len(c.NickNames) >= MaxDirectParticipants:
+		return errors.New("a direct conversation has at most 8 participants")
+	}
+	for _, nickname := range c.NickNames {
+		if nickname == "" {
+			return errors.New("nick_names cannot be empty")
+		}
+	}
+	return nil
+}
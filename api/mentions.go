@@ -0,0 +1,35 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxMarkedMentions is the number of mentions a request can mark as read at once.
+const MaxMarkedMentions = 100
+
+type (
+	// MentionResponse is a message that mentioned the user.
+	MentionResponse struct {
+		Message     MessageResponse `json:"message"`
+		MentionedAt time.Time       `json:"mentioned_at"`
+	}
+
+	// MarkMentionsReadRequest lists the messages whose mentions were read, all the mentions when empty.
+	MarkMentionsReadRequest struct {
+		MessageIDs []uuid.UUID `json:"message_ids"`
+	}
+
+	MarkMentionsReadResponse struct {
+		Marked int64 `json:"marked"`
+	}
+)
+
+func (c *MarkMentionsReadRequest) Check() error {
+	if len(c.MessageIDs) > MaxMarkedMentions {
+		return errors.New("at most 100 message ids can be marked at once")
+	}
+	return nil
+}
@@ -1,6 +1,12 @@
 package api
 
-import "github.com/google/uuid"
+import (
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
 
 type (
 	CreateMessageRequest struct {
@@ -13,4 +19,64 @@ type (
 	CreateMessageResponse struct {
 		ID uuid.UUID `json:"id"`
 	}
+
+	MessageResponse struct {
+		ID        uuid.UUID  `json:"id"`
+		UserID    uuid.UUID  `json:"user_id"`
+		NickName  string     `json:"nick_name"`
+		Body      string     `json:"body"`
+		Chatroom  string     `json:"chatroom"`
+		ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+		CreatedAt time.Time  `json:"created_at"`
+		EditedAt  *time.Time `json:"edited_at,omitempty"`
+		// Reactions counts the users per emoji, the first used first.
+		Reactions []ReactionCountResponse `json:"reactions,omitempty"`
+		// ReplyCount and LastReplyAt summarize the thread started by the message.
+		ReplyCount  int        `json:"reply_count,omitempty"`
+		LastReplyAt *time.Time `json:"last_reply_at,omitempty"`
+	}
+
+	// ThreadResponse is a message with a page of its replies, oldest first; NextCursor is empty on the last page.
+	ThreadResponse struct {
+		Parent     MessageResponse   `json:"parent"`
+		Replies    []MessageResponse `json:"replies"`
+		NextCursor string            `json:"next_cursor,omitempty"`
+	}
+
+	ReactionCountResponse struct {
+		Emoji string `json:"emoji"`
+		Count int    `json:"count"`
+	}
+
+	EditMessageRequest struct {
+		Body string `json:"body"`
+	}
+
+	// MessageEditResponse is an entry of the edit history of a message, with the body it had before.
+	MessageEditResponse struct {
+		ID           uuid.UUID `json:"id"`
+		EditorID     uuid.UUID `json:"editor_id"`
+		Action       string    `json:"action"`
+		PreviousBody string    `json:"previous_body"`
+		CreatedAt    time.Time `json:"created_at"`
+	}
+
+	// MessagesPageResponse lists messages newest first; NextCursor is empty on the last page.
+	MessagesPageResponse struct {
+		Messages   []MessageResponse `json:"messages"`
+		NextCursor string            `json:"next_cursor,omitempty"`
+	}
 )
+
+// MaxMessageBody is the longest body a message can be stored with.
+const MaxMessageBody = 256
+
+func (c *EditMessageRequest) Check() error {
+	switch {
+	case c.Body == "":
+		return errors.New("body is required")
+	case utf8.RuneCountInString(c.Body) > MaxMessageBody:
+		return errors.New("body must be at most 256 characters")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// MarkReadRequest names the message of the room read last.
+	MarkReadRequest struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+
+	// ReadMarkerResponse is where the user stopped reading a room, with the messages left unread.
+	ReadMarkerResponse struct {
+		RoomID     string    `json:"room_id"`
+		MessageID  uuid.UUID `json:"message_id"`
+		LastReadAt time.Time `json:"last_read_at"`
+		Unread     int64     `json:"unread"`
+	}
+
+	// MyRoomResponse is a room of the user with the messages they have not read. LastReadMessageID is
+	// empty until they read the room.
+	MyRoomResponse struct {
+		RoomResponse
+		Unread            int64      `json:"unread"`
+		LastReadMessageID *uuid.UUID `json:"last_read_message_id,omitempty"`
+		LastReadAt        *time.Time `json:"last_read_at,omitempty"`
+	}
+)
+
+func (c *MarkReadRequest) Check() error {
+	if c.MessageID == uuid.Nil {
+		return errors.New("message_id is required")
+	}
+	return nil
+}
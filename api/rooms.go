@@ -0,0 +1,104 @@
+package api
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var roomIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+// DirectRoomPrefix starts the IDs of the rooms of the direct conversations, no other room can use it.
+const DirectRoomPrefix = "dm-"
+
+type (
+	CreateRoomRequest struct {
+		ID         string `json:"id"`
+		Title      string `json:"title"`
+		Topic      string `json:"topic"`
+		Visibility string `json:"visibility"`
+	}
+
+	// UpdateRoomRequest only changes the fields present in the body.
+	UpdateRoomRequest struct {
+		Title      *string `json:"title"`
+		Topic      *string `json:"topic"`
+		Visibility *string `json:"visibility"`
+	}
+
+	InviteRequest struct {
+		NickName string `json:"nick_name"`
+	}
+
+	UpdateMemberRequest struct {
+		Role string `json:"role"`
+	}
+
+	MemberResponse struct {
+		UserID   uuid.UUID `json:"user_id"`
+		NickName string    `json:"nick_name,omitempty"`
+		Role     string    `json:"role"`
+		JoinedAt time.Time `json:"joined_at"`
+	}
+
+	// OnlineMemberResponse is a user connected to the room.
+	OnlineMemberResponse struct {
+		UserID   uuid.UUID `json:"user_id"`
+		NickName string    `json:"nick_name"`
+	}
+
+	RoomResponse struct {
+		ID         string     `json:"id"`
+		OwnerID    *uuid.UUID `json:"owner_id,omitempty"`
+		Title      string     `json:"title"`
+		Topic      string     `json:"topic"`
+		Visibility string     `json:"visibility"`
+		CreatedAt  time.Time  `json:"created_at"`
+	}
+)
+
+func (c *CreateRoomRequest) Check() error {
+	switch {
+	case !roomIDPattern.MatchString(c.ID):
+		return errors.New("id must be 1 to 50 lowercase letters, digits, '-' or '_'")
+	case strings.HasPrefix(c.ID, DirectRoomPrefix):
+		return errors.New("ids starting with " + DirectRoomPrefix + " are reserved for direct conversations")
+	case c.Title == "":
+		return errors.New("title is required")
+	case c.Visibility != "" && !validVisibility(c.Visibility):
+		return errors.New("visibility must be public or private")
+	}
+	return nil
+}
+
+func (c *UpdateRoomRequest) Check() error {
+	switch {
+	case c.Title != nil && *c.Title == "":
+		return errors.New("title cannot be empty")
+	case c.Visibility != nil && !validVisibility(*c.Visibility):
+		return errors.New("visibility must be public or private")
+	}
+	return nil
+}
+
+func (c *InviteRequest) Check() error {
+	if c.NickName == "" {
+		return errors.New("nick_name is required")
+	}
+	return nil
+}
+
+// Check only accepts the roles that can be granted, ownership is not transferable.
+func (c *UpdateMemberRequest) Check() error {
+	if c.Role != "moderator" && c.Role != "member" {
+		return errors.New("role must be moderator or member")
+	}
+	return nil
+}
+
+func validVisibility(visibility string) bool {
+	return visibility == "public" || visibility == "private"
+}
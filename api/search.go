@@ -0,0 +1,44 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxSearchText is the longest text a search can look for.
+const MaxSearchText = 256
+
+type (
+	// SearchRequest looks for the messages matching Text, in Room and by the author From when given.
+	// Before is the cursor of the previous page.
+	SearchRequest struct {
+		Text   string
+		Room   string
+		From   string
+		Before string
+	}
+
+	// SearchResultResponse is a message matching a search. The snippet is the body around the matched
+	// words, escaped for HTML, with the matched words wrapped in <mark> and </mark>.
+	SearchResultResponse struct {
+		Message MessageResponse `json:"message"`
+		Snippet string          `json:"snippet"`
+	}
+
+	// SearchResponse lists the matching messages newest first; NextCursor is empty on the last page.
+	SearchResponse struct {
+		Results    []SearchResultResponse `json:"results"`
+		NextCursor string                 `json:"next_cursor,omitempty"`
+	}
+)
+
+func (c *SearchRequest) Check() error {
+	switch {
+	case strings.TrimSpace(c.Text) == "":
+		return errors.New("q is required")
+	case utf8.RuneCountInString(c.Text) > MaxSearchText:
+		return errors.New("q must be at most 256 characters")
+	}
+	return nil
+}
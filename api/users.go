@@ -30,6 +30,7 @@ type (
 		LastName  string    `json:"last_name"`
 		Email     string    `json:"email"`
 		NickName  string    `json:"nick_name"`
+		Token     string    `json:"token,omitempty"`
 	}
 )
 
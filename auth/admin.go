@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+
+	"go-chat/api"
+)
+
+const forbiddenMsg = "admin access required"
+
+// RequireAdmin only lets through the identities whose user ID is in the admin list. Nicknames are
+// chosen by the users and not unique, so they never grant access. It must run after Middleware.
+func RequireAdmin(userIDs []uuid.UUID) echo.MiddlewareFunc {
+	admins := make(map[uuid.UUID]bool, len(userIDs))
+	for _, userID := range userIDs {
+		admins[userID] = true
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, ok := FromContext(c)
+			if !ok || !admins[identity.UserID] {
+				return c.JSON(http.StatusForbidden, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: forbiddenMsg})
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/rs/zerolog/log"
+
+	"go-chat/api"
+)
+
+const (
+	identityContextKey = "auth.identity"
+	tokenContextKey    = "auth.token"
+	// tokenQueryParam carries the token for websocket handshakes, browsers cannot set headers there.
+	tokenQueryParam = "token"
+	bearerPrefix    = "Bearer "
+	unauthorizedMsg = "invalid or missing token"
+)
+
+type validator interface {
+	Validate(token string) (Identity, error)
+}
+
+// Middleware rejects the requests without a valid session token and stores the identity in the context.
+func Middleware(sessions validator) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := tokenFromRequest(c)
+			if token == "" {
+				return c.JSON(http.StatusUnauthorized, &api.APIError{HTTPStatusCode: http.StatusUnauthorized, Msg: unauthorizedMsg})
+			}
+
+			identity, err := sessions.Validate(token)
+			if err == ErrInvalidToken {
+				return c.JSON(http.StatusUnauthorized, &api.APIError{HTTPStatusCode: http.StatusUnauthorized, Msg: unauthorizedMsg})
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("error validating session token")
+				return c.JSON(http.StatusInternalServerError, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Msg: err.Error()})
+			}
+
+			c.Set(identityContextKey, identity)
+			c.Set(tokenContextKey, token)
+			return next(c)
+		}
+	}
+}
+
+// FromContext returns the identity stored by Middleware.
+func FromContext(c echo.Context) (Identity, bool) {
+	identity, ok := c.Get(identityContextKey).(Identity)
+	return identity, ok
+}
+
+// TokenFromContext returns the token validated by Middleware.
+func TokenFromContext(c echo.Context) string {
+	token, _ := c.Get(tokenContextKey).(string)
+	return token
+}
+
+func tokenFromRequest(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if strings.HasPrefix(header, bearerPrefix) {
+		return strings.TrimSpace(strings.TrimPrefix(header, bearerPrefix))
+	}
+	return c.QueryParam(tokenQueryParam)
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+)
+
+type (
+	sessionsMock struct {
+		tokens map[string]Identity
+		fail   bool
+	}
+)
+
+func NewSessionsMock(fail bool) *sessionsMock {
+	return &sessionsMock{
+		tokens: map[string]Identity{"valid": {UserID: uuid.New(), Nickname: "any_nickname"}},
+		fail:   fail,
+	}
+}
+
+func (s sessionsMock) Validate(token string) (Identity, error) {
+	if s.fail {
+		return Identity{}, errors.New("redis unavailable")
+	}
+	identity, ok := s.tokens[token]
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+	return identity, nil
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		sessions   *sessionsMock
+		header     string
+		target     string
+		wantStatus int
+	}{
+		{
+			name:       "Authenticate - Bearer header",
+			sessions:   NewSessionsMock(false),
+			header:     "Bearer valid",
+			target:     "/api/v1/anything",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Authenticate - Token query param",
+			sessions:   NewSessionsMock(false),
+			target:     "/websocket/random?token=valid",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "Authenticate - Missing token",
+			sessions:   NewSessionsMock(false),
+			target:     "/api/v1/anything",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Authenticate - Unknown token",
+			sessions:   NewSessionsMock(false),
+			header:     "Bearer forged",
+			target:     "/api/v1/anything",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "Authenticate - Error validating",
+			sessions:   NewSessionsMock(true),
+			header:     "Bearer valid",
+			target:     "/api/v1/anything",
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			next := func(c echo.Context) error {
+				identity, ok := FromContext(c)
+				if !ok || identity.Nickname != "any_nickname" {
+					t.Errorf("identity not stored in context")
+				}
+				return c.NoContent(http.StatusOK)
+			}
+			if err := Middleware(tt.sessions)(next)(c); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	admin := Identity{UserID: uuid.New(), Nickname: "admin"}
+	tests := []struct {
+		name       string
+		identity   *Identity
+		wantStatus int
+	}{
+		{name: "Require admin - Admin", identity: &admin, wantStatus: http.StatusOK},
+		{name: "Require admin - Same nickname", identity: &Identity{UserID: uuid.New(), Nickname: "admin"}, wantStatus: http.StatusForbidden},
+		{name: "Require admin - Anonymous", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/api/v1/admin/anything", nil), rec)
+			if tt.identity != nil {
+				c.Set(identityContextKey, *tt.identity)
+			}
+
+			next := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+			if err := RequireAdmin([]uuid.UUID{admin.UserID})(next)(c); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+)
+
+const (
+	sessionKeyPrefix  = "sessions:"
+	tokenSize         = 32
+	defaultSessionTTL = 24 * time.Hour
+)
+
+// ErrInvalidToken is returned when a token is unknown or expired.
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+type (
+	// Identity is the authenticated user behind a session token.
+	Identity struct {
+		UserID   uuid.UUID `json:"user_id"`
+		Nickname string    `json:"nickname"`
+	}
+
+	// Sessions issues opaque session tokens and keeps them in redis until they expire.
+	Sessions struct {
+		RedisClient *redis.Client
+		TTL         time.Duration
+	}
+)
+
+func NewSessions(redisClient *redis.Client, ttl time.Duration) *Sessions {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	return &Sessions{
+		RedisClient: redisClient,
+		TTL:         ttl,
+	}
+}
+
+// Issue creates a new session for the identity and returns its token.
+func (s *Sessions) Issue(identity Identity) (string, error) {
+	buf := make([]byte, tokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	body, err := json.Marshal(identity)
+	if err != nil {
+		return "", err
+	}
+	if err := s.RedisClient.Set(sessionKey(token), body, s.TTL).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Validate returns the identity of a live session.
+func (s *Sessions) Validate(token string) (Identity, error) {
+	body, err := s.RedisClient.Get(sessionKey(token)).Bytes()
+	if err == redis.Nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+
+	var identity Identity
+	if err := json.Unmarshal(body, &identity); err != nil {
+		return Identity{}, err
+	}
+	return identity, nil
+}
+
+// Revoke ends the session so the token can no longer be used.
+func (s *Sessions) Revoke(token string) error {
+	return s.RedisClient.Del(sessionKey(token)).Err()
+}
+
+func sessionKey(token string) string {
+	return sessionKeyPrefix + token
+}
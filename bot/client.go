@@ -66,15 +66,18 @@ func (c StocksClient) GetStockFile(stockCode string) (StockData, error) {
 	log.Info().Msg(fmt.Sprintf("calling url %s ", url))
 
 	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return StockData{}, err
+	}
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := c.Getter.Do(req)
-
+	if err != nil {
+		return StockData{}, HandleHTTPClientError(err)
+	}
 	defer resp.Body.Close()
 
 	switch {
-	case err != nil:
-		return StockData{}, HandleHTTPClientError(err)
 	case resp.StatusCode != http.StatusOK:
 		buf := new(bytes.Buffer)
 		buf.ReadFrom(resp.Body)
@@ -1,17 +1,15 @@
 package bot
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/labstack/echo"
-	rabbit "github.com/rabbitmq/amqp091-go"
-	"github.com/rs/zerolog/log"
 
 	"go-chat/api"
-	"go-chat/chatrooms"
+	"go-chat/commands"
 )
 
 const (
@@ -19,45 +17,37 @@ const (
 	stockNotFoundedMessage   = "Invalid stock code for command /stock=%v"
 	stockServiceNotAvailable = "Stock service is not available"
 	noDataIdentifier         = "N/D"
-	broadcasterChannelName   = "broadcast-channel"
+	stockCommandName         = "stock"
 )
 
 type (
 	stockClient interface {
 		GetStockFile(stockCode string) (StockData, error)
 	}
-	publisher interface {
-		Publish(channelName string, body []byte) error
-	}
 	BotMgr struct {
 		stockClient stockClient
-		publisher   publisher
-		conn        *rabbit.Connection
 	}
 )
 
-func NewBotMgr(client stockClient, publisher publisher, conn *rabbit.Connection) *BotMgr {
+func NewBotMgr(client stockClient) *BotMgr {
 	return &BotMgr{
 		stockClient: client,
-		publisher:   publisher,
-		conn:        conn,
 	}
 }
 
-func (bm *BotMgr) GetAndPublishStockPrice(chatMsg chatrooms.ChatMessage) error {
-	stockMsg, _ := bm.GetStockPrice(nil, getStockCode(chatMsg.Text))
-
-	chatMsg.Text = stockMsg
-	chatMsg.Username = "Bot"
-	chatMsgAsByte, err := json.Marshal(chatMsg)
-	if err != nil {
-		log.Error().Err(err)
+// StockCommand returns the /stock command answering with the current quote of a stock.
+func (bm *BotMgr) StockCommand() commands.Command {
+	return commands.Command{
+		Name:    stockCommandName,
+		Usage:   "<stock_code>",
+		Help:    "replies with the current quote of the stock, e.g. /stock=aapl.us",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Exec: func(ctx context.Context, inv commands.Invocation) (string, error) {
+			stockMsg, _ := bm.GetStockPrice(nil, inv.Args[0])
+			return stockMsg, nil
+		},
 	}
-	err = bm.publisher.Publish(broadcasterChannelName, chatMsgAsByte)
-	if err != nil {
-		return err
-	}
-	return nil
 }
 
 func (bm *BotMgr) GetStockPrice(ctx echo.Context, stockCode string) (string, *api.APIError) {
@@ -66,19 +56,17 @@ func (bm *BotMgr) GetStockPrice(ctx echo.Context, stockCode string) (string, *ap
 		return stockServiceNotAvailable, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Cause: err}
 	}
 
-	return readFileAndGetStockPrice(stockData), &api.APIError{}
+	return readFileAndGetStockPrice(stockData), nil
 }
 
 func readFileAndGetStockPrice(stockData StockData) string {
+	if len(stockData.Data) < 2 || len(stockData.Data[1]) == 0 {
+		return fmt.Sprintf(stockNotFoundedMessage, stockData.StockCode)
+	}
 	stockValues := strings.Split(stockData.Data[1][0], ",")
-	currentStockPrice := stockValues[3]
-	if stockValues[3] == noDataIdentifier {
+	if len(stockValues) < 4 || stockValues[3] == noDataIdentifier {
 		return fmt.Sprintf(stockNotFoundedMessage, stockData.StockCode)
 	}
+	currentStockPrice := stockValues[3]
 	return fmt.Sprintf(stockMessage, strings.ToUpper(stockData.StockCode), currentStockPrice)
 }
-
-func getStockCode(message string) string {
-	// probably here it could handle not understood messages or format
-	return strings.Split(message, "=")[1]
-}
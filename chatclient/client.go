@@ -0,0 +1,154 @@
+// Package chatclient speaks the chatrooms websocket protocol. It is used by the tests and by tools
+// talking to a running server.
+package chatclient
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"go-chat/chatrooms"
+)
+
+var (
+	ErrTimeout            = errors.New("no frame received before the deadline")
+	ErrUnsupportedVersion = errors.New("the server does not speak the protocol version")
+)
+
+// Conn is a websocket connection to a chatroom.
+type Conn struct {
+	ws *websocket.Conn
+	// mu serializes the writes, the reads belong to a single caller
+	mu sync.Mutex
+}
+
+// Dial joins the room of the server at serverURL (http or ws) with the session token, speaking
+// the current protocol version.
+func Dial(serverURL, roomID, token string) (*Conn, error) {
+	return DialVersion(serverURL, roomID, token, chatrooms.ProtocolVersion)
+}
+
+// DialVersion is Dial asking for the given protocol version, the handshake fails when the server
+// does not speak it.
+func DialVersion(serverURL, roomID, token string, version int) (*Conn, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/websocket/" + url.PathEscape(roomID)
+	u.RawQuery = url.Values{"token": {token}}.Encode()
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{chatrooms.Subprotocol(version)}
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if ws.Subprotocol() != dialer.Subprotocols[0] {
+		ws.Close()
+		return nil, ErrUnsupportedVersion
+	}
+	return &Conn{ws: ws}, nil
+}
+
+// Protocol returns the protocol version agreed with the server.
+func (c *Conn) Protocol() string {
+	return c.ws.Subprotocol()
+}
+
+// Send sends a chat message with a new client ID and returns that ID.
+func (c *Conn) Send(text string) (string, error) {
+	clientID := uuid.New().String()
+	return clientID, c.Resend(clientID, text)
+}
+
+// Resend sends a chat message with the given client ID, the server acknowledges it only once.
+func (c *Conn) Resend(clientID, text string) error {
+	return c.write(chatrooms.FrameMessageSend, chatrooms.SendPayload{ClientID: clientID, Text: text})
+}
+
+// Reply sends a chat message replying to the given message and returns its client ID.
+func (c *Conn) Reply(parentID, text string) (string, error) {
+	clientID := uuid.New().String()
+	return clientID, c.write(chatrooms.FrameMessageSend, chatrooms.SendPayload{ClientID: clientID, Text: text, ParentID: parentID})
+}
+
+// SendReceipt reports the message as delivered or read to its author.
+func (c *Conn) SendReceipt(msg chatrooms.ChatMessage, state string) error {
+	return c.write(chatrooms.FrameMessageReceipt, chatrooms.ReceiptPayload{
+		MessageID: msg.ID,
+		State:     state,
+	})
+}
+
+// React adds the reaction to the message, the room gets a reaction.add once it is stored.
+func (c *Conn) React(messageID, emoji string) error {
+	return c.write(chatrooms.FrameReactionAdd, chatrooms.ReactionPayload{MessageID: messageID, Emoji: emoji})
+}
+
+// Unreact removes the reaction from the message.
+func (c *Conn) Unreact(messageID, emoji string) error {
+	return c.write(chatrooms.FrameReactionRemove, chatrooms.ReactionPayload{MessageID: messageID, Emoji: emoji})
+}
+
+// WriteFrame sends a raw frame.
+func (c *Conn) WriteFrame(frame chatrooms.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ws.WriteJSON(frame)
+}
+
+// Next returns the next frame sent by the server. After ErrTimeout the connection is no longer usable.
+func (c *Conn) Next(timeout time.Duration) (chatrooms.Frame, error) {
+	c.ws.SetReadDeadline(time.Now().Add(timeout))
+	var frame chatrooms.Frame
+	if err := c.ws.ReadJSON(&frame); err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return chatrooms.Frame{}, ErrTimeout
+		}
+		return chatrooms.Frame{}, err
+	}
+	return frame, nil
+}
+
+// Expect skips frames until one of the given type arrives and decodes its payload into v.
+// The skipped frames are lost.
+func (c *Conn) Expect(frameType string, timeout time.Duration, v interface{}) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrTimeout
+		}
+		frame, err := c.Next(remaining)
+		if err != nil {
+			return err
+		}
+		if frame.Type == frameType {
+			return frame.DecodePayload(v)
+		}
+	}
+}
+
+// Close closes the connection, leaving the room.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return c.ws.Close()
+}
+
+func (c *Conn) write(frameType string, payload interface{}) error {
+	frame, err := chatrooms.NewFrame(frameType, payload)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(frame)
+}
@@ -0,0 +1,235 @@
+package chatclient
+
+import (
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+
+	"go-chat/api"
+	"go-chat/auth"
+	"go-chat/chatrooms"
+	"go-chat/events"
+)
+
+const timeout = 5 * time.Second
+
+type (
+	sessionsMock struct {
+		tokens map[string]auth.Identity
+	}
+	roomsMock   struct{}
+	historyMock struct{}
+
+	// authorsMock records the authors of the messages as the stand-in processor stores them.
+	authorsMock struct {
+		authors sync.Map
+	}
+)
+
+func (s sessionsMock) Validate(token string) (auth.Identity, error) {
+	identity, ok := s.tokens[token]
+	if !ok {
+		return auth.Identity{}, auth.ErrInvalidToken
+	}
+	return identity, nil
+}
+
+func (roomsMock) CheckAccess(uuid.UUID, string) *api.APIError { return nil }
+
+func (historyMock) Append(chatrooms.ChatMessage) error { return nil }
+
+func (historyMock) Replay(string) ([]chatrooms.ChatMessage, error) { return nil, nil }
+
+func (a *authorsMock) MessageAuthor(_, messageID string) (string, error) {
+	authorID, ok := a.authors.Load(messageID)
+	if !ok {
+		return "", chatrooms.ErrUnknownMessage
+	}
+	return authorID.(string), nil
+}
+
+// newServer runs the chatrooms handler on an in-memory broker, with a consumer standing in for the
+// message processor: it stores nothing but announces every message as persisted.
+func newServer(t *testing.T, identities map[string]auth.Identity) *httptest.Server {
+	t.Helper()
+	broker := events.NewMemoryBroker()
+	hub := chatrooms.NewHub()
+	authors := &authorsMock{}
+	h := &chatrooms.Handler{Rooms: roomsMock{}, History: historyMock{}, Publisher: broker, Authors: authors, Hub: hub}
+
+	roomEvents, err := broker.Subscribe(chatrooms.EventsExchangeName, h.HandleEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.SetBinder(roomEvents)
+	go h.HandleMessages()
+
+	err = broker.Consume(chatrooms.MessagesChannelName, func(msg events.Message) {
+		envelope, err := events.Decode(msg.Body)
+		if err != nil {
+			msg.Reject()
+			return
+		}
+		var chatMessage chatrooms.ChatMessage
+		envelope.DecodePayload(&chatMessage)
+		authors.authors.Store(chatMessage.ID, chatMessage.UserID)
+		chatMessage.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+		persisted, _ := events.NewEnvelope(events.TypeMessagePersisted, "messages", chatMessage)
+		body, _ := persisted.Encode()
+		broker.PublishEvent(chatrooms.EventsExchangeName, chatMessage.Room, body)
+		msg.Ack()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.GET("/websocket/:id", h.HandleConnections, auth.Middleware(sessionsMock{tokens: identities}))
+	server := httptest.NewServer(e)
+	t.Cleanup(func() {
+		server.Close()
+		broker.Close()
+	})
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server, token string) *Conn {
+	t.Helper()
+	conn, err := Dial(server.URL, "random", token)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// frames are read once the connection joined the room, so any reply proves it did
+	if err := conn.WriteFrame(chatrooms.Frame{Type: "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply chatrooms.ErrorPayload
+	if err := conn.Expect(chatrooms.FrameError, timeout, &reply); err != nil {
+		t.Fatalf("waiting for the connection to join: %v", err)
+	}
+	return conn
+}
+
+func TestConn_DeliveryStates(t *testing.T) {
+	alice := auth.Identity{UserID: uuid.New(), Nickname: "alice"}
+	bob := auth.Identity{UserID: uuid.New(), Nickname: "bob"}
+	server := newServer(t, map[string]auth.Identity{"alice": alice, "bob": bob})
+
+	sender := dial(t, server, "alice")
+	recipient := dial(t, server, "bob")
+	clientID, err := sender.Send("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var accepted chatrooms.AckPayload
+	if err := sender.Expect(chatrooms.FrameMessageAck, timeout, &accepted); err != nil {
+		t.Fatalf("waiting for the accepted ack: %v", err)
+	}
+	if accepted.ClientID != clientID || accepted.State != chatrooms.StateAccepted || accepted.ID == clientID {
+		t.Errorf("ack = %+v, want %s accepted with a server id", accepted, clientID)
+	}
+
+	var persisted chatrooms.AckPayload
+	if err := sender.Expect(chatrooms.FrameMessageAck, timeout, &persisted); err != nil {
+		t.Fatalf("waiting for the persisted ack: %v", err)
+	}
+	if persisted.ID != accepted.ID || persisted.State != chatrooms.StatePersisted || persisted.Timestamp == "" {
+		t.Errorf("ack = %+v, want %s persisted", persisted, accepted.ID)
+	}
+
+	var msg chatrooms.ChatMessage
+	if err := recipient.Expect(chatrooms.FrameMessageNew, timeout, &msg); err != nil {
+		t.Fatalf("waiting for the message: %v", err)
+	}
+	if msg.ID != accepted.ID || msg.Username != "alice" || msg.Text != "hello" {
+		t.Errorf("message = %+v, want hello from alice", msg)
+	}
+
+	if err := recipient.SendReceipt(msg, chatrooms.StateRead); err != nil {
+		t.Fatal(err)
+	}
+	var receipt chatrooms.ReceiptPayload
+	if err := sender.Expect(chatrooms.FrameMessageReceipt, timeout, &receipt); err != nil {
+		t.Fatalf("waiting for the receipt: %v", err)
+	}
+	if receipt.MessageID != accepted.ID || receipt.UserID != bob.UserID.String() || receipt.State != chatrooms.StateRead {
+		t.Errorf("receipt = %+v, want %s read by bob", receipt, accepted.ID)
+	}
+}
+
+func TestConn_UnknownFrame(t *testing.T) {
+	server := newServer(t, map[string]auth.Identity{"alice": {UserID: uuid.New(), Nickname: "alice"}})
+	conn, err := Dial(server.URL, "random", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteFrame(chatrooms.Frame{Type: "message.shout"}); err != nil {
+		t.Fatal(err)
+	}
+	var reply chatrooms.ErrorPayload
+	if err := conn.Expect(chatrooms.FrameError, timeout, &reply); err != nil {
+		t.Fatalf("waiting for the error: %v", err)
+	}
+	if reply.Code != chatrooms.ErrCodeUnknownType || reply.Type != "message.shout" {
+		t.Errorf("error = %+v, want %s for message.shout", reply, chatrooms.ErrCodeUnknownType)
+	}
+}
+
+func TestDial_Subprotocol(t *testing.T) {
+	server := newServer(t, map[string]auth.Identity{"alice": {UserID: uuid.New(), Nickname: "alice"}})
+
+	conn, err := Dial(server.URL, "random", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Protocol() != chatrooms.Subprotocol(chatrooms.ProtocolVersion) {
+		t.Errorf("Protocol() = %q, want %q", conn.Protocol(), chatrooms.Subprotocol(chatrooms.ProtocolVersion))
+	}
+
+	if _, err := DialVersion(server.URL, "random", "alice", chatrooms.ProtocolVersion+1); err == nil {
+		t.Errorf("DialVersion() should fail for an unsupported version")
+	}
+}
+
+func TestDial_InvalidToken(t *testing.T) {
+	server := newServer(t, nil)
+	if _, err := Dial(server.URL, "random", "unknown"); err == nil || errors.Is(err, ErrTimeout) {
+		t.Errorf("Dial() error = %v, want a handshake error", err)
+	}
+}
+
+func TestConn_Reply(t *testing.T) {
+	alice := auth.Identity{UserID: uuid.New(), Nickname: "alice"}
+	server := newServer(t, map[string]auth.Identity{"alice": alice})
+	conn := dial(t, server, "alice")
+
+	if _, err := conn.Send("first"); err != nil {
+		t.Fatal(err)
+	}
+	var parent chatrooms.ChatMessage
+	if err := conn.Expect(chatrooms.FrameMessageNew, timeout, &parent); err != nil {
+		t.Fatalf("waiting for the message: %v", err)
+	}
+
+	if _, err := conn.Reply(parent.ID, "second"); err != nil {
+		t.Fatal(err)
+	}
+	var reply chatrooms.ChatMessage
+	if err := conn.Expect(chatrooms.FrameMessageNew, timeout, &reply); err != nil {
+		t.Fatalf("waiting for the reply: %v", err)
+	}
+	if reply.ParentID != parent.ID || reply.Text != "second" {
+		t.Errorf("reply = %+v, want second replying to %s", reply, parent.ID)
+	}
+}
@@ -0,0 +1,260 @@
+package chatrooms
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DropMessages discards the messages that do not fit in the client outbound queue.
+	DropMessages SlowConsumerPolicy = iota
+	// Disconnect closes the connection of a client that cannot keep up.
+	Disconnect
+)
+
+const (
+	defaultSendBufferSize = 256
+	defaultWriteWait      = 10 * time.Second
+	defaultPongWait       = 60 * time.Second
+	defaultMaxMessageSize = 4096
+)
+
+var errUnknownPolicy = errors.New("unknown slow consumer policy")
+
+type (
+	// SlowConsumerPolicy decides what happens when the outbound queue of a client is full.
+	SlowConsumerPolicy int
+
+	// ClientConfig holds the settings applied to every websocket connection.
+	ClientConfig struct {
+		SendBufferSize int
+		WriteWait      time.Duration
+		PongWait       time.Duration
+		PingPeriod     time.Duration
+		MaxMessageSize int64
+		SlowConsumer   SlowConsumerPolicy
+	}
+
+	// wsConn is the part of *websocket.Conn used by a Client.
+	wsConn interface {
+		ReadJSON(v interface{}) error
+		WriteJSON(v interface{}) error
+		WriteControl(messageType int, data []byte, deadline time.Time) error
+		SetReadLimit(limit int64)
+		SetReadDeadline(t time.Time) error
+		SetWriteDeadline(t time.Time) error
+		SetPongHandler(h func(appData string) error)
+		Close() error
+	}
+
+	// Client wraps a websocket connection so that a single goroutine writes to it.
+	Client struct {
+		// UserID identifies the authenticated user behind the connection.
+		UserID string
+
+		conn wsConn
+		cfg  ClientConfig
+
+		send      chan Frame
+		done      chan struct{}
+		closeOnce sync.Once
+		// shutdown asks the writer to flush the queued frames before closing
+		shutdown     chan struct{}
+		shutdownOnce sync.Once
+	}
+)
+
+// DefaultClientConfig returns the client settings used when nothing else is configured.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		SendBufferSize: defaultSendBufferSize,
+		WriteWait:      defaultWriteWait,
+		PongWait:       defaultPongWait,
+		PingPeriod:     (defaultPongWait * 9) / 10,
+		MaxMessageSize: defaultMaxMessageSize,
+		SlowConsumer:   DropMessages,
+	}
+}
+
+// ParseSlowConsumerPolicy maps the configuration value ("drop" or "disconnect") to a policy.
+func ParseSlowConsumerPolicy(value string) (SlowConsumerPolicy, error) {
+	switch value {
+	case "drop":
+		return DropMessages, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropMessages, errUnknownPolicy
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if p == Disconnect {
+		return "disconnect"
+	}
+	return "drop"
+}
+
+// withDefaults fills the unset fields with the values of DefaultClientConfig.
+func (cfg ClientConfig) withDefaults() ClientConfig {
+	def := DefaultClientConfig()
+	if cfg.SendBufferSize <= 0 {
+		cfg.SendBufferSize = def.SendBufferSize
+	}
+	if cfg.WriteWait <= 0 {
+		cfg.WriteWait = def.WriteWait
+	}
+	if cfg.PongWait <= 0 {
+		cfg.PongWait = def.PongWait
+	}
+	if cfg.PingPeriod <= 0 || cfg.PingPeriod >= cfg.PongWait {
+		cfg.PingPeriod = (cfg.PongWait * 9) / 10
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = def.MaxMessageSize
+	}
+	return cfg
+}
+
+func newClient(conn wsConn, cfg ClientConfig) *Client {
+	cfg = cfg.withDefaults()
+	return &Client{
+		conn:     conn,
+		cfg:      cfg,
+		send:     make(chan Frame, cfg.SendBufferSize),
+		done:     make(chan struct{}),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Send queues the frame for the client without blocking the caller.
+// It returns false when the frame was not queued.
+func (c *Client) Send(frame Frame) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- frame:
+		return true
+	case <-c.done:
+		return false
+	default:
+	}
+
+	if c.cfg.SlowConsumer == Disconnect {
+		log.Warn().Msg("disconnecting slow websocket client")
+		c.Close()
+		return false
+	}
+	log.Warn().Msg("dropping message for slow websocket client")
+	return false
+}
+
+// Close stops the writer and closes the underlying connection. It is safe to call more than once.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// Shutdown writes the frames already queued and a close message, then closes the client.
+func (c *Client) Shutdown() {
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+// Done is closed once the client has been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// writePump is the only goroutine writing to the connection.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(c.cfg.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+	}()
+
+	for {
+		select {
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				if unsafeError(err) {
+					log.Error().Err(err).Msg("error writing to websocket")
+				}
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(c.cfg.WriteWait)); err != nil {
+				return
+			}
+		case <-c.shutdown:
+			c.flush()
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// flush writes the queued frames and a close message.
+func (c *Client) flush() {
+	for {
+		select {
+		case frame := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteWait))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				return
+			}
+		default:
+			closing := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			c.conn.WriteControl(websocket.CloseMessage, closing, time.Now().Add(c.cfg.WriteWait))
+			return
+		}
+	}
+}
+
+// readPump reads frames until the connection fails, passing each of them to handle.
+// Frames that are not valid JSON are answered with an error and skipped.
+func (c *Client) readPump(handle func(frame Frame)) {
+	defer c.Close()
+
+	c.conn.SetReadLimit(c.cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.cfg.PongWait))
+	})
+
+	for {
+		var frame Frame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			if decodeError(err) {
+				c.Send(errorFrame("", ErrCodeInvalidFrame, err.Error()))
+				continue
+			}
+			if unsafeError(err) {
+				log.Error().Err(err).Msg("error reading from websocket")
+			}
+			return
+		}
+		handle(frame)
+	}
+}
+
+// decodeError reports whether the frame was read but is not valid JSON, the connection is still usable.
+func decodeError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
@@ -0,0 +1,275 @@
+package chatrooms
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+type (
+	conn struct {
+		incoming chan Frame
+		closed   chan struct{}
+		once     sync.Once
+
+		writeDelay time.Duration
+		writing    int32
+		overlapped int32
+		mu         sync.Mutex
+		written    []Frame
+	}
+)
+
+func NewConnMock(writeDelay time.Duration) *conn {
+	return &conn{
+		incoming:   make(chan Frame),
+		closed:     make(chan struct{}),
+		writeDelay: writeDelay,
+	}
+}
+
+func (c *conn) ReadJSON(v interface{}) error {
+	select {
+	case msg := <-c.incoming:
+		*(v.(*Frame)) = msg
+		return nil
+	case <-c.closed:
+		return errConnClosed
+	}
+}
+
+func (c *conn) WriteJSON(v interface{}) error {
+	if atomic.AddInt32(&c.writing, 1) > 1 {
+		atomic.StoreInt32(&c.overlapped, 1)
+	}
+	defer atomic.AddInt32(&c.writing, -1)
+
+	select {
+	case <-c.closed:
+		return errConnClosed
+	default:
+	}
+	time.Sleep(c.writeDelay)
+	c.mu.Lock()
+	c.written = append(c.written, v.(Frame))
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) WriteControl(int, []byte, time.Time) error { return nil }
+func (c *conn) SetReadLimit(int64)                        {}
+func (c *conn) SetReadDeadline(time.Time) error           { return nil }
+func (c *conn) SetWriteDeadline(time.Time) error          { return nil }
+func (c *conn) SetPongHandler(func(string) error)         {}
+
+func (c *conn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *conn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *conn) messages() []Frame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Frame(nil), c.written...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHub_BroadcastOnlyToRoomMembers(t *testing.T) {
+	const (
+		clientsPerRoom = 20
+		senders        = 10
+		msgsPerSender  = 10
+	)
+	hub := NewHub()
+	rooms := []string{"tech", "music"}
+	conns := map[string][]*conn{}
+
+	for _, roomID := range rooms {
+		for i := 0; i < clientsPerRoom; i++ {
+			c := NewConnMock(0)
+			client := newClient(c, ClientConfig{SendBufferSize: senders * msgsPerSender})
+			go client.writePump()
+			hub.Join(roomID, client)
+			conns[roomID] = append(conns[roomID], c)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+			for i := 0; i < msgsPerSender; i++ {
+				hub.Broadcast(ChatMessage{Username: fmt.Sprint(s), Text: fmt.Sprint(i), Room: "tech"})
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	for _, c := range conns["tech"] {
+		c := c
+		waitFor(t, func() bool { return len(c.messages()) == senders*msgsPerSender })
+		if atomic.LoadInt32(&c.overlapped) != 0 {
+			t.Errorf("concurrent writes detected on a connection")
+		}
+	}
+	for _, c := range conns["music"] {
+		if got := len(c.messages()); got != 0 {
+			t.Errorf("music member received %d messages sent to tech", got)
+		}
+	}
+}
+
+func TestHub_LeaveClosesEmptyRoom(t *testing.T) {
+	hub := NewHub()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client := newClient(NewConnMock(0), ClientConfig{})
+			go client.writePump()
+			hub.Join("random", client)
+			hub.Broadcast(ChatMessage{Room: "random", Text: "hi"})
+			hub.Leave("random", client)
+			client.Close()
+		}()
+	}
+	wg.Wait()
+
+	if _, ok := hub.Room("random"); ok {
+		t.Errorf("room should be closed once every member left")
+	}
+}
+
+func TestClient_SlowConsumerPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     SlowConsumerPolicy
+		wantClosed bool
+	}{
+		{
+			name:       "Slow consumer - Drop messages",
+			policy:     DropMessages,
+			wantClosed: false,
+		},
+		{
+			name:       "Slow consumer - Disconnect",
+			policy:     Disconnect,
+			wantClosed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConnMock(50 * time.Millisecond)
+			client := newClient(c, ClientConfig{SendBufferSize: 1, SlowConsumer: tt.policy})
+			go client.writePump()
+			defer client.Close()
+
+			queued := 0
+			for i := 0; i < 10; i++ {
+				if client.Send(Frame{Type: fmt.Sprint(i)}) {
+					queued++
+				}
+			}
+			if queued == 10 {
+				t.Errorf("expected some messages to be rejected")
+			}
+			if c.isClosed() != tt.wantClosed {
+				t.Errorf("closed = %v, want %v", c.isClosed(), tt.wantClosed)
+			}
+		})
+	}
+}
+
+func TestClient_ReadPumpStopsWriter(t *testing.T) {
+	c := NewConnMock(0)
+	client := newClient(c, ClientConfig{})
+	go client.writePump()
+
+	received := make(chan Frame, 1)
+	go client.readPump(func(frame Frame) { received <- frame })
+
+	c.incoming <- Frame{Type: FrameMessageSend}
+	if frame := <-received; frame.Type != FrameMessageSend {
+		t.Errorf("got %q, want %s", frame.Type, FrameMessageSend)
+	}
+
+	c.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not closed after the connection failed")
+	}
+	if client.Send(Frame{Type: FrameMessageNew}) {
+		t.Errorf("send after close should be rejected")
+	}
+}
+
+func TestHub_Evict(t *testing.T) {
+	hub := NewHub()
+	kept, evicted := NewConnMock(0), NewConnMock(0)
+	for userID, c := range map[string]*conn{"member": kept, "stranger": evicted} {
+		client := newClient(c, ClientConfig{})
+		client.UserID = userID
+		go client.writePump()
+		hub.Join("private", client)
+	}
+
+	hub.Evict("private", func(userID string) bool { return userID == "member" })
+
+	waitFor(t, evicted.isClosed)
+	if notices := evicted.messages(); len(notices) != 1 || notices[0].Type != FrameSystemNotice {
+		t.Errorf("evicted client got %+v, want a notice", notices)
+	}
+	if kept.isClosed() {
+		t.Errorf("member client should stay connected")
+	}
+}
+
+func TestHub_FullRoomDoesNotBlock(t *testing.T) {
+	hub := NewHub()
+	// a room nobody drains
+	hub.rooms["busy"] = newRoom("busy")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= roomBufferSize; i++ {
+			hub.BroadcastFrame("busy", Frame{Type: FrameMessageNew})
+		}
+		hub.Join("random", newClient(NewConnMock(0), ClientConfig{}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a full room blocked the hub")
+	}
+	if queued := len(hub.rooms["busy"].broadcast); queued != roomBufferSize {
+		t.Errorf("queued %d frames, want the %d the room holds", queued, roomBufferSize)
+	}
+}
@@ -1,189 +1,701 @@
 package chatrooms
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
 
-	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo"
-	rabbit "github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog/log"
 
 	"go-chat/api"
+	"go-chat/auth"
+	"go-chat/commands"
+	"go-chat/events"
 )
 
 const (
-	stockCommandString     = "/stock="
-	messagesChannelName    = "chat-channel"
-	broadcasterChannelName = "broadcast-channel"
+	MessagesChannelName = "chat-channel"
+	eventSource         = "chatrooms"
+
+	// EventsExchangeName fans out the room events to every instance, the routing key is the room id.
+	EventsExchangeName = "chat-events"
 )
 
 var (
-	clients      = make(map[*websocket.Conn]bool)
-	broadcaster  = make(chan ChatMessage)
 	connUpgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    supportedSubprotocols(),
 	}
-	roomId string
 )
 
 type (
-	botMgr interface {
-		GetStockPrice(ctx echo.Context, stockCode string) (string, *api.APIError)
-	}
 	publisher interface {
 		Publish(channelName string, body []byte) error
-		Consume(channelName string) (<-chan rabbit.Delivery, error)
+		PublishEvent(exchange, routingKey string, body []byte) error
+	}
+	roomsMgr interface {
+		CheckAccess(userID uuid.UUID, roomID string) *api.APIError
+	}
+	historyStore interface {
+		Append(msg ChatMessage) error
+		Replay(roomID string) ([]ChatMessage, error)
+	}
+	presenceTracker interface {
+		Join(roomID, connID string, member PresenceMember) (bool, error)
+		Leave(roomID, connID string, member PresenceMember) (bool, error)
+	}
+	deduplicator interface {
+		FirstSeen(userID, clientID, messageID string) (string, bool, error)
+		Forget(userID, clientID string) error
+	}
+	// reactionStore stores the reactions and reports whether they changed, or ErrUnknownMessage when
+	// the message is not one of the room.
+	reactionStore interface {
+		AddReaction(reaction ReactionPayload) (bool, error)
+		RemoveReaction(reaction ReactionPayload) (bool, error)
+	}
+	rateLimiter interface {
+		Allow(key string) (bool, error)
+	}
+	// threadResolver returns the first message of the thread of a message of the room, or
+	// ErrUnknownMessage when the message is not one of the room.
+	threadResolver interface {
+		ThreadRoot(roomID, messageID string) (string, error)
+	}
+
+	// messageAuthors returns the author of a message of the room, or ErrUnknownMessage when the
+	// message is not one of the room.
+	messageAuthors interface {
+		MessageAuthor(roomID, messageID string) (string, error)
+	}
+
+	// readMarkers moves the read markers of the users and tells every connection of the user, or
+	// returns ErrUnknownMessage when the message is not one of the room.
+	readMarkers interface {
+		AdvanceReadMarker(marker ReadMarkerPayload) error
 	}
 
 	Handler struct {
-		BotManager  botMgr
-		RedisClient *redis.Client
-		Publisher   publisher
+		Rooms     roomsMgr
+		History   historyStore
+		Publisher publisher
+		// Seen, when set, drops the messages resent with a client ID already accepted.
+		Seen deduplicator
+		// Presence, when set, announces the users joining and leaving the rooms.
+		Presence presenceTracker
+		// Typing, when set, relays the typing indicators to the other members.
+		Typing *TypingIndicators
+		// Reactions, when set, lets the users react to the messages.
+		Reactions reactionStore
+		// ReactionLimit, when set, rejects the reaction changes of the users making too many.
+		ReactionLimit rateLimiter
+		// Threads, when set, checks the messages replied to and attaches the replies to the first
+		// message of their thread.
+		Threads threadResolver
+		// Reads, when set, lets the users move their read markers.
+		Reads readMarkers
+		// Authors, when set, lets the users send receipts, routed to the authors of the messages.
+		Authors messageAuthors
+		Hub     *Hub
+		// ClientConfig is applied to every websocket connection; the zero value falls back to DefaultClientConfig.
+		ClientConfig ClientConfig
+
+		// accepted hands the messages accepted by the connections to HandleMessages
+		accepted     chan chatEvent
+		acceptedOnce sync.Once
+	}
+
+	// chatEvent is a message received from a client along with the event announcing it.
+	chatEvent struct {
+		envelope events.Envelope
+		msg      ChatMessage
 	}
 
 	ChatMessage struct {
+		// ID is assigned by the server when the message is accepted.
+		ID string `json:"id,omitempty"`
+		// ClientID is the ID the sender gave to the message, empty for the messages of the server.
+		ClientID string `json:"client_id,omitempty"`
+		// ParentID is set on the replies, to the first message of their thread.
+		ParentID  string `json:"parent_id,omitempty"`
+		UserID    string `json:"user_id,omitempty"`
 		Username  string `json:"username"`
 		Text      string `json:"text"`
 		Room      string `json:"room"`
 		Timestamp string `json:"timestamp"`
+		// EditedAt is set once the text was edited.
+		EditedAt string `json:"edited_at,omitempty"`
+		// Recipient restricts the delivery to the connections of one user.
+		Recipient string `json:"recipient,omitempty"`
 	}
 )
 
-func (ch *ChatMessage) IsStockCommand() bool {
-	r, _ := regexp.Compile(stockCommandString)
-	return r.MatchString(ch.Text)
+// IsCommand reports whether the text is a chat command, which is neither stored nor broadcast.
+func (ch *ChatMessage) IsCommand() bool {
+	return commands.IsCommand(ch.Text)
 }
 
 func (h *Handler) HandleConnections(c echo.Context) error {
+	identity, ok := auth.FromContext(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, &api.APIError{HTTPStatusCode: http.StatusUnauthorized, Msg: "missing identity"})
+	}
+
+	roomID := c.Param("id")
+	if apiErr := h.Rooms.CheckAccess(identity.UserID, roomID); apiErr != nil {
+		return c.JSON(apiErr.HTTPStatusCode, apiErr)
+	}
+
+	if !negotiable(websocket.Subprotocols(c.Request())) {
+		apiErr := &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: fmt.Sprintf("%s: supported protocols are %v", ErrCodeUnsupportedVersion, supportedSubprotocols())}
+		return c.JSON(apiErr.HTTPStatusCode, apiErr)
+	}
+
 	ws, err := connUpgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
-		log.Fatal().Err(err)
+		log.Error().Err(err).Msg("error upgrading connection")
+		return nil
 	}
-	defer ws.Close()
-	clients[ws] = true
-	roomId = c.Param("id")
+	client := newClient(ws, h.ClientConfig)
+	client.UserID = identity.UserID.String()
+	defer client.Close()
+	go client.writePump()
+
+	room := h.Hub.Join(roomID, client)
+	defer h.Hub.Leave(roomID, client)
 
-	if h.RedisClient.Exists(roomId).Val() != 0 {
-		h.sendPreviousMessages(ws)
+	h.sendPreviousMessages(client, room)
+
+	member := PresenceMember{UserID: client.UserID, Username: identity.Nickname}
+	connID := uuid.New().String()
+	h.joinPresence(roomID, connID, member)
+	defer h.leavePresence(roomID, connID, member)
+	defer h.stopTyping(roomID, member)
+
+	// waiting for incoming frames
+	client.readPump(func(frame Frame) {
+		log.Info().Msg(fmt.Sprintf("Frame received: %s %s\n", frame.Type, frame.Payload))
+		h.handleFrame(client, identity, roomID, frame)
+	})
+	return nil
+}
+
+// handleFrame dispatches a frame sent by the client, answering the frames it cannot handle with an error
+// frame. Frames are never treated as chat text unless they are a message.send.
+func (h *Handler) handleFrame(client *Client, identity auth.Identity, roomID string, frame Frame) {
+	switch frame.Type {
+	case FrameMessageSend:
+		var payload SendPayload
+		if err := frame.DecodePayload(&payload); err != nil || payload.Text == "" {
+			client.Send(messageErrorFrame(payload.ClientID, ErrCodeInvalidFrame, "message.send needs a text"))
+			return
+		}
+		// longer messages could never be stored
+		if utf8.RuneCountInString(payload.Text) > api.MaxMessageBody {
+			client.Send(messageErrorFrame(payload.ClientID, ErrCodeInvalidFrame, fmt.Sprintf("message.send text is limited to %d characters", api.MaxMessageBody)))
+			return
+		}
+		if event, ok := h.accept(client, identity, roomID, payload); ok {
+			h.broadcaster() <- event
+		}
+	case FrameTypingStart:
+		h.startTyping(roomID, PresenceMember{UserID: client.UserID, Username: identity.Nickname})
+	case FrameTypingStop:
+		h.stopTyping(roomID, PresenceMember{UserID: client.UserID, Username: identity.Nickname})
+	case FrameReactionAdd, FrameReactionRemove:
+		h.react(client, identity, roomID, frame)
+	case FrameReadMarker:
+		h.markRead(client, identity, roomID, frame)
+	case FrameMessageReceipt:
+		h.receipt(client, identity, roomID, frame)
+	default:
+		client.Send(errorFrame(frame.Type, ErrCodeUnknownType, fmt.Sprintf("frame type %q is not accepted from clients", frame.Type)))
 	}
+}
 
-	// waiting for incoming messages
-	for {
-		var msg ChatMessage
-		err := ws.ReadJSON(&msg)
-		log.Info().Msg(fmt.Sprintf("Message received: %v\n", msg))
+// accept stamps the message with its sender and a server ID, queues it and acknowledges it to the sender.
+// It reports false when the message must not be broadcast, because it was already accepted
+// or could not be queued.
+func (h *Handler) accept(client *Client, identity auth.Identity, roomID string, payload SendPayload) (chatEvent, bool) {
+	// the sender is always the authenticated user
+	msg := ChatMessage{
+		ID:        uuid.New().String(),
+		UserID:    identity.UserID.String(),
+		Username:  identity.Nickname,
+		Text:      payload.Text,
+		Room:      roomID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	if _, err := uuid.Parse(payload.ClientID); err == nil {
+		msg.ClientID = payload.ClientID
+	}
+	if payload.ParentID != "" {
+		parentID, ok := h.threadRoot(client, roomID, msg.ClientID, payload.ParentID)
+		if !ok {
+			return chatEvent{}, false
+		}
+		msg.ParentID = parentID
+	}
+
+	if h.Seen != nil && msg.ClientID != "" {
+		id, first, err := h.Seen.FirstSeen(msg.UserID, msg.ClientID, msg.ID)
 		if err != nil {
-			delete(clients, ws)
-			break
+			log.Error().Err(err).Msg("error checking message id")
+		} else if !first {
+			log.Info().Msgf("message %s already accepted as %s", msg.ClientID, id)
+			msg.ID = id
+			client.Send(ackFrame(msg, StateAccepted))
+			return chatEvent{}, false
 		}
-		err = h.publishMessage(msg)
+	}
+
+	envelope, err := events.NewEnvelope(events.TypeMessageCreated, eventSource, msg)
+	if err == nil {
+		err = h.publishMessage(envelope)
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("error publishing msg")
+		if h.Seen != nil && msg.ClientID != "" {
+			if err := h.Seen.Forget(msg.UserID, msg.ClientID); err != nil {
+				log.Error().Err(err).Msg("error forgetting message id")
+			}
+		}
+		client.Send(messageErrorFrame(msg.ClientID, ErrCodeUnavailable, "message not queued, resend it"))
+		return chatEvent{}, false
+	}
+
+	client.Send(ackFrame(msg, StateAccepted))
+	// the message ends the typing
+	h.stopTyping(roomID, PresenceMember{UserID: msg.UserID, Username: msg.Username})
+	return chatEvent{envelope: envelope, msg: msg}, true
+}
+
+// react adds or removes the reaction of the user, telling the room when it changed.
+func (h *Handler) react(client *Client, identity auth.Identity, roomID string, frame Frame) {
+	if h.Reactions == nil {
+		client.Send(errorFrame(frame.Type, ErrCodeUnknownType, "reactions are not enabled"))
+		return
+	}
+	var reaction ReactionPayload
+	if err := frame.DecodePayload(&reaction); err != nil || reaction.MessageID == "" || !validEmoji(reaction.Emoji) {
+		client.Send(errorFrame(frame.Type, ErrCodeInvalidFrame, frame.Type+" needs a message_id and an emoji"))
+		return
+	}
+	if h.ReactionLimit != nil {
+		allowed, err := h.ReactionLimit.Allow(client.UserID)
 		if err != nil {
-			log.Error().Err(err).Msg("error publishing msg")
+			log.Error().Err(err).Msg("error checking reaction rate")
+		} else if !allowed {
+			client.Send(errorFrame(frame.Type, ErrCodeRateLimited, "too many reactions, slow down"))
+			return
 		}
-		broadcaster <- msg
 	}
-	return nil
+	// the reaction is always the authenticated user's, to a message of the room
+	reaction.UserID = identity.UserID.String()
+	reaction.Room = roomID
+
+	store, eventType := h.Reactions.AddReaction, events.TypeReactionAdded
+	if frame.Type == FrameReactionRemove {
+		store, eventType = h.Reactions.RemoveReaction, events.TypeReactionRemoved
+	}
+	changed, err := store(reaction)
+	switch {
+	case errors.Is(err, ErrUnknownMessage):
+		client.Send(errorFrame(frame.Type, ErrCodeNotFound, "no such message in the room"))
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("error storing reaction")
+		client.Send(errorFrame(frame.Type, ErrCodeUnavailable, "reaction not stored"))
+		return
+	case !changed:
+		return
+	}
+
+	envelope, err := events.NewEnvelope(eventType, eventSource, reaction)
+	if err == nil {
+		err = h.publishEvent(roomID, envelope)
+	}
+	if err != nil {
+		log.Error().Err(err).Msgf("error publishing %s event", eventType)
+	}
+}
+
+// receipt tells the author of a message of the room that the user got or read it.
+func (h *Handler) receipt(client *Client, identity auth.Identity, roomID string, frame Frame) {
+	if h.Authors == nil {
+		client.Send(errorFrame(frame.Type, ErrCodeUnknownType, "receipts are not enabled"))
+		return
+	}
+	var receipt ReceiptPayload
+	if err := frame.DecodePayload(&receipt); err != nil || receipt.MessageID == "" || !validReceiptState(receipt.State) {
+		client.Send(errorFrame(frame.Type, ErrCodeInvalidFrame, "message.receipt needs a message_id and a delivered or read state"))
+		return
+	}
+	// the receipt goes to the author of the stored message, whatever the client says
+	authorID, err := h.Authors.MessageAuthor(roomID, receipt.MessageID)
+	switch {
+	case errors.Is(err, ErrUnknownMessage):
+		client.Send(errorFrame(frame.Type, ErrCodeNotFound, "no such message in the room"))
+		return
+	case err != nil:
+		log.Error().Err(err).Msg("error getting the author of the message")
+		client.Send(errorFrame(frame.Type, ErrCodeUnavailable, "receipt not delivered"))
+		return
+	}
+	receipt.Room = roomID
+	receipt.AuthorID = authorID
+	receipt.UserID = identity.UserID.String()
+	if err := h.publishReceipt(receipt); err != nil {
+		log.Error().Err(err).Msg("error publishing receipt")
+		client.Send(errorFrame(frame.Type, ErrCodeUnavailable, "receipt not delivered"))
+	}
+}
+
+// markRead moves the read marker of the user in the room to the message of the frame.
+func (h *Handler) markRead(client *Client, identity auth.Identity, roomID string, frame Frame) {
+	if h.Reads == nil {
+		client.Send(errorFrame(frame.Type, ErrCodeUnknownType, "read markers are not enabled"))
+		return
+	}
+	var marker ReadMarkerPayload
+	if err := frame.DecodePayload(&marker); err != nil || marker.MessageID == "" {
+		client.Send(errorFrame(frame.Type, ErrCodeInvalidFrame, "read.marker needs a message_id"))
+		return
+	}
+	// the marker is always the authenticated user's, in the room of the connection
+	marker.UserID = identity.UserID.String()
+	marker.Room = roomID
+
+	err := h.Reads.AdvanceReadMarker(marker)
+	switch {
+	case errors.Is(err, ErrUnknownMessage):
+		client.Send(errorFrame(frame.Type, ErrCodeNotFound, "no such message in the room"))
+	case err != nil:
+		log.Error().Err(err).Msg("error moving read marker")
+		client.Send(errorFrame(frame.Type, ErrCodeUnavailable, "read marker not moved"))
+	}
 }
 
-func (h *Handler) sendPreviousMessages(ws *websocket.Conn) {
-	chatMessages, err := h.RedisClient.LRange(roomId, 0, -1).Result()
+// threadRoot returns the message the reply is attached to, answering the sender when there is none.
+func (h *Handler) threadRoot(client *Client, roomID, clientID, parentID string) (string, bool) {
+	if _, err := uuid.Parse(parentID); err != nil {
+		client.Send(messageErrorFrame(clientID, ErrCodeInvalidFrame, "parent_id must be a message id"))
+		return "", false
+	}
+	if h.Threads == nil {
+		return parentID, true
+	}
+	rootID, err := h.Threads.ThreadRoot(roomID, parentID)
+	switch {
+	case errors.Is(err, ErrUnknownMessage):
+		client.Send(messageErrorFrame(clientID, ErrCodeNotFound, "no such message to reply to in the room"))
+		return "", false
+	case err != nil:
+		log.Error().Err(err).Msg("error getting thread")
+		client.Send(messageErrorFrame(clientID, ErrCodeUnavailable, "message not queued, resend it"))
+		return "", false
+	}
+	return rootID, true
+}
+
+// joinPresence registers the connection, announcing the user when it is their first one in the room.
+func (h *Handler) joinPresence(roomID, connID string, member PresenceMember) {
+	if h.Presence == nil {
+		return
+	}
+	first, err := h.Presence.Join(roomID, connID, member)
 	if err != nil {
-		panic(err)
+		log.Error().Err(err).Msg("error registering presence")
+		return
 	}
-	for _, chatMessage := range chatMessages {
-		var msg ChatMessage
-		json.Unmarshal([]byte(chatMessage), &msg)
-		messageClient(ws, msg)
+	if first {
+		h.publishPresence(events.TypePresenceJoined, roomID, member)
 	}
 }
 
-func messageClients(msg ChatMessage) {
-	for client := range clients {
-		messageClient(client, msg)
+// leavePresence deregisters the connection, announcing the user when it was their last one in the room.
+func (h *Handler) leavePresence(roomID, connID string, member PresenceMember) {
+	if h.Presence == nil {
+		return
+	}
+	last, err := h.Presence.Leave(roomID, connID, member)
+	if err != nil {
+		log.Error().Err(err).Msg("error deregistering presence")
+		return
+	}
+	if last {
+		h.publishPresence(events.TypePresenceLeft, roomID, member)
 	}
 }
 
-func messageClient(client *websocket.Conn, msg ChatMessage) {
-	err := client.WriteJSON(msg)
-	if err != nil && unsafeError(err) {
-		log.Error().Err(err)
-		client.Close()
-		delete(clients, client)
+// startTyping tells the other members the user is typing, unless they were told less than an interval ago.
+func (h *Handler) startTyping(roomID string, member PresenceMember) {
+	if h.Typing == nil {
+		return
+	}
+	expired := func() {
+		h.publishTyping(events.TypeTypingStopped, roomID, member)
+	}
+	if h.Typing.Start(roomID, member.UserID, expired) {
+		h.publishTyping(events.TypeTypingStarted, roomID, member)
+	}
+}
+
+// stopTyping tells the other members the user stopped typing, if they were told otherwise.
+func (h *Handler) stopTyping(roomID string, member PresenceMember) {
+	if h.Typing == nil {
+		return
+	}
+	if h.Typing.Stop(roomID, member.UserID) {
+		h.publishTyping(events.TypeTypingStopped, roomID, member)
 	}
 }
 
-func (h *Handler) storeInRedis(msg ChatMessage) {
-	json, err := json.Marshal(msg)
+// publishTyping sends the indicator through the room events, it is neither queued nor stored.
+func (h *Handler) publishTyping(eventType, roomID string, member PresenceMember) {
+	envelope, err := events.NewEnvelope(eventType, eventSource, TypingPayload{
+		UserID:   member.UserID,
+		Username: member.Username,
+		Room:     roomID,
+	})
+	if err == nil {
+		err = h.publishEvent(roomID, envelope)
+	}
 	if err != nil {
-		panic(err)
+		log.Error().Err(err).Msgf("error publishing %s event", eventType)
 	}
+}
 
-	if err := h.RedisClient.RPush(roomId, json).Err(); err != nil {
-		panic(err)
+// AnnounceOffline tells the room the user left, it is called for the connections that expired.
+func (h *Handler) AnnounceOffline(roomID string, member PresenceMember) {
+	h.publishPresence(events.TypePresenceLeft, roomID, member)
+}
+
+func (h *Handler) publishPresence(eventType, roomID string, member PresenceMember) {
+	envelope, err := events.NewEnvelope(eventType, eventSource, PresencePayload{
+		UserID:   member.UserID,
+		Username: member.Username,
+		Room:     roomID,
+	})
+	if err == nil {
+		err = h.publishEvent(roomID, envelope)
 	}
+	if err != nil {
+		log.Error().Err(err).Msgf("error publishing %s event", eventType)
+	}
+}
+
+// ackFrame tells the author of the message it reached the state.
+func ackFrame(msg ChatMessage, state string) Frame {
+	return mustFrame(FrameMessageAck, AckPayload{
+		ClientID:  msg.ClientID,
+		ID:        msg.ID,
+		Room:      msg.Room,
+		State:     state,
+		Timestamp: msg.Timestamp,
+	})
+}
+
+func (h *Handler) sendPreviousMessages(client *Client, room *Room) {
+	chatMessages, err := h.History.Replay(room.ID)
+	if err != nil {
+		log.Error().Err(err).Msg("error reading room history")
+		return
+	}
+	for _, msg := range chatMessages {
+		client.Send(mustFrame(FrameMessageNew, msg))
+	}
+}
+
+// broadcaster returns the channel between the connections and HandleMessages.
+func (h *Handler) broadcaster() chan chatEvent {
+	h.acceptedOnce.Do(func() {
+		h.accepted = make(chan chatEvent)
+	})
+	return h.accepted
 }
 
 func (h *Handler) HandleMessages() {
+	broadcaster := h.broadcaster()
 	for {
-		msg := <-broadcaster
+		event := <-broadcaster
+		msg := event.msg
 		fmt.Printf("Message read from broadcaster: %v\n", msg)
-		if !msg.IsStockCommand() {
-			h.storeInRedis(msg)
-			messageClients(msg)
+		if !msg.IsCommand() {
+			if err := h.History.Append(msg); err != nil {
+				log.Error().Err(err).Msg("error storing msg in room history")
+			}
+			if err := h.publishEvent(msg.Room, event.envelope); err != nil {
+				// the other instances miss it, the local members still get it
+				log.Error().Err(err).Msg("error publishing room event")
+				h.Hub.Broadcast(msg)
+			}
 		}
 	}
 }
 
 func unsafeError(err error) bool {
-	return !websocket.IsCloseError(err, websocket.CloseGoingAway) && err != io.EOF
+	return !websocket.IsCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) && err != io.EOF
 }
 
-func (h *Handler) publishMessage(msg ChatMessage) error {
+func (h *Handler) publishMessage(envelope events.Envelope) error {
 
-	msgByte, _ := json.Marshal(msg)
-	err := h.Publisher.Publish(messagesChannelName, msgByte)
+	msgByte, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	err = h.Publisher.Publish(MessagesChannelName, msgByte)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (h *Handler) WaitingForQueueMsgs() {
-	msgs, err := h.Publisher.Consume(broadcasterChannelName)
+// publishEvent sends the event to the members of the room connected to any instance.
+func (h *Handler) publishEvent(roomID string, envelope events.Envelope) error {
+	body, err := envelope.Encode()
 	if err != nil {
-		log.Error().Err(err)
-	}
-
-	var stockBotChannelReceiver chan struct{}
-
-	go func() {
-		for d := range msgs {
-			log.Info().Msg(fmt.Sprintf("Received message from bot: %s", d.Body))
-			for client := range clients {
-				var msg ChatMessage
-				err := json.Unmarshal(d.Body, &msg)
-				if err != nil {
-					log.Error().Err(err)
-				}
-				err = client.WriteJSON(msg)
-				if err != nil && unsafeError(err) {
-					log.Error().Err(err)
-					client.Close()
-					delete(clients, client)
-				}
-			}
+		return err
+	}
+	return h.Publisher.PublishEvent(EventsExchangeName, roomID, body)
+}
 
+// publishReceipt relays the receipt to the author of the message, wherever it is connected.
+func (h *Handler) publishReceipt(receipt ReceiptPayload) error {
+	envelope, err := events.NewEnvelope(events.TypeMessageReceipt, eventSource, receipt)
+	if err != nil {
+		return err
+	}
+	return h.publishEvent(receipt.Room, envelope)
+}
+
+// HandleEvent delivers a room event, published by any instance, to the local members.
+func (h *Handler) HandleEvent(event events.Message) {
+	log.Info().Msg(fmt.Sprintf("Received room event: %s", event.Body))
+	envelope, err := events.Decode(event.Body)
+	if err != nil {
+		log.Error().Err(err).Msg("failed decoding room event")
+		return
+	}
+
+	switch envelope.Type {
+	case events.TypeMessageCreated, events.TypeBotReply:
+		var msg ChatMessage
+		if err := envelope.DecodePayload(&msg); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.Broadcast(msg)
+	case events.TypeMessagePersisted:
+		var msg ChatMessage
+		if err := envelope.DecodePayload(&msg); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.SendTo(msg.Room, msg.UserID, ackFrame(msg, StatePersisted))
+	case events.TypeMessageReceipt:
+		var receipt ReceiptPayload
+		if err := envelope.DecodePayload(&receipt); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		authorID := receipt.AuthorID
+		receipt.AuthorID = ""
+		h.Hub.SendTo(receipt.Room, authorID, mustFrame(FrameMessageReceipt, receipt))
+	case events.TypeMessageEdited:
+		var edit EditPayload
+		if err := envelope.DecodePayload(&edit); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.BroadcastFrame(edit.Room, mustFrame(FrameMessageEdit, edit))
+	case events.TypeMessageDeleted:
+		var deletion DeletePayload
+		if err := envelope.DecodePayload(&deletion); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.BroadcastFrame(deletion.Room, mustFrame(FrameMessageDelete, deletion))
+	case events.TypePresenceJoined, events.TypePresenceLeft:
+		var presence PresencePayload
+		if err := envelope.DecodePayload(&presence); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		frameType := FramePresenceJoin
+		if envelope.Type == events.TypePresenceLeft {
+			frameType = FramePresenceLeave
+		}
+		h.Hub.BroadcastFrame(presence.Room, mustFrame(frameType, presence))
+	case events.TypeTypingStarted, events.TypeTypingStopped:
+		var typing TypingPayload
+		if err := envelope.DecodePayload(&typing); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		frameType := FrameTypingStart
+		if envelope.Type == events.TypeTypingStopped {
+			frameType = FrameTypingStop
+		}
+		h.Hub.BroadcastExcept(typing.Room, typing.UserID, mustFrame(frameType, typing))
+	case events.TypeThreadReplied:
+		var thread ThreadPayload
+		if err := envelope.DecodePayload(&thread); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
 		}
-	}()
-	log.Info().Msg("Waiting for new messages in bot consumer")
-	<-stockBotChannelReceiver
+		participants := thread.Participants
+		thread.Participants = nil
+		frame := mustFrame(FrameThreadReply, thread)
+		for _, participant := range participants {
+			if participant != thread.UserID {
+				h.Hub.SendTo(thread.Room, participant, frame)
+			}
+		}
+	case events.TypeMentioned:
+		var mention MentionPayload
+		if err := envelope.DecodePayload(&mention); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.Notify(mention.UserID, mustFrame(FrameMention, mention))
+	case events.TypeReadMarkerMoved:
+		var marker ReadMarkerPayload
+		if err := envelope.DecodePayload(&marker); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.Notify(marker.UserID, mustFrame(FrameReadMarker, marker))
+	case events.TypeRoomEvicted:
+		var eviction Eviction
+		if err := envelope.DecodePayload(&eviction); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		h.Hub.Evict(eviction.Room, eviction.Keep)
+	case events.TypeReactionAdded, events.TypeReactionRemoved:
+		var reaction ReactionPayload
+		if err := envelope.DecodePayload(&reaction); err != nil {
+			log.Error().Err(err).Msgf("failed unmarshalling %s event %s", envelope.Type, envelope.ID)
+			return
+		}
+		frameType := FrameReactionAdd
+		if envelope.Type == events.TypeReactionRemoved {
+			frameType = FrameReactionRemove
+		}
+		h.Hub.BroadcastFrame(reaction.Room, mustFrame(frameType, reaction))
+	default:
+		log.Debug().Msgf("ignoring room event %s of type %s", envelope.ID, envelope.Type)
+	}
 }
@@ -0,0 +1,695 @@
+package chatrooms
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-chat/api"
+	"go-chat/auth"
+	"go-chat/events"
+)
+
+type (
+	publisherMock struct {
+		fail      bool
+		published [][]byte
+		events    []events.Envelope
+	}
+
+	presenceMock struct {
+		connections map[string]int
+	}
+
+	seenMock struct {
+		// ids maps the client IDs to the server IDs
+		ids map[string]string
+	}
+
+	reactionsMock struct {
+		// messages are the IDs of the messages of the room
+		messages  map[string]bool
+		reactions map[ReactionPayload]bool
+	}
+
+	limiterMock struct {
+		allowed int
+	}
+
+	readsMock struct {
+		// messages are the IDs of the messages of the room
+		messages map[string]bool
+		marked   []ReadMarkerPayload
+	}
+
+	// authorsMock maps the IDs of the messages of the room to their authors.
+	authorsMock map[string]string
+)
+
+const firstServerID = "9e4c1a37-2f0d-4b8e-a5d6-3c7b9f1e2a40"
+
+func NewPublisherMock(fail bool) *publisherMock {
+	return &publisherMock{fail: fail}
+}
+
+func (p *publisherMock) Publish(_ string, body []byte) error {
+	if p.fail {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, body)
+	return nil
+}
+
+func (p *publisherMock) PublishEvent(_, _ string, body []byte) error {
+	envelope, err := events.Decode(body)
+	if err != nil {
+		return err
+	}
+	p.events = append(p.events, envelope)
+	return nil
+}
+
+func NewPresenceMock() *presenceMock {
+	return &presenceMock{connections: map[string]int{}}
+}
+
+func (p *presenceMock) Join(_, _ string, member PresenceMember) (bool, error) {
+	p.connections[member.UserID]++
+	return p.connections[member.UserID] == 1, nil
+}
+
+func (p *presenceMock) Leave(_, _ string, member PresenceMember) (bool, error) {
+	p.connections[member.UserID]--
+	return p.connections[member.UserID] == 0, nil
+}
+
+func NewSeenMock(clientIDs ...string) *seenMock {
+	s := &seenMock{ids: map[string]string{}}
+	for _, id := range clientIDs {
+		s.ids[id] = firstServerID
+	}
+	return s
+}
+
+func (s *seenMock) FirstSeen(_, clientID, messageID string) (string, bool, error) {
+	if id, ok := s.ids[clientID]; ok {
+		return id, false, nil
+	}
+	s.ids[clientID] = messageID
+	return messageID, true, nil
+}
+
+func (s *seenMock) Forget(_, clientID string) error {
+	delete(s.ids, clientID)
+	return nil
+}
+
+func NewReactionsMock(messageIDs ...string) *reactionsMock {
+	r := &reactionsMock{messages: map[string]bool{}, reactions: map[ReactionPayload]bool{}}
+	for _, id := range messageIDs {
+		r.messages[id] = true
+	}
+	return r
+}
+
+func (r *reactionsMock) AddReaction(reaction ReactionPayload) (bool, error) {
+	if !r.messages[reaction.MessageID] {
+		return false, ErrUnknownMessage
+	}
+	if r.reactions[reaction] {
+		return false, nil
+	}
+	r.reactions[reaction] = true
+	return true, nil
+}
+
+func (r *reactionsMock) RemoveReaction(reaction ReactionPayload) (bool, error) {
+	if !r.messages[reaction.MessageID] {
+		return false, ErrUnknownMessage
+	}
+	removed := r.reactions[reaction]
+	delete(r.reactions, reaction)
+	return removed, nil
+}
+
+func (l *limiterMock) Allow(string) (bool, error) {
+	l.allowed--
+	return l.allowed >= 0, nil
+}
+
+func (r *readsMock) AdvanceReadMarker(marker ReadMarkerPayload) error {
+	if !r.messages[marker.MessageID] {
+		return ErrUnknownMessage
+	}
+	r.marked = append(r.marked, marker)
+	return nil
+}
+
+func (a authorsMock) MessageAuthor(_, messageID string) (string, error) {
+	authorID, ok := a[messageID]
+	if !ok {
+		return "", ErrUnknownMessage
+	}
+	return authorID, nil
+}
+
+// nextFrame returns the next frame queued for the client, decoding its payload into v.
+func nextFrame(t *testing.T, client *Client, v interface{}) string {
+	t.Helper()
+	select {
+	case frame := <-client.send:
+		if err := frame.DecodePayload(v); err != nil {
+			t.Fatalf("decoding %s payload: %v", frame.Type, err)
+		}
+		return frame.Type
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame sent to the client")
+		return ""
+	}
+}
+
+func TestHandler_Accept(t *testing.T) {
+	const clientID = "2b1f6f6a-8a0f-4c53-9a43-1c6d8f0e7b21"
+	tests := []struct {
+		name          string
+		publisher     *publisherMock
+		seen          *seenMock
+		wantBroadcast bool
+		wantFrame     string
+		wantSeen      bool
+	}{
+		{
+			name:          "Accept - Client message ID",
+			publisher:     NewPublisherMock(false),
+			seen:          NewSeenMock(),
+			wantBroadcast: true,
+			wantFrame:     FrameMessageAck,
+			wantSeen:      true,
+		},
+		{
+			name:          "Accept - Resent message",
+			publisher:     NewPublisherMock(false),
+			seen:          NewSeenMock(clientID),
+			wantBroadcast: false,
+			wantFrame:     FrameMessageAck,
+			wantSeen:      true,
+		},
+		{
+			name:          "Accept - Broker unavailable",
+			publisher:     NewPublisherMock(true),
+			seen:          NewSeenMock(),
+			wantBroadcast: false,
+			wantFrame:     FrameMessageError,
+			wantSeen:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Handler{Publisher: tt.publisher, Seen: tt.seen}
+			client := newClient(NewConnMock(0), ClientConfig{})
+			identity := auth.Identity{UserID: uuid.New(), Nickname: "any_nickname"}
+
+			event, ok := h.accept(client, identity, "random", SendPayload{ClientID: clientID, Text: "hi"})
+			if ok != tt.wantBroadcast {
+				t.Fatalf("accept() broadcast = %v, want %v", ok, tt.wantBroadcast)
+			}
+			if ok && (event.msg.ClientID != clientID || event.msg.ID == clientID || event.msg.UserID != identity.UserID.String() || event.envelope.Type != events.TypeMessageCreated) {
+				t.Errorf("accept() event = %+v", event)
+			}
+			if ok && len(tt.publisher.published) != 1 {
+				t.Errorf("published %d messages, want 1", len(tt.publisher.published))
+			}
+
+			var reply AckPayload
+			if frame := nextFrame(t, client, &reply); frame != tt.wantFrame || reply.ClientID != clientID {
+				t.Errorf("reply = %s %+v, want %s for %s", frame, reply, tt.wantFrame, clientID)
+			}
+			if tt.wantFrame == FrameMessageAck && (reply.ID != tt.seen.ids[clientID] || reply.State != StateAccepted || reply.Timestamp == "") {
+				t.Errorf("ack = %+v, want the server id %s accepted", reply, tt.seen.ids[clientID])
+			}
+			if _, seen := tt.seen.ids[clientID]; seen != tt.wantSeen {
+				t.Errorf("seen = %v, want %v", seen, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestHandler_HandleFrameErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     Frame
+		wantFrame string
+		wantCode  string
+	}{
+		{
+			name:      "Frame - Unknown type",
+			frame:     Frame{Type: "message.shout"},
+			wantFrame: FrameError,
+			wantCode:  ErrCodeUnknownType,
+		},
+		{
+			name:      "Frame - Server frame sent by a client",
+			frame:     mustFrame(FrameMessageNew, ChatMessage{Text: "hi"}),
+			wantFrame: FrameError,
+			wantCode:  ErrCodeUnknownType,
+		},
+		{
+			name:      "Frame - Send without text",
+			frame:     mustFrame(FrameMessageSend, SendPayload{ClientID: uuid.New().String()}),
+			wantFrame: FrameMessageError,
+			wantCode:  ErrCodeInvalidFrame,
+		},
+		{
+			name:      "Frame - Send too long",
+			frame:     mustFrame(FrameMessageSend, SendPayload{ClientID: uuid.New().String(), Text: strings.Repeat("é", api.MaxMessageBody+1)}),
+			wantFrame: FrameMessageError,
+			wantCode:  ErrCodeInvalidFrame,
+		},
+		{
+			name:      "Frame - Receipt with an unknown state",
+			frame:     mustFrame(FrameMessageReceipt, ReceiptPayload{MessageID: uuid.New().String(), State: StatePersisted}),
+			wantFrame: FrameError,
+			wantCode:  ErrCodeInvalidFrame,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := Handler{Publisher: NewPublisherMock(false), Authors: authorsMock{}}
+			client := newClient(NewConnMock(0), ClientConfig{})
+
+			h.handleFrame(client, auth.Identity{UserID: uuid.New()}, "random", tt.frame)
+
+			var reply ErrorPayload
+			if frame := nextFrame(t, client, &reply); frame != tt.wantFrame || reply.Code != tt.wantCode {
+				t.Errorf("reply = %s %+v, want %s %s", frame, reply, tt.wantFrame, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestHandler_HandleEventPersisted(t *testing.T) {
+	hub := NewHub()
+	h := Handler{Hub: hub}
+	author, other := newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{})
+	author.UserID, other.UserID = uuid.New().String(), uuid.New().String()
+	hub.Join("random", author)
+	hub.Join("random", other)
+
+	msg := ChatMessage{ID: uuid.New().String(), ClientID: uuid.New().String(), UserID: author.UserID, Room: "random", Timestamp: "2022-08-14T10:00:00.123456Z"}
+	envelope, _ := events.NewEnvelope(events.TypeMessagePersisted, "messages", msg)
+	body, _ := envelope.Encode()
+	h.HandleEvent(events.Message{Topic: "random", Body: body})
+
+	var ack AckPayload
+	if frame := nextFrame(t, author, &ack); frame != FrameMessageAck || ack.ID != msg.ID || ack.State != StatePersisted || ack.Timestamp != msg.Timestamp {
+		t.Errorf("ack = %s %+v, want persisted %s at %s", frame, ack, msg.ID, msg.Timestamp)
+	}
+	select {
+	case frame := <-other.send:
+		t.Errorf("other member received %s", frame.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNegotiable(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		want      bool
+	}{
+		{
+			name: "Negotiable - No subprotocol",
+			want: true,
+		},
+		{
+			name:      "Negotiable - Current version among others",
+			requested: []string{"go-chat.v9", Subprotocol(ProtocolVersion)},
+			want:      true,
+		},
+		{
+			name:      "Negotiable - Unsupported versions only",
+			requested: []string{"go-chat.v9"},
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiable(tt.requested); got != tt.want {
+				t.Errorf("negotiable(%v) = %v, want %v", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler_PresenceCountsUsersOnce(t *testing.T) {
+	publisher := NewPublisherMock(false)
+	h := Handler{Publisher: publisher, Presence: NewPresenceMock()}
+	member := PresenceMember{UserID: uuid.New().String(), Username: "any_nickname"}
+
+	// two tabs of the same user
+	h.joinPresence("random", "tab-1", member)
+	h.joinPresence("random", "tab-2", member)
+	h.leavePresence("random", "tab-1", member)
+	h.leavePresence("random", "tab-2", member)
+
+	want := []string{events.TypePresenceJoined, events.TypePresenceLeft}
+	if len(publisher.events) != len(want) {
+		t.Fatalf("published %d presence events, want %d", len(publisher.events), len(want))
+	}
+	for i, envelope := range publisher.events {
+		var presence PresencePayload
+		if err := envelope.DecodePayload(&presence); err != nil || envelope.Type != want[i] || presence.UserID != member.UserID || presence.Room != "random" {
+			t.Errorf("event %d = %s %+v, want %s", i, envelope.Type, presence, want[i])
+		}
+	}
+}
+
+func TestParsePresenceEntry(t *testing.T) {
+	member := PresenceMember{UserID: uuid.New().String(), Username: "nick:with:colons"}
+	got, ok := parsePresenceEntry(presenceEntry(uuid.New().String(), member))
+	if !ok || got != member {
+		t.Errorf("parsePresenceEntry() = %+v, %v, want %+v", got, ok, member)
+	}
+	if _, ok := parsePresenceEntry("malformed"); ok {
+		t.Errorf("parsePresenceEntry() should reject a malformed entry")
+	}
+}
+
+func TestHandler_HandleEventTypingSkipsTypist(t *testing.T) {
+	hub := NewHub()
+	h := Handler{Hub: hub}
+	typist, other := newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{})
+	typist.UserID, other.UserID = uuid.New().String(), uuid.New().String()
+	hub.Join("random", typist)
+	hub.Join("random", other)
+
+	envelope, _ := events.NewEnvelope(events.TypeTypingStarted, eventSource, TypingPayload{UserID: typist.UserID, Username: "typist", Room: "random"})
+	body, _ := envelope.Encode()
+	h.HandleEvent(events.Message{Topic: "random", Body: body})
+
+	var typing TypingPayload
+	if frame := nextFrame(t, other, &typing); frame != FrameTypingStart || typing.UserID != typist.UserID {
+		t.Errorf("frame = %s %+v, want %s from the typist", frame, typing, FrameTypingStart)
+	}
+	select {
+	case frame := <-typist.send:
+		t.Errorf("typist received its own %s", frame.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandler_HandleEventEditAndDelete(t *testing.T) {
+	hub := NewHub()
+	h := Handler{Hub: hub}
+	client := newClient(NewConnMock(0), ClientConfig{})
+	client.UserID = uuid.New().String()
+	hub.Join("random", client)
+	messageID := uuid.New().String()
+
+	edited, _ := events.NewEnvelope(events.TypeMessageEdited, eventSource, EditPayload{ID: messageID, Room: "random", Text: "fixed"})
+	body, _ := edited.Encode()
+	h.HandleEvent(events.Message{Topic: "random", Body: body})
+
+	var edit EditPayload
+	if frame := nextFrame(t, client, &edit); frame != FrameMessageEdit || edit.ID != messageID || edit.Text != "fixed" {
+		t.Errorf("frame = %s %+v, want %s of %s", frame, edit, FrameMessageEdit, messageID)
+	}
+
+	deleted, _ := events.NewEnvelope(events.TypeMessageDeleted, eventSource, DeletePayload{ID: messageID, Room: "random"})
+	body, _ = deleted.Encode()
+	h.HandleEvent(events.Message{Topic: "random", Body: body})
+
+	var deletion DeletePayload
+	if frame := nextFrame(t, client, &deletion); frame != FrameMessageDelete || deletion.ID != messageID {
+		t.Errorf("frame = %s %+v, want %s of %s", frame, deletion, FrameMessageDelete, messageID)
+	}
+}
+
+func TestHandler_React(t *testing.T) {
+	const messageID = "5d0c2e9a-7b4f-4f1e-9c3a-2e8b6d4f1a70"
+	identity := auth.Identity{UserID: uuid.New(), Nickname: "alice"}
+	tests := []struct {
+		name      string
+		frames    []Frame
+		allowed   int
+		wantCode  string
+		wantEvent string
+	}{
+		{
+			name:      "React - Add",
+			frames:    []Frame{mustFrame(FrameReactionAdd, ReactionPayload{MessageID: messageID, Emoji: "👍"})},
+			allowed:   1,
+			wantEvent: events.TypeReactionAdded,
+		},
+		{
+			name: "React - Remove",
+			frames: []Frame{
+				mustFrame(FrameReactionAdd, ReactionPayload{MessageID: messageID, Emoji: "👍"}),
+				mustFrame(FrameReactionRemove, ReactionPayload{MessageID: messageID, Emoji: "👍"}),
+			},
+			allowed:   2,
+			wantEvent: events.TypeReactionRemoved,
+		},
+		{
+			name:     "React - Invalid emoji",
+			frames:   []Frame{mustFrame(FrameReactionAdd, ReactionPayload{MessageID: messageID, Emoji: "thumbs up"})},
+			allowed:  1,
+			wantCode: ErrCodeInvalidFrame,
+		},
+		{
+			name:     "React - Unknown message",
+			frames:   []Frame{mustFrame(FrameReactionAdd, ReactionPayload{MessageID: uuid.New().String(), Emoji: "👍"})},
+			allowed:  1,
+			wantCode: ErrCodeNotFound,
+		},
+		{
+			name:     "React - Rate limited",
+			frames:   []Frame{mustFrame(FrameReactionAdd, ReactionPayload{MessageID: messageID, Emoji: "👍"})},
+			allowed:  0,
+			wantCode: ErrCodeRateLimited,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := NewPublisherMock(false)
+			h := Handler{Publisher: publisher, Reactions: NewReactionsMock(messageID), ReactionLimit: &limiterMock{allowed: tt.allowed}}
+			client := newClient(NewConnMock(0), ClientConfig{})
+			client.UserID = identity.UserID.String()
+
+			for _, frame := range tt.frames {
+				h.handleFrame(client, identity, "random", frame)
+			}
+
+			if tt.wantCode != "" {
+				var payload ErrorPayload
+				if frame := nextFrame(t, client, &payload); frame != FrameError || payload.Code != tt.wantCode {
+					t.Errorf("frame = %s %+v, want %s %s", frame, payload, FrameError, tt.wantCode)
+				}
+				if len(publisher.events) != 0 {
+					t.Errorf("published %d events, want none", len(publisher.events))
+				}
+				return
+			}
+			if len(publisher.events) != len(tt.frames) {
+				t.Fatalf("published %d events, want %d", len(publisher.events), len(tt.frames))
+			}
+			last := publisher.events[len(publisher.events)-1]
+			var reaction ReactionPayload
+			if err := last.DecodePayload(&reaction); err != nil {
+				t.Fatal(err)
+			}
+			if last.Type != tt.wantEvent || reaction.UserID != client.UserID || reaction.Room != "random" {
+				t.Errorf("event = %s %+v, want %s by the user in random", last.Type, reaction, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestHandler_HandleEventThreadReply(t *testing.T) {
+	hub := NewHub()
+	h := Handler{Hub: hub}
+	author, replier, bystander := newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{})
+	author.UserID, replier.UserID, bystander.UserID = uuid.New().String(), uuid.New().String(), uuid.New().String()
+	for _, client := range []*Client{author, replier, bystander} {
+		hub.Join("random", client)
+	}
+
+	envelope, _ := events.NewEnvelope(events.TypeThreadReplied, eventSource, ThreadPayload{
+		ParentID:     uuid.New().String(),
+		MessageID:    uuid.New().String(),
+		Room:         "random",
+		UserID:       replier.UserID,
+		ReplyCount:   1,
+		Participants: []string{author.UserID, replier.UserID},
+	})
+	body, _ := envelope.Encode()
+	h.HandleEvent(events.Message{Topic: "random", Body: body})
+
+	var thread ThreadPayload
+	if frame := nextFrame(t, author, &thread); frame != FrameThreadReply || thread.ReplyCount != 1 || thread.Participants != nil {
+		t.Errorf("frame = %s %+v, want %s without the participants", frame, thread, FrameThreadReply)
+	}
+	for _, client := range []*Client{replier, bystander} {
+		select {
+		case frame := <-client.send:
+			t.Errorf("user %s received %s", client.UserID, frame.Type)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestHandler_HandleEventMention(t *testing.T) {
+	hub := NewHub()
+	h := Handler{Hub: hub}
+	mentionedID := uuid.New().String()
+	inRandom, inTech, other := newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{}), newClient(NewConnMock(0), ClientConfig{})
+	inRandom.UserID, inTech.UserID, other.UserID = mentionedID, mentionedID, uuid.New().String()
+	hub.Join("random", inRandom)
+	hub.Join("tech", inTech)
+	hub.Join("random", other)
+
+	envelope, _ := events.NewEnvelope(events.TypeMentioned, eventSource, MentionPayload{
+		MessageID: uuid.New().String(),
+		Room:      "random",
+		UserID:    mentionedID,
+		AuthorID:  other.UserID,
+		Text:      "hi @bob",
+	})
+	body, _ := envelope.Encode()
+	h.HandleEvent(events.Message{Topic: UserKey(mentionedID), Body: body})
+
+	for _, client := range []*Client{inRandom, inTech} {
+		var mention MentionPayload
+		if frame := nextFrame(t, client, &mention); frame != FrameMention || mention.Room != "random" {
+			t.Errorf("frame = %s %+v, want %s of room random", frame, mention, FrameMention)
+		}
+	}
+	select {
+	case frame := <-other.send:
+		t.Errorf("author received %s", frame.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestHandler_HandleEventEvicted(t *testing.T) {
+	tests := []struct {
+		name        string
+		eviction    Eviction
+		wantEvicted map[string]bool
+	}{
+		{"room deleted", Eviction{Room: "private"}, map[string]bool{"member": true, "removed": true}},
+		{"member removed", Eviction{Room: "private", Users: []string{"removed"}}, map[string]bool{"removed": true}},
+		{"room made private", Eviction{Room: "private", Members: []string{"member"}}, map[string]bool{"removed": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			h := Handler{Hub: hub}
+			conns := map[string]*conn{"member": NewConnMock(0), "removed": NewConnMock(0)}
+			for userID, c := range conns {
+				client := newClient(c, ClientConfig{})
+				client.UserID = userID
+				go client.writePump()
+				hub.Join("private", client)
+			}
+
+			envelope, _ := events.NewEnvelope(events.TypeRoomEvicted, "rooms", tt.eviction)
+			body, _ := envelope.Encode()
+			h.HandleEvent(events.Message{Topic: "private", Body: body})
+
+			for userID, c := range conns {
+				if tt.wantEvicted[userID] {
+					waitFor(t, c.isClosed)
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			for userID, c := range conns {
+				if c.isClosed() != tt.wantEvicted[userID] {
+					t.Errorf("%s closed = %v, want %v", userID, c.isClosed(), tt.wantEvicted[userID])
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_MarkRead(t *testing.T) {
+	const messageID = "5d0c2e9a-7b4f-4f1e-9c3a-2e8b6d4f1a70"
+	identity := auth.Identity{UserID: uuid.New(), Nickname: "alice"}
+	tests := []struct {
+		name     string
+		frame    Frame
+		wantCode string
+	}{
+		{name: "Mark read - Message of the room", frame: mustFrame(FrameReadMarker, ReadMarkerPayload{MessageID: messageID})},
+		{name: "Mark read - Missing message", frame: mustFrame(FrameReadMarker, ReadMarkerPayload{}), wantCode: ErrCodeInvalidFrame},
+		{name: "Mark read - Unknown message", frame: mustFrame(FrameReadMarker, ReadMarkerPayload{MessageID: uuid.New().String()}), wantCode: ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := &readsMock{messages: map[string]bool{messageID: true}}
+			h := Handler{Reads: reads}
+			client := newClient(NewConnMock(0), ClientConfig{})
+			client.UserID = identity.UserID.String()
+
+			h.handleFrame(client, identity, "random", tt.frame)
+
+			if tt.wantCode != "" {
+				var payload ErrorPayload
+				if frame := nextFrame(t, client, &payload); frame != FrameError || payload.Code != tt.wantCode {
+					t.Errorf("frame = %s %+v, want %s %s", frame, payload, FrameError, tt.wantCode)
+				}
+				return
+			}
+			want := ReadMarkerPayload{MessageID: messageID, Room: "random", UserID: client.UserID}
+			if len(reads.marked) != 1 || reads.marked[0] != want {
+				t.Errorf("marked = %+v, want %+v", reads.marked, want)
+			}
+		})
+	}
+}
+
+func TestHandler_Receipt(t *testing.T) {
+	const messageID = "5d0c2e9a-7b4f-4f1e-9c3a-2e8b6d4f1a70"
+	authorID, readerID := uuid.New().String(), uuid.New()
+	tests := []struct {
+		name     string
+		receipt  ReceiptPayload
+		wantCode string
+	}{
+		{name: "Receipt - Message of the room", receipt: ReceiptPayload{MessageID: messageID, State: StateRead}},
+		{name: "Receipt - Author claimed by the client", receipt: ReceiptPayload{MessageID: messageID, AuthorID: uuid.New().String(), State: StateDelivered}},
+		{name: "Receipt - Message of another room", receipt: ReceiptPayload{MessageID: uuid.New().String(), State: StateRead}, wantCode: ErrCodeNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := NewPublisherMock(false)
+			h := Handler{Publisher: publisher, Authors: authorsMock{messageID: authorID}}
+			client := newClient(NewConnMock(0), ClientConfig{})
+
+			h.handleFrame(client, auth.Identity{UserID: readerID}, "random", mustFrame(FrameMessageReceipt, tt.receipt))
+
+			if tt.wantCode != "" {
+				var payload ErrorPayload
+				if frame := nextFrame(t, client, &payload); frame != FrameError || payload.Code != tt.wantCode {
+					t.Errorf("frame = %s %+v, want %s %s", frame, payload, FrameError, tt.wantCode)
+				}
+				if len(publisher.events) != 0 {
+					t.Errorf("published %d receipts, want none", len(publisher.events))
+				}
+				return
+			}
+			if len(publisher.events) != 1 {
+				t.Fatalf("published %d receipts, want 1", len(publisher.events))
+			}
+			var receipt ReceiptPayload
+			publisher.events[0].DecodePayload(&receipt)
+			want := ReceiptPayload{MessageID: messageID, Room: "random", AuthorID: authorID, UserID: readerID.String(), State: tt.receipt.State}
+			if receipt != want {
+				t.Errorf("receipt = %+v, want %+v", receipt, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package chatrooms
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"go-chat/db"
+)
+
+const (
+	defaultHistoryMaxMessages = 200
+	defaultHistoryIdleTTL     = 7 * 24 * time.Hour
+	defaultHistoryReplayLast  = 50
+)
+
+// editHistoryScript edits or removes (ARGV[2] = "remove") the message with the id ARGV[1] in the
+// history list, in one step so the concurrent appends and trims cannot shift it meanwhile.
+var editHistoryScript = redis.NewScript(`
+local items = redis.call('LRANGE', KEYS[1], 0, -1)
+for i, item in ipairs(items) do
+	local ok, msg = pcall(cjson.decode, item)
+	if ok and type(msg) == 'table' and msg['id'] == ARGV[1] then
+		if ARGV[2] == 'remove' then
+			redis.call('LREM', KEYS[1], 1, item)
+		else
+			msg['text'] = ARGV[3]
+			msg['edited_at'] = ARGV[4]
+			redis.call('LSET', KEYS[1], i - 1, cjson.encode(msg))
+		end
+		return 1
+	end
+end
+return 0
+`)
+
+type (
+	historyLoader interface {
+		ListByChatroom(chatroom string, before *db.MessageCursor, limit int) ([]db.MessageWithAuthor, error)
+	}
+
+	// HistoryConfig bounds what is kept in redis for every room and what is replayed on join.
+	HistoryConfig struct {
+		// MaxMessages is the number of messages kept per room.
+		MaxMessages int64
+		// IdleTTL expires the history of rooms without new messages.
+		IdleTTL time.Duration
+		// ReplayLast is the number of messages sent to a client joining the room.
+		ReplayLast int64
+		// ReplaySince, when set, only replays the messages newer than this window.
+		ReplaySince time.Duration
+	}
+
+	// HistoryCache keeps the latest messages of every room in a capped redis list,
+	// rebuilding it from the database when the key is missing.
+	HistoryCache struct {
+		RedisClient *redis.Client
+		Loader      historyLoader
+		cfg         HistoryConfig
+	}
+)
+
+// DefaultHistoryConfig returns the history settings used when nothing else is configured.
+func DefaultHistoryConfig() HistoryConfig {
+	return HistoryConfig{
+		MaxMessages: defaultHistoryMaxMessages,
+		IdleTTL:     defaultHistoryIdleTTL,
+		ReplayLast:  defaultHistoryReplayLast,
+	}
+}
+
+func NewHistoryCache(redisClient *redis.Client, loader historyLoader, cfg HistoryConfig) *HistoryCache {
+	def := DefaultHistoryConfig()
+	if cfg.MaxMessages <= 0 {
+		cfg.MaxMessages = def.MaxMessages
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = def.IdleTTL
+	}
+	if cfg.ReplayLast <= 0 || cfg.ReplayLast > cfg.MaxMessages {
+		cfg.ReplayLast = cfg.MaxMessages
+	}
+	return &HistoryCache{
+		RedisClient: redisClient,
+		Loader:      loader,
+		cfg:         cfg,
+	}
+}
+
+// Append stores the message at the end of its room history, trimming the oldest ones.
+func (hc *HistoryCache) Append(msg ChatMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return hc.push(historyKey(msg.Room), body)
+}
+
+// Replay returns the messages a client joining the room should receive, oldest first.
+func (hc *HistoryCache) Replay(roomID string) ([]ChatMessage, error) {
+	key := historyKey(roomID)
+	exists, err := hc.RedisClient.Exists(key).Result()
+	if err != nil {
+		return nil, err
+	}
+	if exists == 0 {
+		if err := hc.rebuild(roomID); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := hc.RedisClient.LRange(key, -hc.cfg.ReplayLast, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var since time.Time
+	if hc.cfg.ReplaySince > 0 {
+		since = time.Now().Add(-hc.cfg.ReplaySince)
+	}
+	msgs := make([]ChatMessage, 0, len(raw))
+	for _, item := range raw {
+		var msg ChatMessage
+		if err := json.Unmarshal([]byte(item), &msg); err != nil {
+			log.Error().Err(err).Msg("skipping malformed history entry")
+			continue
+		}
+		if !since.IsZero() && msg.sentBefore(since) {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Edit replaces the text of the message in the room history, if it is still there.
+func (hc *HistoryCache) Edit(roomID, messageID, text, editedAt string) error {
+	return editHistoryScript.Run(hc.RedisClient, []string{historyKey(roomID)}, messageID, "edit", text, editedAt).Err()
+}
+
+// Remove drops the message from the room history, if it is still there.
+func (hc *HistoryCache) Remove(roomID, messageID string) error {
+	return editHistoryScript.Run(hc.RedisClient, []string{historyKey(roomID)}, messageID, "remove").Err()
+}
+
+// rebuild fills a cold room history from the messages stored in the database.
+func (hc *HistoryCache) rebuild(roomID string) error {
+	if hc.Loader == nil {
+		return nil
+	}
+	rows, err := hc.Loader.ListByChatroom(roomID, nil, int(hc.cfg.MaxMessages))
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	// rows come newest first, the list keeps them oldest first
+	bodies := make([]interface{}, 0, len(rows))
+	for i := len(rows) - 1; i >= 0; i-- {
+		body, err := json.Marshal(ChatMessage{
+			ID:        rows[i].ID.String(),
+			ClientID:  formatOptionalID(rows[i].ClientID),
+			ParentID:  formatOptionalID(rows[i].ParentID),
+			UserID:    rows[i].UserID.String(),
+			Username:  rows[i].Nickname,
+			Text:      rows[i].Body,
+			Room:      rows[i].Chatroom,
+			Timestamp: rows[i].CreatedAt.UTC().Format(time.RFC3339),
+			EditedAt:  formatOptionalTime(rows[i].EditedAt),
+		})
+		if err != nil {
+			return err
+		}
+		bodies = append(bodies, body)
+	}
+	log.Info().Msgf("rebuilding history of room %s with %d messages", roomID, len(bodies))
+	return hc.push(historyKey(roomID), bodies...)
+}
+
+func (hc *HistoryCache) push(key string, bodies ...interface{}) error {
+	_, err := hc.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(key, bodies...)
+		pipe.LTrim(key, -hc.cfg.MaxMessages, -1)
+		pipe.Expire(key, hc.cfg.IdleTTL)
+		return nil
+	})
+	return err
+}
+
+// formatOptionalID formats an optional ID of a stored message, such as its client ID.
+func formatOptionalID(id *uuid.UUID) string {
+	if id == nil {
+		return ""
+	}
+	return id.String()
+}
+
+// formatOptionalTime formats the time when it is set.
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// sentBefore reports whether the message timestamp is older than t. Messages without
+// a readable timestamp are considered recent.
+func (ch *ChatMessage) sentBefore(t time.Time) bool {
+	sent, err := time.Parse(time.RFC3339, ch.Timestamp)
+	if err != nil {
+		return false
+	}
+	return sent.Before(t)
+}
@@ -0,0 +1,331 @@
+package chatrooms
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	historyKeyPrefix = "chatrooms:"
+	historyKeySuffix = ":history"
+	roomBufferSize   = 256
+	// userKeyPrefix routes the events meant for a user wherever they are connected, room IDs cannot contain it.
+	userKeyPrefix = "user:"
+	// bindTimeout is how long Join waits for the events of the room to be received.
+	bindTimeout = 5 * time.Second
+)
+
+type (
+	// roomBinder subscribes the instance to the events of the rooms it has members in, and to the
+	// events of the users connected to it.
+	roomBinder interface {
+		Bind(roomID string)
+		Unbind(roomID string)
+		Synced() <-chan struct{}
+	}
+
+	// Hub keeps track of the open rooms and routes every message to the room it belongs to.
+	Hub struct {
+		mu    sync.RWMutex
+		rooms map[string]*Room
+		// users holds the rooms every user is connected to, with the number of their connections
+		users  map[string]map[string]int
+		binder roomBinder
+	}
+
+	// Room holds the members connected to a chatroom and fans out its messages.
+	Room struct {
+		ID         string
+		HistoryKey string
+
+		mu        sync.RWMutex
+		members   map[*Client]bool
+		broadcast chan outbound
+	}
+
+	// Eviction is the payload of room.evicted, naming the clients of the room every instance disconnects:
+	// the ones of Users when set, otherwise every one but the Members'.
+	Eviction struct {
+		Room    string   `json:"room"`
+		Users   []string `json:"users,omitempty"`
+		Members []string `json:"members,omitempty"`
+	}
+
+	// outbound is a frame for the members of a room, or only for the connections of recipient when set.
+	// The connections of except, when set, are skipped.
+	outbound struct {
+		frame     Frame
+		recipient string
+		except    string
+	}
+)
+
+func NewHub() *Hub {
+	return &Hub{
+		rooms: make(map[string]*Room),
+		users: make(map[string]map[string]int),
+	}
+}
+
+// UserKey returns the routing key of the events meant for the user, received by the instances
+// the user is connected to.
+func UserKey(userID string) string {
+	return userKeyPrefix + userID
+}
+
+// SetBinder tells the binder which rooms are open on this instance, so only their events are
+// received from the other instances. It must be called before the first Join.
+func (h *Hub) SetBinder(binder roomBinder) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.binder = binder
+}
+
+func newRoom(id string) *Room {
+	return &Room{
+		ID:         id,
+		HistoryKey: historyKey(id),
+		members:    make(map[*Client]bool),
+		broadcast:  make(chan outbound, roomBufferSize),
+	}
+}
+
+// historyKey returns the redis key where the messages of a room are stored.
+func historyKey(roomID string) string {
+	return historyKeyPrefix + roomID + historyKeySuffix
+}
+
+// Join adds the client to the room, opening the room if it is the first member. It returns once the
+// events of the room are received, so the history read afterwards misses none of them.
+func (h *Hub) Join(roomID string, client *Client) *Room {
+	room, synced := h.join(roomID, client)
+	if synced == nil {
+		return room
+	}
+	select {
+	case <-synced:
+	case <-time.After(bindTimeout):
+		log.Warn().Msgf("room %s joined before its events were bound", roomID)
+	}
+	return room
+}
+
+// join adds the client to the room and returns the channel closed once the room is bound, if any.
+// The binding is not waited for under the lock, the events bound so far are handled meanwhile.
+func (h *Hub) join(roomID string, client *Client) (*Room, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[roomID]
+	if !ok {
+		room = newRoom(roomID)
+		h.rooms[roomID] = room
+		go room.run()
+		if h.binder != nil {
+			h.binder.Bind(roomID)
+		}
+		log.Info().Msgf("room %s opened", roomID)
+	}
+	room.add(client)
+	h.track(roomID, client.UserID, 1)
+	if h.binder == nil {
+		return room, nil
+	}
+	return room, h.binder.Synced()
+}
+
+// Leave removes the client from the room, closing the room once it is empty.
+func (h *Hub) Leave(roomID string, client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	h.track(roomID, client.UserID, -1)
+	if room.remove(client) == 0 {
+		close(room.broadcast)
+		delete(h.rooms, roomID)
+		if h.binder != nil {
+			h.binder.Unbind(roomID)
+		}
+		log.Info().Msgf("room %s closed", roomID)
+	}
+}
+
+// track counts the connections of the user to the room, subscribing to the events of the user
+// while they have any. It must be called with the lock held.
+func (h *Hub) track(roomID, userID string, delta int) {
+	if userID == "" {
+		return
+	}
+	rooms, ok := h.users[userID]
+	if !ok && delta < 0 {
+		return
+	}
+	if !ok {
+		rooms = make(map[string]int)
+		h.users[userID] = rooms
+		if h.binder != nil {
+			h.binder.Bind(UserKey(userID))
+		}
+	}
+	rooms[roomID] += delta
+	if rooms[roomID] <= 0 {
+		delete(rooms, roomID)
+	}
+	if len(rooms) == 0 {
+		delete(h.users, userID)
+		if h.binder != nil {
+			h.binder.Unbind(UserKey(userID))
+		}
+	}
+}
+
+// Broadcast sends the message to the members of msg.Room connected to this instance.
+func (h *Hub) Broadcast(msg ChatMessage) {
+	h.send(msg.Room, outbound{frame: mustFrame(FrameMessageNew, msg), recipient: msg.Recipient})
+}
+
+// BroadcastFrame sends the frame to the members of the room connected to this instance.
+func (h *Hub) BroadcastFrame(roomID string, frame Frame) {
+	h.send(roomID, outbound{frame: frame})
+}
+
+// BroadcastExcept sends the frame to the members of the room connected to this instance but the user.
+func (h *Hub) BroadcastExcept(roomID, userID string, frame Frame) {
+	h.send(roomID, outbound{frame: frame, except: userID})
+}
+
+// SendTo sends the frame to the connections of the user in the room, if any is on this instance.
+func (h *Hub) SendTo(roomID, userID string, frame Frame) {
+	h.send(roomID, outbound{frame: frame, recipient: userID})
+}
+
+// Notify sends the frame to every connection of the user on this instance, whatever the room.
+func (h *Hub) Notify(userID string, frame Frame) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for roomID := range h.users[userID] {
+		if room, ok := h.rooms[roomID]; ok {
+			room.deliver(outbound{frame: frame, recipient: userID})
+		}
+	}
+}
+
+func (h *Hub) send(roomID string, out outbound) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room, ok := h.rooms[roomID]
+	if !ok {
+		return
+	}
+	room.deliver(out)
+}
+
+// Evict tells the clients of the room whose user should no longer be there why and disconnects them.
+func (h *Hub) Evict(roomID string, keep func(userID string) bool) {
+	room, ok := h.Room(roomID)
+	if !ok {
+		return
+	}
+	for _, client := range room.clients() {
+		if !keep(client.UserID) {
+			log.Info().Msgf("evicting user %s from room %s", client.UserID, roomID)
+			client.Send(noticeFrame(NoticeEvicted, "you no longer have access to this room"))
+			client.Shutdown()
+		}
+	}
+}
+
+// Keep reports whether the connections of the user stay in the room.
+func (e Eviction) Keep(userID string) bool {
+	if e.Users != nil {
+		return !contains(e.Users, userID)
+	}
+	return contains(e.Members, userID)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Room returns the open room with the given id.
+func (h *Hub) Room(roomID string) (*Room, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	room, ok := h.rooms[roomID]
+	return room, ok
+}
+
+func (r *Room) add(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.members[client] = true
+}
+
+func (r *Room) remove(client *Client) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, client)
+	return len(r.members)
+}
+
+func (r *Room) clients() []*Client {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*Client, 0, len(r.members))
+	for client := range r.members {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Size returns the number of connections in the room.
+func (r *Room) Size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// deliver queues the frame for the members of the room, dropping it when the queue is full: blocking
+// with the hub locked would stall every room, not just this one. It must be called with the hub lock
+// held, so the room is not closed meanwhile.
+func (r *Room) deliver(out outbound) {
+	select {
+	case r.broadcast <- out:
+	default:
+		log.Warn().Msgf("dropping %s frame for the full room %s", out.frame.Type, r.ID)
+	}
+}
+
+func (r *Room) run() {
+	for out := range r.broadcast {
+		r.mu.RLock()
+		for client := range r.members {
+			if out.accepts(client.UserID) {
+				client.Send(out.frame)
+			}
+		}
+		r.mu.RUnlock()
+	}
+}
+
+// accepts reports whether the connections of the user get the frame.
+func (out outbound) accepts(userID string) bool {
+	if out.recipient != "" && out.recipient != userID {
+		return false
+	}
+	return out.except == "" || out.except != userID
+}
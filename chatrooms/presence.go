@@ -0,0 +1,269 @@
+package chatrooms
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	presenceKeySuffix  = ":presence"
+	presenceSeparator  = ":"
+	defaultPresenceTTL = 30 * time.Second
+)
+
+// countOthersLua counts the live connections of the user with the entry prefix, other than the entry.
+const countOthersLua = `
+local function others(key, now, prefix, entry)
+	local count = 0
+	for _, live in ipairs(redis.call("ZRANGEBYSCORE", key, now, "+inf")) do
+		if live ~= entry and string.sub(live, 1, #prefix) == prefix then
+			count = count + 1
+		end
+	end
+	return count
+end
+`
+
+// joinPresenceScript adds the connection ARGV[2] to the room KEYS[1], expiring at ARGV[1], and
+// returns the number of the other live connections of its user, whose entries start with ARGV[5].
+var joinPresenceScript = redis.NewScript(countOthersLua + `
+redis.call("ZADD", KEYS[1], ARGV[1], ARGV[2])
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+return others(KEYS[1], ARGV[4], ARGV[5], ARGV[2])
+`)
+
+// leavePresenceScript removes the connection ARGV[1] from the room KEYS[1] and returns the number of
+// the other live connections of its user, or -1 when the connection was removed already.
+var leavePresenceScript = redis.NewScript(countOthersLua + `
+if redis.call("ZREM", KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+return others(KEYS[1], ARGV[2], ARGV[3], ARGV[1])
+`)
+
+type (
+	// PresenceMember is a user connected to a room.
+	PresenceMember struct {
+		UserID   string
+		Username string
+	}
+
+	// Presence tracks the connections of every room in redis, so all the instances agree on who is online.
+	// Every connection is an entry of a sorted set scored with its expiry, which the instance holding
+	// the connection pushes back on every heartbeat: the connections of a crashed instance expire.
+	// A user is online while any of their connections is.
+	Presence struct {
+		RedisClient *redis.Client
+		TTL         time.Duration
+
+		mu sync.Mutex
+		// local holds the entries of the connections of this instance, by room
+		local map[string]map[string]bool
+	}
+)
+
+// NewPresence returns a Presence expiring the connections not refreshed for ttl, 0 falls back to 30s.
+func NewPresence(redisClient *redis.Client, ttl time.Duration) *Presence {
+	if ttl <= 0 {
+		ttl = defaultPresenceTTL
+	}
+	return &Presence{
+		RedisClient: redisClient,
+		TTL:         ttl,
+		local:       make(map[string]map[string]bool),
+	}
+}
+
+// Join registers the connection and reports whether it is the first one of the user in the room.
+// The connection is added and the others counted at once, so of the connections of a user joining
+// together exactly one is the first.
+func (p *Presence) Join(roomID, connID string, member PresenceMember) (bool, error) {
+	entry := presenceEntry(connID, member)
+	p.track(roomID, entry, true)
+
+	ttl := int64(p.TTL / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	others, err := joinPresenceScript.Run(p.RedisClient, []string{presenceKey(roomID)},
+		p.expiry(), entry, ttl, now(), member.UserID+presenceSeparator).Int64()
+	if err != nil {
+		return false, err
+	}
+	return others == 0, nil
+}
+
+// Leave removes the connection and reports whether it was the last one of the user in the room.
+func (p *Presence) Leave(roomID, connID string, member PresenceMember) (bool, error) {
+	entry := presenceEntry(connID, member)
+	p.track(roomID, entry, false)
+	return p.remove(roomID, entry, member.UserID)
+}
+
+// remove deletes the entry of a connection of the user and reports whether it was the last one.
+// The connection is removed and the others counted at once, so of the connections of a user leaving
+// together exactly one is the last, and an entry already removed is never.
+func (p *Presence) remove(roomID, entry, userID string) (bool, error) {
+	others, err := leavePresenceScript.Run(p.RedisClient, []string{presenceKey(roomID)},
+		entry, now(), userID+presenceSeparator).Int64()
+	if err != nil {
+		return false, err
+	}
+	return others == 0, nil
+}
+
+// Online returns the users with a live connection to the room, sorted by username.
+func (p *Presence) Online(roomID string) ([]PresenceMember, error) {
+	entries, err := p.live(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(entries))
+	members := make([]PresenceMember, 0, len(entries))
+	for _, entry := range entries {
+		member, ok := parsePresenceEntry(entry)
+		if !ok || seen[member.UserID] {
+			continue
+		}
+		seen[member.UserID] = true
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Username < members[j].Username
+	})
+	return members, nil
+}
+
+// Heartbeat keeps the connections of this instance alive and removes the expired ones of the rooms
+// it has connections in, calling offline for every user left without connections. It never returns.
+func (p *Presence) Heartbeat(offline func(roomID string, member PresenceMember)) {
+	ticker := time.NewTicker(p.TTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		for roomID, entries := range p.snapshot() {
+			if err := p.refresh(roomID, entries); err != nil {
+				log.Error().Err(err).Msgf("error refreshing presence of room %s", roomID)
+				continue
+			}
+			if err := p.sweep(roomID, offline); err != nil {
+				log.Error().Err(err).Msgf("error expiring presence of room %s", roomID)
+			}
+		}
+	}
+}
+
+// refresh pushes back the expiry of the connections, leaving alone the ones swept meanwhile.
+func (p *Presence) refresh(roomID string, entries []string) error {
+	key := presenceKey(roomID)
+	expiry := p.expiry()
+	_, err := p.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			pipe.ZAddXX(key, redis.Z{Score: expiry, Member: entry})
+		}
+		pipe.Expire(key, p.TTL)
+		return nil
+	})
+	return err
+}
+
+// sweep removes the expired connections of the room. Only the instance that removed an entry
+// reports its user offline.
+func (p *Presence) sweep(roomID string, offline func(roomID string, member PresenceMember)) error {
+	key := presenceKey(roomID)
+	expired, err := p.RedisClient.ZRangeByScore(key, redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatInt(now(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	reported := map[string]bool{}
+	for _, entry := range expired {
+		member, ok := parsePresenceEntry(entry)
+		if !ok {
+			p.RedisClient.ZRem(key, entry)
+			continue
+		}
+		last, err := p.remove(roomID, entry, member.UserID)
+		if err != nil {
+			return err
+		}
+		if last && !reported[member.UserID] {
+			reported[member.UserID] = true
+			log.Info().Msgf("presence of user %s in room %s expired", member.UserID, roomID)
+			offline(roomID, member)
+		}
+	}
+	return nil
+}
+
+// live returns the entries of the room that have not expired.
+func (p *Presence) live(roomID string) ([]string, error) {
+	return p.RedisClient.ZRangeByScore(presenceKey(roomID), redis.ZRangeBy{
+		Min: strconv.FormatInt(now(), 10),
+		Max: "+inf",
+	}).Result()
+}
+
+func (p *Presence) track(roomID, entry string, connected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if connected {
+		if p.local[roomID] == nil {
+			p.local[roomID] = make(map[string]bool)
+		}
+		p.local[roomID][entry] = true
+		return
+	}
+	delete(p.local[roomID], entry)
+	if len(p.local[roomID]) == 0 {
+		delete(p.local, roomID)
+	}
+}
+
+func (p *Presence) snapshot() map[string][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rooms := make(map[string][]string, len(p.local))
+	for roomID, entries := range p.local {
+		for entry := range entries {
+			rooms[roomID] = append(rooms[roomID], entry)
+		}
+	}
+	return rooms
+}
+
+func (p *Presence) expiry() float64 {
+	return float64(time.Now().Add(p.TTL).Unix())
+}
+
+// now is the score under which the connections have expired.
+func now() int64 {
+	return time.Now().Unix()
+}
+
+// presenceKey returns the redis key where the connections of a room are stored.
+func presenceKey(roomID string) string {
+	return historyKeyPrefix + roomID + presenceKeySuffix
+}
+
+// presenceEntry identifies a connection, the username goes last as it may contain the separator.
+func presenceEntry(connID string, member PresenceMember) string {
+	return member.UserID + presenceSeparator + connID + presenceSeparator + member.Username
+}
+
+func parsePresenceEntry(entry string) (PresenceMember, bool) {
+	parts := strings.SplitN(entry, presenceSeparator, 3)
+	if len(parts) != 3 {
+		return PresenceMember{}, false
+	}
+	return PresenceMember{UserID: parts[0], Username: parts[2]}, true
+}
@@ -0,0 +1,293 @@
+package chatrooms
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ProtocolVersion is the version of the websocket frames described by protocol.v1.schema.json.
+const ProtocolVersion = 1
+
+// subprotocolPrefix names the protocol versions in the Sec-WebSocket-Protocol header, e.g. "go-chat.v1".
+const subprotocolPrefix = "go-chat.v"
+
+// Frame types sent by the clients.
+const (
+	FrameMessageSend = "message.send"
+	// FrameMessageReceipt is sent by a recipient and relayed to the author of the message.
+	FrameMessageReceipt = "message.receipt"
+)
+
+// Frame types sent by both sides: the clients ask for the change, the server broadcasts it once done.
+const (
+	FrameTypingStart    = "typing.start"
+	FrameTypingStop     = "typing.stop"
+	FrameReactionAdd    = "reaction.add"
+	FrameReactionRemove = "reaction.remove"
+	// FrameReadMarker moves the read marker of the user in the room; the server tells every
+	// connection of the user, on any room, where it moved.
+	FrameReadMarker = "read.marker"
+)
+
+// Frame types sent by the server.
+const (
+	FrameMessageNew   = "message.new"
+	FrameMessageAck   = "message.ack"
+	FrameMessageError = "message.error"
+	// FrameMessageEdit and FrameMessageDelete follow the changes made through the messages API.
+	FrameMessageEdit   = "message.edit"
+	FrameMessageDelete = "message.delete"
+	// FrameMention tells a user, on all their connections, that a message mentioned them.
+	FrameMention = "mention"
+	// FrameThreadReply tells the participants of a thread, but the author of the reply, about a new reply.
+	FrameThreadReply   = "thread.reply"
+	FramePresenceJoin  = "presence.join"
+	FramePresenceLeave = "presence.leave"
+	FrameSystemNotice  = "system.notice"
+	// FrameError reports a frame the server could not handle.
+	FrameError = "error"
+)
+
+// Delivery states of a message, in the order they are reached.
+const (
+	// StateAccepted tells the sender the message was queued for delivery.
+	StateAccepted = "accepted"
+	// StatePersisted tells the sender the message was stored, with its canonical timestamp.
+	StatePersisted = "persisted"
+	// StateDelivered and StateRead are reported by the recipients.
+	StateDelivered = "delivered"
+	StateRead      = "read"
+)
+
+// Error codes of the error and message.error frames.
+const (
+	ErrCodeInvalidFrame = "invalid_frame"
+	ErrCodeUnknownType  = "unknown_type"
+	// ErrCodeUnsupportedVersion rejects the handshakes asking only for protocol versions this server does not speak.
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	// ErrCodeUnavailable means the message was not queued and can be resent with the same client ID.
+	ErrCodeUnavailable = "unavailable"
+	// ErrCodeNotFound rejects the frames about a message that is not one of the room.
+	ErrCodeNotFound = "not_found"
+	// ErrCodeRateLimited rejects the frames of a user sending too many of them.
+	ErrCodeRateLimited = "rate_limited"
+)
+
+// Codes of the system.notice frames.
+const (
+	// NoticeEvicted is sent before closing the connection of a user removed from the room.
+	NoticeEvicted = "evicted"
+)
+
+// maxEmojiLength is the longest emoji accepted in a reaction, in bytes.
+const maxEmojiLength = 32
+
+var errInvalidPayload = errors.New("invalid frame payload")
+
+// ErrUnknownMessage is returned by the stores for a message that does not exist in the room.
+var ErrUnknownMessage = errors.New("unknown message")
+
+type (
+	// Frame is the unit of the websocket protocol, the payload depends on the type.
+	Frame struct {
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload,omitempty"`
+	}
+
+	// SendPayload is the payload of message.send.
+	SendPayload struct {
+		// ClientID is generated by the client, so resends of the same message can be recognized.
+		ClientID string `json:"client_id"`
+		Text     string `json:"text"`
+		// ParentID makes the message a reply to the given message of the room.
+		ParentID string `json:"parent_id,omitempty"`
+	}
+
+	// AckPayload is the payload of message.ack, sent to the author once per delivery state.
+	AckPayload struct {
+		ClientID string `json:"client_id,omitempty"`
+		// ID is the ID assigned by the server.
+		ID        string `json:"id"`
+		Room      string `json:"room"`
+		State     string `json:"state"`
+		Timestamp string `json:"timestamp"`
+	}
+
+	// ErrorPayload is the payload of error and message.error. For an error, Type is the type of the
+	// rejected frame; for a message.error, ClientID is the client ID of the rejected message.
+	ErrorPayload struct {
+		Type     string `json:"type,omitempty"`
+		ClientID string `json:"client_id,omitempty"`
+		Code     string `json:"code"`
+		Message  string `json:"message"`
+	}
+
+	// ReceiptPayload is the payload of message.receipt. Clients send it with the message, the server
+	// fills in its author, who receives it with the user who got the message.
+	ReceiptPayload struct {
+		MessageID string `json:"message_id"`
+		Room      string `json:"room,omitempty"`
+		AuthorID  string `json:"author_id,omitempty"`
+		UserID    string `json:"user_id,omitempty"`
+		State     string `json:"state"`
+	}
+
+	// PresencePayload is the payload of presence.join and presence.leave.
+	PresencePayload struct {
+		UserID   string `json:"user_id"`
+		Username string `json:"username"`
+		Room     string `json:"room"`
+	}
+
+	// TypingPayload is the payload of typing.start and typing.stop, the server fills in the user.
+	TypingPayload struct {
+		UserID   string `json:"user_id,omitempty"`
+		Username string `json:"username,omitempty"`
+		Room     string `json:"room,omitempty"`
+	}
+
+	// EditPayload is the payload of message.edit.
+	EditPayload struct {
+		ID       string `json:"id"`
+		Room     string `json:"room,omitempty"`
+		Text     string `json:"text"`
+		EditedAt string `json:"edited_at,omitempty"`
+	}
+
+	// DeletePayload is the payload of message.delete.
+	DeletePayload struct {
+		ID        string `json:"id"`
+		Room      string `json:"room,omitempty"`
+		DeletedAt string `json:"deleted_at,omitempty"`
+	}
+
+	// ReactionPayload is the payload of reaction.add and reaction.remove, the server fills in the user and room.
+	ReactionPayload struct {
+		MessageID string `json:"message_id"`
+		Emoji     string `json:"emoji"`
+		UserID    string `json:"user_id,omitempty"`
+		Room      string `json:"room,omitempty"`
+	}
+
+	// ThreadPayload is the payload of thread.reply, with the replies to the parent message so far.
+	ThreadPayload struct {
+		ParentID    string `json:"parent_id"`
+		MessageID   string `json:"message_id"`
+		Room        string `json:"room"`
+		UserID      string `json:"user_id"`
+		Username    string `json:"username"`
+		ReplyCount  int    `json:"reply_count"`
+		LastReplyAt string `json:"last_reply_at"`
+		// Participants are the users to notify, they only travel with the room event.
+		Participants []string `json:"participants,omitempty"`
+	}
+
+	// ReadMarkerPayload is the payload of read.marker. Clients send the message read last, the server
+	// fills in the user, the room and what is left unread.
+	ReadMarkerPayload struct {
+		MessageID string `json:"message_id"`
+		Room      string `json:"room,omitempty"`
+		UserID    string `json:"user_id,omitempty"`
+		Unread    int64  `json:"unread"`
+	}
+
+	// MentionPayload is the payload of mention.
+	MentionPayload struct {
+		MessageID string `json:"message_id"`
+		Room      string `json:"room"`
+		// UserID is the user mentioned.
+		UserID    string `json:"user_id"`
+		AuthorID  string `json:"author_id"`
+		Author    string `json:"author"`
+		Text      string `json:"text"`
+		Timestamp string `json:"timestamp"`
+	}
+
+	// NoticePayload is the payload of system.notice, a text from the server shown in the room.
+	NoticePayload struct {
+		Code string `json:"code"`
+		Text string `json:"text"`
+	}
+)
+
+// Subprotocol returns the Sec-WebSocket-Protocol value of the protocol version.
+func Subprotocol(version int) string {
+	return subprotocolPrefix + strconv.Itoa(version)
+}
+
+// supportedSubprotocols lists the protocol versions this server speaks, preferred first.
+func supportedSubprotocols() []string {
+	return []string{Subprotocol(ProtocolVersion)}
+}
+
+// negotiable reports whether the handshake can agree on a protocol version. Clients asking for no
+// subprotocol get the current version.
+func negotiable(requested []string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, protocol := range requested {
+		for _, supported := range supportedSubprotocols() {
+			if protocol == supported {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewFrame builds a frame of the given type around the payload.
+func NewFrame(frameType string, payload interface{}) (Frame, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Type: frameType, Payload: body}, nil
+}
+
+// DecodePayload unmarshals the payload of the frame into v.
+func (f Frame) DecodePayload(v interface{}) error {
+	if len(f.Payload) == 0 {
+		return errInvalidPayload
+	}
+	return json.Unmarshal(f.Payload, v)
+}
+
+// mustFrame builds a frame around a payload that always marshals.
+func mustFrame(frameType string, payload interface{}) Frame {
+	frame, err := NewFrame(frameType, payload)
+	if err != nil {
+		panic(err)
+	}
+	return frame
+}
+
+// errorFrame rejects a frame of the given type.
+func errorFrame(frameType, code, message string) Frame {
+	return mustFrame(FrameError, ErrorPayload{Type: frameType, Code: code, Message: message})
+}
+
+// messageErrorFrame rejects the message with the given client ID.
+func messageErrorFrame(clientID, code, message string) Frame {
+	return mustFrame(FrameMessageError, ErrorPayload{ClientID: clientID, Code: code, Message: message})
+}
+
+// noticeFrame builds a system notice.
+func noticeFrame(code, text string) Frame {
+	return mustFrame(FrameSystemNotice, NoticePayload{Code: code, Text: text})
+}
+
+// validReceiptState reports whether a recipient may report the state.
+func validReceiptState(state string) bool {
+	return state == StateDelivered || state == StateRead
+}
+
+// validEmoji reports whether the reaction is short and has no blanks or control characters.
+func validEmoji(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxEmojiLength && strings.IndexFunc(emoji, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) < 0
+}
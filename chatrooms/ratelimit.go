@@ -0,0 +1,57 @@
+package chatrooms
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	rateLimitKeyPrefix = "chatrooms:ratelimit:"
+	defaultRateLimit   = 20
+	defaultRateWindow  = 10 * time.Second
+)
+
+// RateLimiter counts the actions of every key in fixed windows stored in redis, so the limit holds
+// whichever instance the user is connected to.
+type RateLimiter struct {
+	RedisClient *redis.Client
+	// Name separates the counters of the limiters sharing the redis instance.
+	Name   string
+	Limit  int64
+	Window time.Duration
+}
+
+// NewRateLimiter returns a limiter allowing limit actions per window, 0 falls back to 20 per 10s.
+func NewRateLimiter(redisClient *redis.Client, name string, limit int64, window time.Duration) *RateLimiter {
+	if limit <= 0 {
+		limit = defaultRateLimit
+	}
+	if window <= 0 {
+		window = defaultRateWindow
+	}
+	return &RateLimiter{
+		RedisClient: redisClient,
+		Name:        name,
+		Limit:       limit,
+		Window:      window,
+	}
+}
+
+// Allow counts an action of the key and reports whether it stays within the limit of the current window.
+func (r *RateLimiter) Allow(key string) (bool, error) {
+	window := time.Now().UnixNano() / int64(r.Window)
+	counterKey := rateLimitKeyPrefix + r.Name + ":" + key + ":" + strconv.FormatInt(window, 10)
+
+	var count *redis.IntCmd
+	_, err := r.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		count = pipe.Incr(counterKey)
+		pipe.Expire(counterKey, r.Window)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return count.Val() <= r.Limit, nil
+}
@@ -0,0 +1,52 @@
+package chatrooms
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	seenKeyPrefix  = "chatrooms:seen:"
+	defaultSeenTTL = 24 * time.Hour
+)
+
+// SeenMessages remembers the client IDs of the messages accepted recently along with the server ID
+// they got, so a message resent by a client after a reconnect is acknowledged again instead of
+// being published twice.
+type SeenMessages struct {
+	RedisClient *redis.Client
+	TTL         time.Duration
+}
+
+// NewSeenMessages returns a SeenMessages keeping the IDs for ttl, 0 falls back to 24h.
+func NewSeenMessages(redisClient *redis.Client, ttl time.Duration) *SeenMessages {
+	if ttl <= 0 {
+		ttl = defaultSeenTTL
+	}
+	return &SeenMessages{
+		RedisClient: redisClient,
+		TTL:         ttl,
+	}
+}
+
+// FirstSeen records the server ID given to the client message of the user and reports whether
+// the client ID was new. Otherwise it returns the server ID recorded first.
+func (s *SeenMessages) FirstSeen(userID, clientID, messageID string) (string, bool, error) {
+	key := seenKey(userID, clientID)
+	first, err := s.RedisClient.SetNX(key, messageID, s.TTL).Result()
+	if err != nil || first {
+		return messageID, first, err
+	}
+	stored, err := s.RedisClient.Get(key).Result()
+	return stored, false, err
+}
+
+// Forget drops the client ID so the message can be accepted again.
+func (s *SeenMessages) Forget(userID, clientID string) error {
+	return s.RedisClient.Del(seenKey(userID, clientID)).Err()
+}
+
+func seenKey(userID, clientID string) string {
+	return seenKeyPrefix + userID + ":" + clientID
+}
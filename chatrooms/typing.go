@@ -0,0 +1,102 @@
+package chatrooms
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultTypingInterval = 2 * time.Second
+	defaultTypingExpiry   = 5 * time.Second
+)
+
+type (
+	// TypingIndicators throttles the typing.start frames of every user and stops the indicator of
+	// the users gone silent. Nothing is stored: a restart only loses the indicators being shown.
+	TypingIndicators struct {
+		// Interval is the minimum time between two typing.start relayed for the same user and room.
+		Interval time.Duration
+		// Expiry stops the indicator of a user who sent no typing.start for that long.
+		Expiry time.Duration
+
+		mu     sync.Mutex
+		typing map[string]*typingState
+	}
+
+	typingState struct {
+		relayed time.Time
+		timer   *time.Timer
+	}
+)
+
+// NewTypingIndicators returns the indicators with the given interval and expiry, 0 falls back to 2s and 5s.
+func NewTypingIndicators(interval, expiry time.Duration) *TypingIndicators {
+	if interval <= 0 {
+		interval = defaultTypingInterval
+	}
+	if expiry <= 0 {
+		expiry = defaultTypingExpiry
+	}
+	return &TypingIndicators{
+		Interval: interval,
+		Expiry:   expiry,
+		typing:   make(map[string]*typingState),
+	}
+}
+
+// Start records that the user is typing in the room and reports whether the other members should be
+// told, at most once per Interval. expired is called once the user stays silent for Expiry.
+func (t *TypingIndicators) Start(roomID, userID string, expired func()) bool {
+	key := typingKey(roomID, userID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.typing[key]
+	if ok {
+		state.timer.Stop()
+	} else {
+		state = &typingState{}
+		t.typing[key] = state
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(t.Expiry, func() {
+		t.mu.Lock()
+		current, ok := t.typing[key]
+		if !ok || current.timer != timer {
+			// restarted or stopped meanwhile
+			t.mu.Unlock()
+			return
+		}
+		delete(t.typing, key)
+		t.mu.Unlock()
+		expired()
+	})
+	state.timer = timer
+
+	now := time.Now()
+	if now.Sub(state.relayed) < t.Interval {
+		return false
+	}
+	state.relayed = now
+	return true
+}
+
+// Stop clears the indicator of the user and reports whether the other members were told they were typing.
+func (t *TypingIndicators) Stop(roomID, userID string) bool {
+	key := typingKey(roomID, userID)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.typing[key]
+	if !ok {
+		return false
+	}
+	state.timer.Stop()
+	delete(t.typing, key)
+	return true
+}
+
+func typingKey(roomID, userID string) string {
+	return roomID + presenceSeparator + userID
+}
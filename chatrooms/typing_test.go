@@ -0,0 +1,55 @@
+package chatrooms
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTypingIndicators_Throttle(t *testing.T) {
+	typing := NewTypingIndicators(time.Hour, time.Hour)
+	noop := func() {}
+
+	if !typing.Start("random", "alice", noop) {
+		t.Errorf("first typing.start should be relayed")
+	}
+	if typing.Start("random", "alice", noop) {
+		t.Errorf("typing.start within the interval should be throttled")
+	}
+	if !typing.Start("tech", "alice", noop) || !typing.Start("random", "bob", noop) {
+		t.Errorf("throttling should be per user and room")
+	}
+	if !typing.Stop("random", "alice") {
+		t.Errorf("stop should be relayed after a start")
+	}
+	if typing.Stop("random", "alice") {
+		t.Errorf("stop without start should not be relayed")
+	}
+	if !typing.Start("random", "alice", noop) {
+		t.Errorf("typing.start after a stop should be relayed")
+	}
+}
+
+func TestTypingIndicators_Expiry(t *testing.T) {
+	typing := NewTypingIndicators(time.Millisecond, 50*time.Millisecond)
+	expired := make(chan struct{}, 2)
+	onExpiry := func() { expired <- struct{}{} }
+
+	typing.Start("random", "alice", onExpiry)
+	// restarting pushes the expiry back, only the last timer fires
+	time.Sleep(30 * time.Millisecond)
+	typing.Start("random", "alice", onExpiry)
+
+	select {
+	case <-expired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("typing indicator did not expire")
+	}
+	select {
+	case <-expired:
+		t.Errorf("typing indicator expired twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if typing.Stop("random", "alice") {
+		t.Errorf("an expired indicator should not be stopped again")
+	}
+}
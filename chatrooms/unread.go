@@ -0,0 +1,136 @@
+package chatrooms
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	unreadKeyPrefix  = "chatrooms:unread:"
+	readersKeySuffix = ":readers"
+	defaultUnreadTTL = 10 * time.Minute
+)
+
+// incrementUnreadScript counts one more unread message of the room ARGV[1] for a user whose count
+// is cached in KEYS[1], and reports whether it was cached.
+var incrementUnreadScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HINCRBY", KEYS[1], ARGV[1], 1)
+return 1
+`)
+
+// UnreadCounters caches in redis the unread counts of the users, by room, so the rooms list does not
+// count the messages in postgres on every request. Every user has a hash of their counts, and every
+// room a set of the users with a cached count, so a new message increments them in place. A count
+// missed by a race is right again once the user reads the room or the cache expires.
+type UnreadCounters struct {
+	RedisClient *redis.Client
+	TTL         time.Duration
+}
+
+// NewUnreadCounters returns the counters cached for ttl, 0 falls back to 10 minutes.
+func NewUnreadCounters(redisClient *redis.Client, ttl time.Duration) *UnreadCounters {
+	if ttl <= 0 {
+		ttl = defaultUnreadTTL
+	}
+	return &UnreadCounters{
+		RedisClient: redisClient,
+		TTL:         ttl,
+	}
+}
+
+// Get returns the cached counts of the user for the rooms, the rooms without one are left out.
+func (u *UnreadCounters) Get(userID string, roomIDs []string) (map[string]int64, error) {
+	counts := make(map[string]int64, len(roomIDs))
+	if len(roomIDs) == 0 {
+		return counts, nil
+	}
+	values, err := u.RedisClient.HMGet(unreadKey(userID), roomIDs...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if count, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			counts[roomIDs[i]] = count
+		}
+	}
+	return counts, nil
+}
+
+// Set caches the counts of the user, by room.
+func (u *UnreadCounters) Set(userID string, counts map[string]int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	key := unreadKey(userID)
+	fields := make(map[string]interface{}, len(counts))
+	for roomID, count := range counts {
+		fields[roomID] = count
+	}
+	_, err := u.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, fields)
+		pipe.Expire(key, u.TTL)
+		for roomID := range counts {
+			pipe.SAdd(readersKey(roomID), userID)
+			pipe.Expire(readersKey(roomID), u.TTL)
+		}
+		return nil
+	})
+	return err
+}
+
+// Increment counts a new message of the room as unread for the users with a cached count, but its author.
+func (u *UnreadCounters) Increment(roomID, authorID string) error {
+	readers, err := u.RedisClient.SMembers(readersKey(roomID)).Result()
+	if err != nil {
+		return err
+	}
+	for _, userID := range readers {
+		if userID == authorID {
+			continue
+		}
+		cached, err := incrementUnreadScript.Run(u.RedisClient, []string{unreadKey(userID)}, roomID).Int64()
+		if err != nil {
+			return err
+		}
+		if cached == 0 {
+			// the count of the user expired
+			if err := u.RedisClient.SRem(readersKey(roomID), userID).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Forget drops the cached counts of the room, they are counted again on their next read.
+func (u *UnreadCounters) Forget(roomID string) error {
+	readers, err := u.RedisClient.SMembers(readersKey(roomID)).Result()
+	if err != nil {
+		return err
+	}
+	_, err = u.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, userID := range readers {
+			pipe.HDel(unreadKey(userID), roomID)
+		}
+		pipe.Del(readersKey(roomID))
+		return nil
+	})
+	return err
+}
+
+func unreadKey(userID string) string {
+	return unreadKeyPrefix + userID
+}
+
+func readersKey(roomID string) string {
+	return unreadKeyPrefix + roomID + readersKeySuffix
+}
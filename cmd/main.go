@@ -4,21 +4,28 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
-	rabbit "github.com/rabbitmq/amqp091-go"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"go-chat/admin"
+	"go-chat/auth"
 	"go-chat/bot"
 	"go-chat/chatrooms"
+	"go-chat/commands"
 	"go-chat/configs"
 	"go-chat/db"
 	"go-chat/events"
 	"go-chat/messages"
+	"go-chat/rooms"
 	"go-chat/router"
 	"go-chat/users"
 )
@@ -39,6 +46,17 @@ func main() {
 		DbPwd:      os.Getenv(configs.DbPwd),
 		DbName:     os.Getenv(configs.DbName),
 		DbSchema:   os.Getenv(configs.DbSchema),
+
+		SlowConsumerPolicy: os.Getenv(configs.SlowConsumerPolicy),
+		HistoryMaxMessages: os.Getenv(configs.HistoryMaxMessages),
+		HistoryIdleTTL:     os.Getenv(configs.HistoryIdleTTL),
+		HistoryReplayLast:  os.Getenv(configs.HistoryReplayLast),
+		HistoryReplaySince: os.Getenv(configs.HistoryReplaySince),
+		Broker:             os.Getenv(configs.Broker),
+		QueueMaxRetries:    os.Getenv(configs.QueueMaxRetries),
+		QueueRetryDelay:    os.Getenv(configs.QueueRetryDelay),
+		AdminUserIDs:       os.Getenv(configs.AdminUserIDs),
+		PresenceTTL:        os.Getenv(configs.PresenceTTL),
 	}.Check()
 	if err != nil {
 		panic(err)
@@ -55,52 +73,207 @@ func main() {
 		log.Error().Err(err)
 	}
 
-	queueCon, err := rabbit.Dial(env.QueueUrl)
-	failOnError(err, "Failed to connect to RabbitMQ")
-	queueClient := events.NewQueueClient(serviceName, queueCon)
-	defer queueClient.CloseConnection()
-
 	redisClient := redis.NewClient(&redis.Options{
 		Addr: env.CacheUrl,
 	})
 	defer redisClient.Close()
 
+	broker, err := newBroker(env, redisClient)
+	failOnError(err, "Failed to connect to the broker")
+	defer broker.Close()
+
 	usersDB := db.NewUsersDB(conn)
 	messagesDB := db.NewMessagesDB(conn)
+	roomsDB := db.NewRoomsDB(conn)
+	membersDB := db.NewMembersDB(conn)
+	reactionsDB := db.NewReactionsDB(conn)
+	mentionsDB := db.NewMentionsDB(conn)
+	readMarkersDB := db.NewReadMarkersDB(conn)
 
 	usersMgr := users.NewUsersMgr(usersDB)
-	messagesMgr := messages.NewMessagesMgr(messagesDB, usersDB)
+	hub := chatrooms.NewHub()
+	presence, err := newPresence(env, redisClient)
+	if err != nil {
+		panic(err)
+	}
+	unread := chatrooms.NewUnreadCounters(redisClient, 0)
+	roomsMgr := rooms.NewRoomsMgr(roomsDB, membersDB, readMarkersDB, usersDB, presence, unread, broker)
+
+	sessions := auth.NewSessions(redisClient, 0)
 
 	usersHandler := users.Handler{
 		UsersMgr: usersMgr,
+		Sessions: sessions,
 	}
 
 	botClient := bot.StocksClient{
 		Getter: &http.Client{},
 	}
 
-	botMgr := bot.NewBotMgr(botClient, queueClient, nil)
+	botMgr := bot.NewBotMgr(botClient)
+
+	commandsRegistry := commands.NewRegistry()
+	failOnError(commandsRegistry.Register(botMgr.StockCommand()), "Failed to register stock command")
+
+	clientConfig := chatrooms.DefaultClientConfig()
+	if env.SlowConsumerPolicy != "" {
+		clientConfig.SlowConsumer, err = chatrooms.ParseSlowConsumerPolicy(env.SlowConsumerPolicy)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	historyConfig, err := newHistoryConfig(env)
+	if err != nil {
+		panic(err)
+	}
+	history := chatrooms.NewHistoryCache(redisClient, messagesDB, historyConfig)
+	messagesMgr := messages.NewMessagesMgr(messagesDB, reactionsDB, mentionsDB, usersDB, roomsMgr, history, unread, broker)
 
 	chatroomsHandler := chatrooms.Handler{
-		BotManager:  botMgr,
-		RedisClient: redisClient,
-		Publisher:   queueClient,
+		Rooms:         roomsMgr,
+		History:       history,
+		Publisher:     broker,
+		Seen:          chatrooms.NewSeenMessages(redisClient, 0),
+		Presence:      presence,
+		Typing:        chatrooms.NewTypingIndicators(0, 0),
+		Reactions:     messagesMgr,
+		ReactionLimit: chatrooms.NewRateLimiter(redisClient, "reactions", 0, 0),
+		Threads:       messagesMgr,
+		Reads:         roomsMgr,
+		Authors:       messagesMgr,
+		Hub:           hub,
+		ClientConfig:  clientConfig,
+	}
+
+	roomEvents, err := broker.Subscribe(chatrooms.EventsExchangeName, chatroomsHandler.HandleEvent)
+	failOnError(err, "Failed to subscribe to room events")
+	hub.SetBinder(roomEvents)
+
+	msgProcessor := messages.NewProcessor(messagesMgr, commandsRegistry, broker)
+
+	messagesHandler := messages.Handler{
+		MessagesMgr: messagesMgr,
+		Rooms:       roomsMgr,
 	}
 
-	msgProcessor := messages.NewProcessor(messagesMgr, botMgr, queueClient)
+	roomsHandler := rooms.Handler{
+		RoomsMgr: roomsMgr,
+	}
+
+	adminHandler := admin.Handler{
+		DeadLettersMgr: admin.NewDeadLettersMgr(broker, chatrooms.MessagesChannelName),
+	}
 
-	apiHandlers := router.NewAPIHandlers(&usersHandler, &chatroomsHandler)
+	admins, err := adminUserIDs(env.AdminUserIDs)
+	if err != nil {
+		panic(err)
+	}
+	apiHandlers := router.NewAPIHandlers(&usersHandler, &chatroomsHandler, &messagesHandler, &roomsHandler, &adminHandler,
+		auth.Middleware(sessions), auth.RequireAdmin(admins))
 	r := router.Router(apiHandlers)
 
 	go chatroomsHandler.HandleMessages()
-	go msgProcessor.WaitForQueueMsgs()
-	go chatroomsHandler.WaitingForQueueMsgs()
+	go presence.Heartbeat(chatroomsHandler.AnnounceOffline)
+	failOnError(msgProcessor.WaitForQueueMsgs(), "Failed to consume chat messages")
 
 	log.Info().Msg(fmt.Sprintf("successfully started %s service \n", serviceName))
 	r.Start(":" + env.ServerPort)
 
 }
 
+// newPresence returns the presence tracker with the configured expiry.
+func newPresence(env configs.Environment, redisClient *redis.Client) (*chatrooms.Presence, error) {
+	var ttl time.Duration
+	if env.PresenceTTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(env.PresenceTTL); err != nil {
+			return nil, err
+		}
+	}
+	return chatrooms.NewPresence(redisClient, ttl), nil
+}
+
+// newBroker connects to the configured broker with the configured retry policy.
+func newBroker(env configs.Environment, redisClient *redis.Client) (events.Broker, error) {
+	policy := events.DefaultRetryPolicy()
+	var err error
+	if env.QueueMaxRetries != "" {
+		if policy.MaxRetries, err = strconv.Atoi(env.QueueMaxRetries); err != nil {
+			return nil, err
+		}
+	}
+	if env.QueueRetryDelay != "" {
+		if policy.RetryDelay, err = time.ParseDuration(env.QueueRetryDelay); err != nil {
+			return nil, err
+		}
+	}
+
+	switch env.Broker {
+	case "", configs.BrokerRabbitMQ:
+		queueClient := events.NewQueueClient(serviceName, events.Dial(env.QueueUrl))
+		queueClient.RetryPolicy = policy
+		return queueClient, queueClient.Connect()
+	case configs.BrokerRedis:
+		// the hostname identifies the instance across restarts, e.g. the pod name
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		redisBroker := events.NewRedisBroker(redisClient, serviceName, hostname)
+		redisBroker.RetryPolicy = policy
+		return redisBroker, nil
+	case configs.BrokerMemory:
+		memoryBroker := events.NewMemoryBroker()
+		memoryBroker.RetryPolicy = policy
+		return memoryBroker, nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", env.Broker)
+}
+
+// newHistoryConfig overrides the default history settings with the configured ones.
+func newHistoryConfig(env configs.Environment) (chatrooms.HistoryConfig, error) {
+	cfg := chatrooms.DefaultHistoryConfig()
+	var err error
+	if env.HistoryMaxMessages != "" {
+		if cfg.MaxMessages, err = strconv.ParseInt(env.HistoryMaxMessages, 10, 64); err != nil {
+			return cfg, err
+		}
+	}
+	if env.HistoryIdleTTL != "" {
+		if cfg.IdleTTL, err = time.ParseDuration(env.HistoryIdleTTL); err != nil {
+			return cfg, err
+		}
+	}
+	if env.HistoryReplayLast != "" {
+		if cfg.ReplayLast, err = strconv.ParseInt(env.HistoryReplayLast, 10, 64); err != nil {
+			return cfg, err
+		}
+	}
+	if env.HistoryReplaySince != "" {
+		if cfg.ReplaySince, err = time.ParseDuration(env.HistoryReplaySince); err != nil {
+			return cfg, err
+		}
+	}
+	return cfg, nil
+}
+
+// adminUserIDs parses the comma separated list of admin user IDs, ignoring blanks.
+func adminUserIDs(value string) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	for _, raw := range strings.Split(value, ",") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		userID, err := uuid.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin user id %q: %w", raw, err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
 func failOnError(err error, msg string) {
 	if err != nil {
 		log.Panic().Err(err).Msg(msg)
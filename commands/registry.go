@@ -0,0 +1,198 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	prefix         = "/"
+	argSeparator   = "="
+	helpName       = "help"
+	defaultTimeout = 10 * time.Second
+)
+
+var (
+	namePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+	ErrAlreadyRegistered = errors.New("command already registered")
+	ErrInvalidName       = errors.New("invalid command name")
+)
+
+type (
+	// Invocation is a command typed by a user, e.g. "/stock aapl.us" or "/stock=aapl.us".
+	Invocation struct {
+		Name string
+		Args []string
+	}
+
+	// Executor runs a command and returns the text replied to the room.
+	Executor func(ctx context.Context, inv Invocation) (string, error)
+
+	Command struct {
+		Name string
+		// Usage describes the arguments, e.g. "<stock_code>".
+		Usage   string
+		Help    string
+		MinArgs int
+		// MaxArgs is the maximum number of arguments, a negative value means unbounded.
+		MaxArgs int
+		Exec    Executor
+	}
+
+	// Reply is the outcome of a command. Private replies only go to the sender.
+	Reply struct {
+		Text    string
+		Private bool
+	}
+
+	// UsageError is returned when a command is unknown or called with the wrong arguments.
+	UsageError struct {
+		Msg string
+	}
+
+	Registry struct {
+		mu       sync.RWMutex
+		commands map[string]Command
+		Timeout  time.Duration
+	}
+)
+
+func (e *UsageError) Error() string {
+	return e.Msg
+}
+
+// NewRegistry returns a registry holding the built-in /help command.
+func NewRegistry() *Registry {
+	r := &Registry{
+		commands: make(map[string]Command),
+		Timeout:  defaultTimeout,
+	}
+	r.commands[helpName] = Command{
+		Name:    helpName,
+		Help:    "lists the available commands",
+		MaxArgs: 0,
+		Exec:    r.help,
+	}
+	return r
+}
+
+func (r *Registry) Register(cmd Command) error {
+	if !namePattern.MatchString(cmd.Name) {
+		return ErrInvalidName
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.commands[cmd.Name]; ok {
+		return ErrAlreadyRegistered
+	}
+	r.commands[cmd.Name] = cmd
+	return nil
+}
+
+// IsCommand reports whether the text should be handled as a command instead of a chat message.
+func IsCommand(text string) bool {
+	_, ok := Parse(text)
+	return ok
+}
+
+// Parse splits "/cmd arg1 arg2" or "/cmd=arg" into an invocation.
+func Parse(text string) (Invocation, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, prefix) {
+		return Invocation{}, false
+	}
+	body := strings.TrimPrefix(text, prefix)
+
+	end := strings.IndexAny(body, " \t"+argSeparator)
+	if end < 0 {
+		end = len(body)
+	}
+	name := strings.ToLower(body[:end])
+	if !namePattern.MatchString(name) {
+		return Invocation{}, false
+	}
+
+	inv := Invocation{Name: name}
+	rest := body[end:]
+	if strings.HasPrefix(rest, argSeparator) {
+		if arg := strings.TrimSpace(strings.TrimPrefix(rest, argSeparator)); arg != "" {
+			inv.Args = []string{arg}
+		}
+		return inv, true
+	}
+	inv.Args = strings.Fields(rest)
+	return inv, true
+}
+
+// Execute runs the command in the text and returns its reply.
+// Bad input results in a private reply explaining the usage.
+func (r *Registry) Execute(ctx context.Context, text string) Reply {
+	inv, ok := Parse(text)
+	if !ok {
+		return Reply{Text: "not a command, type /help to list the commands", Private: true}
+	}
+
+	r.mu.RLock()
+	cmd, ok := r.commands[inv.Name]
+	r.mu.RUnlock()
+	if !ok {
+		return Reply{Text: fmt.Sprintf("unknown command /%s, type /help to list the commands", inv.Name), Private: true}
+	}
+	if len(inv.Args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(inv.Args) > cmd.MaxArgs) {
+		return Reply{Text: "usage: " + cmd.signature(), Private: true}
+	}
+
+	text, err := cmd.Exec(ctx, inv)
+	var usageErr *UsageError
+	switch {
+	case errors.As(err, &usageErr):
+		return Reply{Text: usageErr.Msg + ", usage: " + cmd.signature(), Private: true}
+	case err != nil:
+		log.Error().Err(err).Msgf("error executing command /%s", inv.Name)
+		return Reply{Text: fmt.Sprintf("/%s failed, try again later", inv.Name), Private: true}
+	}
+	return Reply{Text: text, Private: cmd.Name == helpName}
+}
+
+// Dispatch executes the command in its own goroutine and hands the reply to the callback.
+func (r *Registry) Dispatch(text string, callback func(Reply)) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+		defer cancel()
+		callback(r.Execute(ctx, text))
+	}()
+}
+
+func (r *Registry) help(context.Context, Invocation) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		cmd := r.commands[name]
+		lines = append(lines, cmd.signature()+" - "+cmd.Help)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (c Command) signature() string {
+	if c.Usage == "" {
+		return prefix + c.Name
+	}
+	return prefix + c.Name + " " + c.Usage
+}
@@ -0,0 +1,123 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		want   Invocation
+		wantOk bool
+	}{
+		{
+			name:   "Parse - Equal separator",
+			text:   "/stock=aapl.us",
+			want:   Invocation{Name: "stock", Args: []string{"aapl.us"}},
+			wantOk: true,
+		},
+		{
+			name:   "Parse - Space separated args",
+			text:   "  /Stock aapl.us  msft.us ",
+			want:   Invocation{Name: "stock", Args: []string{"aapl.us", "msft.us"}},
+			wantOk: true,
+		},
+		{
+			name:   "Parse - Without args",
+			text:   "/help",
+			want:   Invocation{Name: "help", Args: []string{}},
+			wantOk: true,
+		},
+		{
+			name:   "Parse - Empty arg after equal",
+			text:   "/stock=",
+			want:   Invocation{Name: "stock"},
+			wantOk: true,
+		},
+		{
+			name:   "Parse - Plain text",
+			text:   "hello /stock=aapl.us",
+			wantOk: false,
+		},
+		{
+			name:   "Parse - Slash only",
+			text:   "/",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Parse(tt.text)
+			if ok != tt.wantOk {
+				t.Fatalf("Parse() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistry_Execute(t *testing.T) {
+	registry := NewRegistry()
+	err := registry.Register(Command{
+		Name:    "echo",
+		Usage:   "<text>",
+		Help:    "repeats the text",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Exec: func(ctx context.Context, inv Invocation) (string, error) {
+			switch inv.Args[0] {
+			case "bad":
+				return "", &UsageError{Msg: "bad text"}
+			case "fail":
+				return "", errors.New("downstream unavailable")
+			}
+			return inv.Args[0], nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		text        string
+		wantText    string
+		wantPrivate bool
+	}{
+		{name: "Execute - Success", text: "/echo=hi", wantText: "hi", wantPrivate: false},
+		{name: "Execute - Missing args", text: "/echo", wantText: "usage: /echo <text>", wantPrivate: true},
+		{name: "Execute - Too many args", text: "/echo a b", wantText: "usage: /echo <text>", wantPrivate: true},
+		{name: "Execute - Usage error from executor", text: "/echo bad", wantText: "bad text, usage: /echo <text>", wantPrivate: true},
+		{name: "Execute - Executor failure", text: "/echo fail", wantText: "/echo failed, try again later", wantPrivate: true},
+		{name: "Execute - Unknown command", text: "/nope", wantText: "unknown command /nope", wantPrivate: true},
+		{name: "Execute - Help", text: "/help", wantText: "/echo <text> - repeats the text", wantPrivate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := registry.Execute(context.Background(), tt.text)
+			if !strings.Contains(reply.Text, tt.wantText) {
+				t.Errorf("Execute() text = %q, want it to contain %q", reply.Text, tt.wantText)
+			}
+			if reply.Private != tt.wantPrivate {
+				t.Errorf("Execute() private = %v, want %v", reply.Private, tt.wantPrivate)
+			}
+		})
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	registry := NewRegistry()
+	if err := registry.Register(Command{Name: "help"}); err != ErrAlreadyRegistered {
+		t.Errorf("Register() error = %v, want %v", err, ErrAlreadyRegistered)
+	}
+	if err := registry.Register(Command{Name: "Bad Name"}); err != ErrInvalidName {
+		t.Errorf("Register() error = %v, want %v", err, ErrInvalidName)
+	}
+}
@@ -17,6 +17,29 @@ const (
 	DbPwd         = "DB_PASSWORD"
 	DbName        = "DB_NAME"
 	DbSchema      = "DB_SCHEMA"
+	// SlowConsumerPolicy is optional: "drop" (default) or "disconnect"
+	SlowConsumerPolicy = "WS_SLOW_CONSUMER_POLICY"
+	// History settings are optional, durations use time.ParseDuration format
+	HistoryMaxMessages = "HISTORY_MAX_MESSAGES"
+	HistoryIdleTTL     = "HISTORY_IDLE_TTL"
+	HistoryReplayLast  = "HISTORY_REPLAY_LAST"
+	HistoryReplaySince = "HISTORY_REPLAY_SINCE"
+	// Broker is optional: "rabbitmq" (default), "redis" or "memory" for a single instance
+	Broker = "BROKER"
+	// Queue retry settings are optional, the delay grows with every attempt
+	QueueMaxRetries = "QUEUE_MAX_RETRIES"
+	QueueRetryDelay = "QUEUE_RETRY_DELAY"
+	// AdminUserIDs is an optional comma separated list of the IDs of the users allowed in the admin endpoints
+	AdminUserIDs = "ADMIN_USER_IDS"
+	// PresenceTTL is optional, how long the connections of a crashed instance stay online (time.ParseDuration format)
+	PresenceTTL = "PRESENCE_TTL"
+)
+
+// Supported brokers
+const (
+	BrokerRabbitMQ = "rabbitmq"
+	BrokerRedis    = "redis"
+	BrokerMemory   = "memory"
 )
 
 // Environment configurations struct
@@ -31,6 +54,17 @@ type Environment struct {
 	DbPwd      string
 	DbName     string
 	DbSchema   string
+
+	SlowConsumerPolicy string
+	HistoryMaxMessages string
+	HistoryIdleTTL     string
+	HistoryReplayLast  string
+	HistoryReplaySince string
+	Broker             string
+	QueueMaxRetries    string
+	QueueRetryDelay    string
+	AdminUserIDs       string
+	PresenceTTL        string
 }
 
 // Check validates service configurations
@@ -40,7 +74,7 @@ func (e Environment) Check() (Environment, error) {
 		return e, errMessage(ServerHostKey)
 	case e.ServerPort == "":
 		return e, errMessage(ServerPortKey)
-	case e.QueueUrl == "":
+	case e.QueueUrl == "" && (e.Broker == "" || e.Broker == BrokerRabbitMQ):
 		return e, errMessage(QueueUrl)
 	case e.CacheUrl == "":
 		return e, errMessage(CacheUrl)
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+type RoomMember struct {
+	RoomID    string    `gorm:"column:room_id;primaryKey"`
+	UserID    uuid.UUID `gorm:"column:user_id;type:uuid;primaryKey"`
+	Role      string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TableName returns the table name associated to MembersDB.
+func (*RoomMember) TableName() string {
+	return "chatrooms.room_members"
+}
+
+// RoomMemberWithNickname is a member joined with the nickname of the user.
+type RoomMemberWithNickname struct {
+	RoomMember
+	Nickname string
+}
+
+type RoomInvitation struct {
+	RoomID    string    `gorm:"column:room_id;primaryKey"`
+	UserID    uuid.UUID `gorm:"column:user_id;type:uuid;primaryKey"`
+	InvitedBy uuid.UUID
+	CreatedAt time.Time
+}
+
+// TableName returns the table name associated to room invitations.
+func (*RoomInvitation) TableName() string {
+	return "chatrooms.room_invitations"
+}
+
+type MembersDB struct {
+	conn *gorm.DB
+}
+
+func NewMembersDB(conn *gorm.DB) *MembersDB {
+	return &MembersDB{conn: conn}
+}
+
+// Add stores the membership, keeping the current role if the user is already a member.
+func (db *MembersDB) Add(member RoomMember) error {
+	return db.conn.WithContext(context.TODO()).Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+}
+
+func (db *MembersDB) Get(roomID string, userID uuid.UUID) (member RoomMember, err error) {
+	err = db.conn.WithContext(context.TODO()).Where("room_id = ? AND user_id = ?", roomID, userID).Find(&member).Error
+	return
+}
+
+func (db *MembersDB) List(roomID string) (members []RoomMemberWithNickname, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Table("chatrooms.room_members AS rm").
+		Select("rm.*, u.nickname").
+		Joins("JOIN chatrooms.users AS u ON u.id = rm.user_id").
+		Where("rm.room_id = ?", roomID).
+		Order("rm.created_at").
+		Find(&members).Error
+	return
+}
+
+func (db *MembersDB) UpdateRole(roomID string, userID uuid.UUID, role string) error {
+	return db.conn.WithContext(context.TODO()).Model(&RoomMember{}).
+		Where("room_id = ? AND user_id = ?", roomID, userID).
+		Update("role", role).Error
+}
+
+func (db *MembersDB) Remove(roomID string, userID uuid.UUID) error {
+	return db.conn.WithContext(context.TODO()).Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&RoomMember{}).Error
+}
+
+// Invite stores a pending invitation, refreshing it if the user was already invited.
+func (db *MembersDB) Invite(invitation RoomInvitation) error {
+	return db.conn.WithContext(context.TODO()).Clauses(clause.OnConflict{UpdateAll: true}).Create(&invitation).Error
+}
+
+// AcceptInvitation turns a pending invitation into a membership. It reports false when there was no invitation.
+func (db *MembersDB) AcceptInvitation(roomID string, userID uuid.UUID) (accepted bool, err error) {
+	err = db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&RoomInvitation{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		accepted = true
+		member := RoomMember{RoomID: roomID, UserID: userID, Role: RoleMember}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+	})
+	return
+}
@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Mention struct {
+	MessageID uuid.UUID `gorm:"column:message_id;type:uuid;primaryKey"`
+	UserID    uuid.UUID `gorm:"column:user_id;type:uuid;primaryKey"`
+	ReadAt    *time.Time
+	CreatedAt time.Time
+}
+
+// TableName returns the table name associated to MentionsDB.
+func (*Mention) TableName() string {
+	return "chatrooms.message_mentions"
+}
+
+// MentionedMessage is an unread mention, with the message and its author.
+type MentionedMessage struct {
+	MessageWithAuthor
+	MentionedAt time.Time
+}
+
+type MentionsDB struct {
+	conn *gorm.DB
+}
+
+func NewMentionsDB(conn *gorm.DB) *MentionsDB {
+	return &MentionsDB{conn: conn}
+}
+
+// Add stores the mentions and returns the ones that were not stored yet.
+func (db *MentionsDB) Add(mentions []Mention) (created []Mention, err error) {
+	conn := db.conn.WithContext(context.TODO())
+	for _, mention := range mentions {
+		result := conn.Clauses(clause.OnConflict{DoNothing: true}).Create(&mention)
+		if result.Error != nil {
+			return created, result.Error
+		}
+		if result.RowsAffected > 0 {
+			created = append(created, mention)
+		}
+	}
+	return created, nil
+}
+
+// ListUnread returns up to limit unread mentions of the user, newest first, leaving out the deleted
+// messages and the rooms the user can no longer see.
+func (db *MentionsDB) ListUnread(userID uuid.UUID, limit int) (mentions []MentionedMessage, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Table("chatrooms.message_mentions AS mm").
+		Select("m.*, u.nickname, mm.created_at AS mentioned_at").
+		Joins("JOIN chatrooms.messages AS m ON m.id = mm.message_id").
+		Joins("JOIN chatrooms.users AS u ON u.id = m.user_id").
+		Joins("JOIN chatrooms.rooms AS r ON r.id = m.chatroom").
+		Where("mm.user_id = ? AND mm.read_at IS NULL AND m.deleted_at IS NULL", userID).
+		Where("r.visibility = ? OR EXISTS (SELECT 1 FROM chatrooms.room_members AS rm WHERE rm.room_id = r.id AND rm.user_id = mm.user_id)",
+			VisibilityPublic).
+		Order("mm.created_at DESC, mm.message_id").
+		Limit(limit).
+		Find(&mentions).Error
+	return
+}
+
+// MarkRead marks the given mentions of the user as read, all of them when messageIDs is empty,
+// and returns how many were unread.
+func (db *MentionsDB) MarkRead(userID uuid.UUID, messageIDs []uuid.UUID) (int64, error) {
+	query := db.conn.WithContext(context.TODO()).Model(&Mention{}).
+		Where("user_id = ? AND read_at IS NULL", userID)
+	if len(messageIDs) > 0 {
+		query = query.Where("message_id IN ?", messageIDs)
+	}
+	result := query.Update("read_at", time.Now())
+	return result.RowsAffected, result.Error
+}
@@ -6,18 +6,56 @@ import (
 
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Message struct {
-	ID        uuid.UUID `gorm:"column:id;type:uuid;primaryKey;default:uuid_generate_v4()"`
+	ID       uuid.UUID  `gorm:"column:id;type:uuid;primaryKey;default:uuid_generate_v4()"`
+	ClientID *uuid.UUID `gorm:"column:client_id;type:uuid"`
+	// ParentID is set on the replies, to the first message of their thread.
+	ParentID  *uuid.UUID `gorm:"column:parent_id;type:uuid"`
 	UserID    uuid.UUID
 	Body      string
 	Chatroom  string
+	EditedAt  *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt
 }
 
+// Actions recorded in the edit history of a message
+const (
+	EditActionEdit   = "edit"
+	EditActionDelete = "delete"
+)
+
+// MessageEdit keeps the body a message had before an edit or its deletion.
+type MessageEdit struct {
+	ID           uuid.UUID `gorm:"column:id;type:uuid;primaryKey;default:uuid_generate_v4()"`
+	MessageID    uuid.UUID
+	EditorID     uuid.UUID
+	Action       string
+	PreviousBody string
+	CreatedAt    time.Time
+}
+
+// TableName returns the table name associated to message edits.
+func (*MessageEdit) TableName() string {
+	return "chatrooms.message_edits"
+}
+
+// MessageWithAuthor is a message joined with the nickname of its author.
+type MessageWithAuthor struct {
+	Message
+	Nickname string
+}
+
+// MessageCursor points at a message in the (created_at, id) order used for pagination.
+type MessageCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
 // TableName returns the table name associated to MessagesDB.
 func (*Message) TableName() string {
 	return "chatrooms.messages"
@@ -31,8 +69,191 @@ func NewMessagesDB(conn *gorm.DB) *MessagesDB {
 	return &MessagesDB{conn: conn}
 }
 
-func (db *MessagesDB) Create(message Message) (uuid.UUID, error) {
-	err := db.conn.WithContext(context.TODO()).Create(&message).Error
+// Create inserts the message once and returns the stored row, reporting whether it was inserted.
+// Creating it again, with the same ID or the same author and client ID, returns the message stored
+// first, even if deleted since.
+func (db *MessagesDB) Create(message Message) (Message, bool, error) {
+	conn := db.conn.WithContext(context.TODO())
+	result := conn.Clauses(clause.OnConflict{DoNothing: true}).Create(&message)
+	if result.Error != nil {
+		return Message{}, false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return message, true, nil
+	}
+
+	// the message stored first may have been deleted since
+	var stored Message
+	query := conn.Unscoped().Where("id = ?", message.ID)
+	if message.ClientID != nil {
+		query = query.Or("user_id = ? AND client_id = ?", message.UserID, message.ClientID)
+	}
+	err := query.First(&stored).Error
+	return stored, false, err
+}
+
+// GetByID returns the message, deleted or not, the ID is empty when it does not exist.
+func (db *MessagesDB) GetByID(id uuid.UUID) (message Message, err error) {
+	err = db.conn.WithContext(context.TODO()).Unscoped().Where("id = ?", id).Find(&message).Error
+	return
+}
+
+// Edit replaces the body of the message, recording the previous one in its edit history.
+// The ID is empty when the message does not exist or was deleted.
+func (db *MessagesDB) Edit(id, editorID uuid.UUID, body string) (message Message, err error) {
+	err = db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		if err := lockMessage(tx, id, &message); err != nil || message.ID == uuid.Nil {
+			return err
+		}
+		if err := recordEdit(tx, message, editorID, EditActionEdit); err != nil {
+			return err
+		}
+		editedAt := time.Now()
+		message.Body = body
+		message.EditedAt = &editedAt
+		return tx.Model(&message).Updates(map[string]interface{}{"body": body, "edited_at": editedAt}).Error
+	})
+	return
+}
+
+// Delete soft deletes the message, recording its body in its edit history.
+// The ID is empty when the message does not exist or was already deleted.
+func (db *MessagesDB) Delete(id, editorID uuid.UUID) (message Message, err error) {
+	err = db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		if err := lockMessage(tx, id, &message); err != nil || message.ID == uuid.Nil {
+			return err
+		}
+		if err := recordEdit(tx, message, editorID, EditActionDelete); err != nil {
+			return err
+		}
+		return tx.Delete(&message).Error
+	})
+	return
+}
+
+// ListEdits returns the edit history of the message, oldest first, including the deleted messages.
+func (db *MessagesDB) ListEdits(messageID uuid.UUID) (edits []MessageEdit, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Where("message_id = ?", messageID).
+		Order("created_at").
+		Find(&edits).Error
+	return
+}
+
+// lockMessage loads the message for update, leaving it empty when it does not exist.
+func lockMessage(tx *gorm.DB, id uuid.UUID, message *Message) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", id).Find(message).Error
+}
+
+func recordEdit(tx *gorm.DB, message Message, editorID uuid.UUID, action string) error {
+	return tx.Create(&MessageEdit{
+		MessageID:    message.ID,
+		EditorID:     editorID,
+		Action:       action,
+		PreviousBody: message.Body,
+	}).Error
+}
+
+// ThreadStats summarizes the replies to a message.
+type ThreadStats struct {
+	ParentID    uuid.UUID
+	ReplyCount  int
+	LastReplyAt time.Time
+}
+
+// ListReplies returns up to limit replies to the message newer than after, oldest first.
+// A nil cursor starts from the first reply.
+func (db *MessagesDB) ListReplies(parentID uuid.UUID, after *MessageCursor, limit int) (messages []MessageWithAuthor, err error) {
+	query := db.conn.WithContext(context.TODO()).
+		Table("chatrooms.messages AS m").
+		Select("m.*, u.nickname").
+		Joins("JOIN chatrooms.users AS u ON u.id = m.user_id").
+		Where("m.parent_id = ? AND m.deleted_at IS NULL", parentID)
+	if after != nil {
+		query = query.Where("(m.created_at, m.id) > (?, ?)", after.CreatedAt, after.ID)
+	}
+	err = query.Order("m.created_at, m.id").Limit(limit).Find(&messages).Error
+	return
+}
+
+// GetThreadStats returns the reply counts of the messages that have replies.
+func (db *MessagesDB) GetThreadStats(parentIDs []uuid.UUID) (stats []ThreadStats, err error) {
+	if len(parentIDs) == 0 {
+		return nil, nil
+	}
+	err = db.conn.WithContext(context.TODO()).Model(&Message{}).
+		Select("parent_id, count(*) AS reply_count, max(created_at) AS last_reply_at").
+		Where("parent_id IN ?", parentIDs).
+		Group("parent_id").
+		Find(&stats).Error
+	return
+}
+
+// ListThreadParticipants returns the users who wrote the message or replied to it.
+func (db *MessagesDB) ListThreadParticipants(parentID uuid.UUID) (userIDs []uuid.UUID, err error) {
+	err = db.conn.WithContext(context.TODO()).Model(&Message{}).
+		Distinct("user_id").
+		Where("id = ? OR parent_id = ?", parentID, parentID).
+		Pluck("user_id", &userIDs).Error
+	return
+}
+
+// ListByChatroom returns up to limit messages of the chatroom older than before, newest first.
+// A nil cursor starts from the latest message.
+func (db *MessagesDB) ListByChatroom(chatroom string, before *MessageCursor, limit int) (messages []MessageWithAuthor, err error) {
+	query := db.conn.WithContext(context.TODO()).
+		Table("chatrooms.messages AS m").
+		Select("m.*, u.nickname").
+		Joins("JOIN chatrooms.users AS u ON u.id = m.user_id").
+		Where("m.chatroom = ? AND m.deleted_at IS NULL", chatroom)
+	if before != nil {
+		query = query.Where("(m.created_at, m.id) < (?, ?)", before.CreatedAt, before.ID)
+	}
+	err = query.Order("m.created_at DESC, m.id DESC").Limit(limit).Find(&messages).Error
+	return
+}
+
+const (
+	// searchHeadline marks the matched words of the snippets, with up to two fragments of the body.
+	searchHeadline = "StartSel=<mark>, StopSel=</mark>, MaxWords=30, MinWords=10, MaxFragments=2"
+	// escapedBody is the body of the message escaped for HTML, so the marks are the only markup of the snippets.
+	escapedBody = `replace(replace(replace(replace(replace(m.body, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;'), '''', '&#39;')`
+)
+
+// MessageSearch filters a full-text search of the messages, Room and From are optional.
+type MessageSearch struct {
+	Text string
+	Room string
+	// From is the nickname of the author.
+	From string
+}
+
+// SearchResult is a message matching a search, with a snippet of its body marking the matched words.
+type SearchResult struct {
+	MessageWithAuthor
+	Snippet string
+}
 
-	return message.ID, err
+// Search returns up to limit messages matching the search older than before, newest first, out of
+// the public rooms and the rooms the user is a member of. A nil cursor starts from the latest match.
+func (db *MessagesDB) Search(userID uuid.UUID, search MessageSearch, before *MessageCursor, limit int) (results []SearchResult, err error) {
+	query := db.conn.WithContext(context.TODO()).
+		Table("chatrooms.messages AS m").
+		Select("m.*, u.nickname, ts_headline('pg_catalog.simple', "+escapedBody+", q, ?) AS snippet", searchHeadline).
+		Joins("CROSS JOIN plainto_tsquery('pg_catalog.simple', ?) AS q", search.Text).
+		Joins("JOIN chatrooms.users AS u ON u.id = m.user_id").
+		Joins("JOIN chatrooms.rooms AS r ON r.id = m.chatroom").
+		Where("m.body_tsv @@ q AND m.deleted_at IS NULL").
+		Where("r.visibility = ? OR r.id IN (SELECT room_id FROM chatrooms.room_members WHERE user_id = ?)", VisibilityPublic, userID)
+	if search.Room != "" {
+		query = query.Where("m.chatroom = ?", search.Room)
+	}
+	if search.From != "" {
+		query = query.Where("u.nickname = ?", search.From)
+	}
+	if before != nil {
+		query = query.Where("(m.created_at, m.id) < (?, ?)", before.CreatedAt, before.ID)
+	}
+	err = query.Order("m.created_at DESC, m.id DESC").Limit(limit).Find(&results).Error
+	return
 }
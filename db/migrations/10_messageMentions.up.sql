@@ -0,0 +1,20 @@
+-- users mentioned by a message, read_at is set once the user saw the mention
+CREATE TABLE IF NOT EXISTS "chatrooms"."message_mentions"
+(
+    "message_id" uuid not null,
+    "user_id"    uuid not null,
+    "read_at"    timestamp with time zone,
+    "created_at" timestamp with time zone default now(),
+    PRIMARY KEY ("message_id", "user_id"),
+    CONSTRAINT fk_message
+        FOREIGN KEY("message_id")
+            REFERENCES "chatrooms"."messages"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user
+        FOREIGN KEY("user_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "message_mentions_unread_idx" ON "chatrooms"."message_mentions" ("user_id", "created_at")
+    WHERE "read_at" IS NULL;
@@ -0,0 +1,19 @@
+-- the last message each user read in a room, last_read_at is the creation time of that message so
+-- the unread messages are the ones after (last_read_at, message_id)
+CREATE TABLE IF NOT EXISTS "chatrooms"."read_markers"
+(
+    "user_id"      uuid not null,
+    "room_id"      varchar(50) not null,
+    "message_id"   uuid not null,
+    "last_read_at" timestamp with time zone not null,
+    "updated_at"   timestamp with time zone default now(),
+    PRIMARY KEY ("user_id", "room_id"),
+    CONSTRAINT fk_user
+        FOREIGN KEY("user_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_room
+        FOREIGN KEY("room_id")
+            REFERENCES "chatrooms"."rooms"("id")
+            ON DELETE CASCADE
+);
@@ -0,0 +1,13 @@
+-- full-text search over the message bodies, with the simple configuration as the rooms mix languages
+ALTER TABLE "chatrooms"."messages" ADD COLUMN IF NOT EXISTS "body_tsv" tsvector;
+
+UPDATE "chatrooms"."messages" SET "body_tsv" = to_tsvector('pg_catalog.simple', "body") WHERE "body_tsv" IS NULL;
+
+CREATE INDEX IF NOT EXISTS "messages_body_tsv_idx"
+    ON "chatrooms"."messages" USING GIN ("body_tsv");
+
+-- the stored and edited bodies keep their vector up to date
+DROP TRIGGER IF EXISTS "messages_body_tsv_update" ON "chatrooms"."messages";
+CREATE TRIGGER "messages_body_tsv_update"
+    BEFORE INSERT OR UPDATE OF "body" ON "chatrooms"."messages"
+    FOR EACH ROW EXECUTE PROCEDURE tsvector_update_trigger("body_tsv", 'pg_catalog.simple', "body");
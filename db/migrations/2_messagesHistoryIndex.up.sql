@@ -0,0 +1,3 @@
+-- keyset pagination of a chatroom history walks (created_at, id) backwards
+CREATE INDEX IF NOT EXISTS "messages_chatroom_created_at_id_idx"
+    ON "chatrooms"."messages" ("chatroom", "created_at" DESC, "id" DESC);
@@ -0,0 +1,24 @@
+-- rooms table
+CREATE TABLE IF NOT EXISTS "chatrooms"."rooms"
+(
+    "id"         varchar(50) not null,
+    "owner_id"   uuid,
+    "title"      varchar(256) not null,
+    "topic"      varchar(1024) not null default '',
+    "visibility" varchar(16) not null default 'public',
+    "created_at" timestamp with time zone default now(),
+    "updated_at" timestamp with time zone default now(),
+    PRIMARY KEY ("id"),
+    CONSTRAINT visibility_check CHECK (visibility IN ('public', 'private')),
+    CONSTRAINT fk_owner
+        FOREIGN KEY("owner_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE SET NULL
+);
+
+-- rooms offered by the login page, owned by nobody
+INSERT INTO "chatrooms"."rooms" ("id", "title")
+VALUES ('random', 'Random'),
+       ('tech', 'Tech'),
+       ('music', 'Music')
+ON CONFLICT ("id") DO NOTHING;
@@ -0,0 +1,50 @@
+-- room members table
+CREATE TABLE IF NOT EXISTS "chatrooms"."room_members"
+(
+    "room_id"    varchar(50) not null,
+    "user_id"    uuid not null,
+    "role"       varchar(16) not null default 'member',
+    "created_at" timestamp with time zone default now(),
+    "updated_at" timestamp with time zone default now(),
+    PRIMARY KEY ("room_id", "user_id"),
+    CONSTRAINT role_check CHECK (role IN ('owner', 'moderator', 'member')),
+    CONSTRAINT fk_room
+        FOREIGN KEY("room_id")
+            REFERENCES "chatrooms"."rooms"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user
+        FOREIGN KEY("user_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "room_members_user_id_idx" ON "chatrooms"."room_members" ("user_id");
+
+-- pending invitations to private rooms
+CREATE TABLE IF NOT EXISTS "chatrooms"."room_invitations"
+(
+    "room_id"    varchar(50) not null,
+    "user_id"    uuid not null,
+    "invited_by" uuid not null,
+    "created_at" timestamp with time zone default now(),
+    PRIMARY KEY ("room_id", "user_id"),
+    CONSTRAINT fk_room
+        FOREIGN KEY("room_id")
+            REFERENCES "chatrooms"."rooms"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user
+        FOREIGN KEY("user_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_invited_by
+        FOREIGN KEY("invited_by")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE
+);
+
+-- the owners of the existing rooms are their first members
+INSERT INTO "chatrooms"."room_members" ("room_id", "user_id", "role")
+SELECT "id", "owner_id", 'owner'
+FROM "chatrooms"."rooms"
+WHERE "owner_id" IS NOT NULL
+ON CONFLICT DO NOTHING;
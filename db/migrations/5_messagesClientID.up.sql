@@ -0,0 +1,6 @@
+-- the id of a message is assigned by the server, client_id is the one given by the sender
+ALTER TABLE "chatrooms"."messages" ADD COLUMN IF NOT EXISTS "client_id" uuid;
+
+-- a message resent by its author is stored once
+CREATE UNIQUE INDEX IF NOT EXISTS "messages_user_id_client_id_idx"
+    ON "chatrooms"."messages" ("user_id", "client_id");
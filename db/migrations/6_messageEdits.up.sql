@@ -0,0 +1,26 @@
+-- set when the body of a message is edited
+ALTER TABLE "chatrooms"."messages" ADD COLUMN IF NOT EXISTS "edited_at" timestamp with time zone;
+
+-- previous bodies of the edited and deleted messages, kept for moderation
+CREATE TABLE IF NOT EXISTS "chatrooms"."message_edits"
+(
+    "id"            uuid default uuid_generate_v4(),
+    "message_id"    uuid not null,
+    "editor_id"     uuid not null,
+    "action"        varchar(16) not null,
+    "previous_body" varchar(256) not null,
+    "created_at"    timestamp with time zone default now(),
+    PRIMARY KEY ("id"),
+    CONSTRAINT action_check CHECK (action IN ('edit', 'delete')),
+    CONSTRAINT fk_message
+        FOREIGN KEY("message_id")
+            REFERENCES "chatrooms"."messages"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_editor
+        FOREIGN KEY("editor_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS "message_edits_message_id_idx"
+    ON "chatrooms"."message_edits" ("message_id", "created_at");
@@ -0,0 +1,17 @@
+-- reactions of the users to messages, each emoji once per user and message
+CREATE TABLE IF NOT EXISTS "chatrooms"."message_reactions"
+(
+    "message_id" uuid not null,
+    "user_id"    uuid not null,
+    "emoji"      varchar(32) not null,
+    "created_at" timestamp with time zone default now(),
+    PRIMARY KEY ("message_id", "user_id", "emoji"),
+    CONSTRAINT fk_message
+        FOREIGN KEY("message_id")
+            REFERENCES "chatrooms"."messages"("id")
+            ON DELETE CASCADE,
+    CONSTRAINT fk_user
+        FOREIGN KEY("user_id")
+            REFERENCES "chatrooms"."users"("id")
+            ON DELETE CASCADE
+);
@@ -0,0 +1,8 @@
+-- a reply references the first message of its thread
+ALTER TABLE "chatrooms"."messages" ADD COLUMN IF NOT EXISTS "parent_id" uuid
+    REFERENCES "chatrooms"."messages"("id") ON DELETE CASCADE;
+
+-- threads are read oldest first, and counted per parent
+CREATE INDEX IF NOT EXISTS "messages_parent_id_created_at_id_idx"
+    ON "chatrooms"."messages" ("parent_id", "created_at", "id")
+    WHERE "parent_id" IS NOT NULL;
@@ -0,0 +1,19 @@
+-- a direct conversation is a room only its participants see, without owner
+ALTER TABLE "chatrooms"."rooms" DROP CONSTRAINT IF EXISTS visibility_check;
+ALTER TABLE "chatrooms"."rooms" ADD CONSTRAINT visibility_check CHECK (visibility IN ('public', 'private', 'direct'));
+
+-- one direct conversation per set of participants, keyed by their sorted ids
+CREATE TABLE IF NOT EXISTS "chatrooms"."direct_conversations"
+(
+    "room_id"          varchar(50) not null,
+    "participants_key" text not null,
+    "created_at"       timestamp with time zone default now(),
+    PRIMARY KEY ("room_id"),
+    CONSTRAINT fk_room
+        FOREIGN KEY("room_id")
+            REFERENCES "chatrooms"."rooms"("id")
+            ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "direct_conversations_participants_key_idx"
+    ON "chatrooms"."direct_conversations" ("participants_key");
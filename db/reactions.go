@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type Reaction struct {
+	MessageID uuid.UUID `gorm:"column:message_id;type:uuid;primaryKey"`
+	UserID    uuid.UUID `gorm:"column:user_id;type:uuid;primaryKey"`
+	Emoji     string    `gorm:"column:emoji;primaryKey"`
+	CreatedAt time.Time
+}
+
+// TableName returns the table name associated to ReactionsDB.
+func (*Reaction) TableName() string {
+	return "chatrooms.message_reactions"
+}
+
+// ReactionCount is the number of users who reacted to a message with an emoji.
+type ReactionCount struct {
+	MessageID uuid.UUID
+	Emoji     string
+	Count     int
+}
+
+type ReactionsDB struct {
+	conn *gorm.DB
+}
+
+func NewReactionsDB(conn *gorm.DB) *ReactionsDB {
+	return &ReactionsDB{conn: conn}
+}
+
+// Add stores the reaction and reports false when the user already reacted with the emoji.
+func (db *ReactionsDB) Add(reaction Reaction) (bool, error) {
+	result := db.conn.WithContext(context.TODO()).Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction)
+	return result.RowsAffected > 0, result.Error
+}
+
+// Remove deletes the reaction and reports false when there was none.
+func (db *ReactionsDB) Remove(reaction Reaction) (bool, error) {
+	result := db.conn.WithContext(context.TODO()).
+		Where("message_id = ? AND user_id = ? AND emoji = ?", reaction.MessageID, reaction.UserID, reaction.Emoji).
+		Delete(&Reaction{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// CountByMessages returns the reaction counts of the messages, by message and emoji, the first used first.
+func (db *ReactionsDB) CountByMessages(messageIDs []uuid.UUID) (counts []ReactionCount, err error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+	err = db.conn.WithContext(context.TODO()).Model(&Reaction{}).
+		Select("message_id, emoji, count(*) AS count").
+		Where("message_id IN ?", messageIDs).
+		Group("message_id, emoji").
+		Order("min(created_at)").
+		Find(&counts).Error
+	return
+}
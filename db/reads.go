@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ReadMarker struct {
+	UserID    uuid.UUID `gorm:"column:user_id;type:uuid;primaryKey"`
+	RoomID    string    `gorm:"column:room_id;primaryKey"`
+	MessageID uuid.UUID `gorm:"column:message_id;type:uuid"`
+	// LastReadAt is the creation time of the message read last.
+	LastReadAt time.Time
+	UpdatedAt  time.Time
+}
+
+// TableName returns the table name associated to ReadMarkersDB.
+func (*ReadMarker) TableName() string {
+	return "chatrooms.read_markers"
+}
+
+// UnreadCount is the number of messages of a room a user has not read.
+type UnreadCount struct {
+	RoomID string
+	Count  int64
+}
+
+type ReadMarkersDB struct {
+	conn *gorm.DB
+}
+
+func NewReadMarkersDB(conn *gorm.DB) *ReadMarkersDB {
+	return &ReadMarkersDB{conn: conn}
+}
+
+// Advance moves the read marker of the user in the room up to the message, never back, and reports
+// whether it moved. The marker returned is the one stored afterwards; its room ID is empty when the
+// message is not one of the room.
+func (db *ReadMarkersDB) Advance(userID uuid.UUID, roomID string, messageID uuid.UUID) (marker ReadMarker, moved bool, err error) {
+	err = db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		var message Message
+		if err := tx.Where("id = ? AND chatroom = ?", messageID, roomID).Find(&message).Error; err != nil || message.ID == uuid.Nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "room_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"message_id", "last_read_at", "updated_at"}),
+			Where: clause.Where{Exprs: []clause.Expression{
+				clause.Expr{SQL: "(read_markers.last_read_at, read_markers.message_id) < (excluded.last_read_at, excluded.message_id)"},
+			}},
+		}).Create(&ReadMarker{UserID: userID, RoomID: roomID, MessageID: message.ID, LastReadAt: message.CreatedAt})
+		if result.Error != nil {
+			return result.Error
+		}
+		moved = result.RowsAffected > 0
+		return tx.Where("user_id = ? AND room_id = ?", userID, roomID).Find(&marker).Error
+	})
+	return
+}
+
+// ListByUser returns the read markers of the user in every room.
+func (db *ReadMarkersDB) ListByUser(userID uuid.UUID) (markers []ReadMarker, err error) {
+	err = db.conn.WithContext(context.TODO()).Where("user_id = ?", userID).Find(&markers).Error
+	return
+}
+
+// CountUnread counts the messages of the rooms the user has not read, leaving out their own messages.
+// The rooms without unread messages are left out.
+func (db *ReadMarkersDB) CountUnread(userID uuid.UUID, roomIDs []string) (counts []UnreadCount, err error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	err = db.conn.WithContext(context.TODO()).
+		Table("chatrooms.messages AS m").
+		Select("m.chatroom AS room_id, count(*) AS count").
+		Joins("LEFT JOIN chatrooms.read_markers AS rm ON rm.room_id = m.chatroom AND rm.user_id = ?", userID).
+		Where("m.chatroom IN ? AND m.deleted_at IS NULL AND m.user_id <> ?", roomIDs, userID).
+		Where("rm.user_id IS NULL OR (m.created_at, m.id) > (rm.last_read_at, rm.message_id)").
+		Group("m.chatroom").
+		Find(&counts).Error
+	return
+}
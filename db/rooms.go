@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+	// VisibilityDirect is the visibility of the rooms of the direct conversations.
+	VisibilityDirect = "direct"
+)
+
+// errDirectExists rolls back a direct conversation opened concurrently with the same participants.
+var errDirectExists = errors.New("direct conversation exists")
+
+type Room struct {
+	ID         string `gorm:"column:id;primaryKey"`
+	OwnerID    *uuid.UUID
+	Title      string
+	Topic      string
+	Visibility string
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// TableName returns the table name associated to RoomsDB.
+func (*Room) TableName() string {
+	return "chatrooms.rooms"
+}
+
+// DirectConversation keys the room of a direct conversation by its participants.
+type DirectConversation struct {
+	RoomID          string `gorm:"column:room_id;primaryKey"`
+	ParticipantsKey string
+	CreatedAt       time.Time
+}
+
+// TableName returns the table name associated to direct conversations.
+func (*DirectConversation) TableName() string {
+	return "chatrooms.direct_conversations"
+}
+
+type RoomsDB struct {
+	conn *gorm.DB
+}
+
+func NewRoomsDB(conn *gorm.DB) *RoomsDB {
+	return &RoomsDB{conn: conn}
+}
+
+// Create stores the room and makes its owner the first member.
+func (db *RoomsDB) Create(room Room) (string, error) {
+	err := db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&room).Error; err != nil {
+			return err
+		}
+		if room.OwnerID == nil {
+			return nil
+		}
+		return tx.Create(&RoomMember{RoomID: room.ID, UserID: *room.OwnerID, Role: RoleOwner}).Error
+	})
+
+	return room.ID, err
+}
+
+func (db *RoomsDB) GetByID(id string) (room Room, err error) {
+	err = db.conn.WithContext(context.TODO()).Where("id = ?", id).Find(&room).Error
+	return
+}
+
+// ListVisible returns the public rooms plus the private rooms the user is a member of, direct
+// conversations aside.
+func (db *RoomsDB) ListVisible(userID uuid.UUID) (rooms []Room, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Where("visibility = ? OR id IN (SELECT room_id FROM chatrooms.room_members WHERE user_id = ?)", VisibilityPublic, userID).
+		Where("visibility <> ?", VisibilityDirect).
+		Order("id").
+		Find(&rooms).Error
+	return
+}
+
+// Update sets the given columns of the room.
+func (db *RoomsDB) Update(id string, fields map[string]interface{}) error {
+	return db.conn.WithContext(context.TODO()).Model(&Room{}).Where("id = ?", id).Updates(fields).Error
+}
+
+func (db *RoomsDB) Delete(id string) error {
+	return db.conn.WithContext(context.TODO()).Where("id = ?", id).Delete(&Room{}).Error
+}
+
+// GetDirect returns the room of the direct conversation between the participants, the ID is empty
+// when there is none.
+func (db *RoomsDB) GetDirect(participantsKey string) (room Room, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Where("id = (SELECT room_id FROM chatrooms.direct_conversations WHERE participants_key = ?)", participantsKey).
+		Find(&room).Error
+	return
+}
+
+// CreateDirect stores the room of a direct conversation with its participants as members. It reports
+// false, storing nothing, when the participants already have a conversation.
+func (db *RoomsDB) CreateDirect(room Room, participantsKey string, participants []uuid.UUID) (created bool, err error) {
+	err = db.conn.WithContext(context.TODO()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&room).Error; err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&DirectConversation{RoomID: room.ID, ParticipantsKey: participantsKey})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errDirectExists
+		}
+		for _, userID := range participants {
+			if err := tx.Create(&RoomMember{RoomID: room.ID, UserID: userID, Role: RoleMember}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errors.Is(err, errDirectExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListDirect returns the rooms of the direct conversations of the user, the latest first.
+func (db *RoomsDB) ListDirect(userID uuid.UUID) (rooms []Room, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Where("visibility = ? AND id IN (SELECT room_id FROM chatrooms.room_members WHERE user_id = ?)", VisibilityDirect, userID).
+		Order("created_at DESC").
+		Find(&rooms).Error
+	return
+}
+
+// ListJoined returns the rooms the user is a member of, along with the public rooms they read, by ID.
+func (db *RoomsDB) ListJoined(userID uuid.UUID) (rooms []Room, err error) {
+	err = db.conn.WithContext(context.TODO()).
+		Where("id IN (SELECT room_id FROM chatrooms.room_members WHERE user_id = ?)", userID).
+		Or("visibility = ? AND id IN (SELECT room_id FROM chatrooms.read_markers WHERE user_id = ?)", VisibilityPublic, userID).
+		Order("id").
+		Find(&rooms).Error
+	return
+}
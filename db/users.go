@@ -48,3 +48,8 @@ func (db *UsersDB) GetByNickName(nickname string) (user User, err error) {
 	err = db.conn.WithContext(context.TODO()).Where("nickname = ?", nickname).Find(&user).Error
 	return
 }
+
+func (db *UsersDB) GetByID(id uuid.UUID) (user User, err error) {
+	err = db.conn.WithContext(context.TODO()).Where("id = ?", id).Find(&user).Error
+	return
+}
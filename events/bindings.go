@@ -0,0 +1,81 @@
+package events
+
+import "sync"
+
+type (
+	// boundKeys holds the keys a subscription wants bound, and tells when the broker caught up with them.
+	boundKeys struct {
+		mu   sync.Mutex
+		keys map[string]bool
+		// version counts the changes of keys, applied is the last version bound on the broker
+		version uint64
+		applied uint64
+		waiters []keysWaiter
+	}
+
+	keysWaiter struct {
+		version uint64
+		done    chan struct{}
+	}
+)
+
+func newBoundKeys() *boundKeys {
+	return &boundKeys{keys: make(map[string]bool)}
+}
+
+func (k *boundKeys) add(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key] = true
+	k.version++
+}
+
+func (k *boundKeys) remove(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, key)
+	k.version++
+}
+
+// wanted returns a copy of the keys with their version.
+func (k *boundKeys) wanted() (map[string]bool, uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make(map[string]bool, len(k.keys))
+	for key := range k.keys {
+		keys[key] = true
+	}
+	return keys, k.version
+}
+
+// apply records that the keys of the version are bound on the broker.
+func (k *boundKeys) apply(version uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if version <= k.applied {
+		return
+	}
+	k.applied = version
+	waiting := k.waiters[:0]
+	for _, w := range k.waiters {
+		if w.version <= version {
+			close(w.done)
+		} else {
+			waiting = append(waiting, w)
+		}
+	}
+	k.waiters = waiting
+}
+
+// synced returns a channel closed once the keys bound so far are bound on the broker.
+func (k *boundKeys) synced() <-chan struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	done := make(chan struct{})
+	if k.version <= k.applied {
+		close(done)
+		return done
+	}
+	k.waiters = append(k.waiters, keysWaiter{version: k.version, done: done})
+	return done
+}
@@ -0,0 +1,112 @@
+package events
+
+import "time"
+
+var (
+	_ Broker = (*QueueClient)(nil)
+	_ Broker = (*MemoryBroker)(nil)
+	_ Broker = (*RedisBroker)(nil)
+)
+
+type (
+	// Broker moves messages between the instances without tying the callers to a transport.
+	// Work queues deliver every message to a single consumer, at least once; events are
+	// fanned out to every instance subscribed to their key, at most once.
+	Broker interface {
+		// Publish sends a message to the work queue.
+		Publish(queue string, body []byte) error
+		// Consume calls handle for every message of the work queue until the broker is closed.
+		// The handler settles each message with Ack, Retry or Reject.
+		Consume(queue string, handle Handler) error
+		// PublishEvent sends an event to the subscriptions of the exchange bound to the key.
+		PublishEvent(exchange, key string, body []byte) error
+		// Subscribe calls handle for the events of the exchange whose key is bound on the subscription.
+		Subscribe(exchange string, handle Handler) (Subscription, error)
+		// DeadLetters returns up to limit messages of the queue that exhausted their retries.
+		DeadLetters(queue string, limit int) ([]DeadLetter, error)
+		// Replay moves up to limit dead-lettered messages back to the queue.
+		Replay(queue string, limit int) (int, error)
+		Close()
+	}
+
+	// Subscription selects the event keys received. Bind and Unbind do not block.
+	Subscription interface {
+		Bind(key string)
+		Unbind(key string)
+		// Synced returns a channel closed once the keys bound so far are bound on the broker.
+		Synced() <-chan struct{}
+	}
+
+	Handler func(msg Message)
+
+	// Message is a work item or an event received from a Broker.
+	Message struct {
+		Topic string
+		Body  []byte
+		// Retries is the number of times the message was handed to Retry before.
+		Retries int
+		settler settler
+	}
+
+	// settler acknowledges a message on the broker it came from.
+	settler interface {
+		ack() error
+		retry(cause error) error
+		reject() error
+	}
+
+	// RetryPolicy bounds how failed work items are retried before being dead-lettered.
+	RetryPolicy struct {
+		// MaxRetries is the number of times a failed message is retried before it is dead-lettered.
+		MaxRetries int
+		// RetryDelay is multiplied by the attempt number to delay every retry.
+		RetryDelay time.Duration
+	}
+
+	// DeadLetter is a message that exhausted its retries.
+	DeadLetter struct {
+		Queue     string
+		Body      []byte
+		Retries   int
+		LastError string
+		Timestamp time.Time
+	}
+)
+
+// DefaultRetryPolicy returns the retry settings used when nothing else is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: defaultMaxRetries,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// delay returns how long to wait before the next attempt of a message retried retries times.
+func (p RetryPolicy) delay(retries int) time.Duration {
+	return p.RetryDelay * time.Duration(retries+1)
+}
+
+// Ack confirms the message was handled.
+func (m Message) Ack() error {
+	if m.settler == nil {
+		return nil
+	}
+	return m.settler.ack()
+}
+
+// Retry schedules the message to be handled again after a delay, or dead-letters it
+// once it has been retried MaxRetries times.
+func (m Message) Retry(cause error) error {
+	if m.settler == nil {
+		return nil
+	}
+	return m.settler.retry(cause)
+}
+
+// Reject sends a message that can never be handled straight to the dead letters.
+func (m Message) Reject() error {
+	if m.settler == nil {
+		return nil
+	}
+	return m.settler.reject()
+}
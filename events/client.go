@@ -2,98 +2,384 @@ package events
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	"github.com/google/uuid"
 	rabbit "github.com/rabbitmq/amqp091-go"
 	"github.com/rs/zerolog/log"
 )
 
-var channel *rabbit.Channel
+const (
+	defaultMinBackoff = 500 * time.Millisecond
+	defaultMaxBackoff = 30 * time.Second
+	defaultMaxRetries = 3
+	defaultRetryDelay = 5 * time.Second
+	defaultPrefetch   = 20
+)
 
-type EventMetadata struct {
-	ID      uuid.UUID
-	From    string
-	Source  string
-	Channel string
-	Subject []byte
-}
+var (
+	errNotConnected = errors.New("not connected to the broker")
+	errClientClosed = errors.New("queue client closed")
+)
 
 type (
+	// topology is what has to be declared on a channel before publishing somewhere.
+	topology struct {
+		name    string
+		declare func(ch amqpChannel) error
+	}
+
+	// QueueClient is the RabbitMQ Broker. It keeps a long-lived broker connection with one
+	// publisher channel and one channel per consumer, reconnecting with backoff when the broker drops.
 	QueueClient struct {
 		serviceName string
-		conn        *rabbit.Connection
+		dial        Dialer
+		MinBackoff  time.Duration
+		MaxBackoff  time.Duration
+		RetryPolicy
+		Prefetch int
+
+		mu       sync.Mutex
+		conn     amqpConnection
+		pubCh    amqpChannel
+		declared map[string]bool
+		// connected is closed once a connection is available and replaced when it drops
+		connected chan struct{}
+
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
 	}
 )
 
-func NewQueueClient(serviceName string, conn *rabbit.Connection) *QueueClient {
+func NewQueueClient(serviceName string, dial Dialer) *QueueClient {
 	return &QueueClient{
 		serviceName: serviceName,
-		conn:        conn,
+		dial:        dial,
+		MinBackoff:  defaultMinBackoff,
+		MaxBackoff:  defaultMaxBackoff,
+		RetryPolicy: DefaultRetryPolicy(),
+		Prefetch:    defaultPrefetch,
+		connected:   make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 }
 
-func (qc *QueueClient) connect(queueName string) *rabbit.Channel {
-	// create a channel
-	ch, err := qc.conn.Channel()
-	failOnError(err, "Failed to open a channel")
+// Connect opens the first connection and starts watching it.
+func (qc *QueueClient) Connect() error {
+	conn, err := qc.dial()
+	if err != nil {
+		return err
+	}
+	qc.setConnection(conn)
 
-	_, err = ch.QueueDeclare(
-		queueName, // name
-		false,     // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	channel = ch
-	return ch
+	qc.wg.Add(1)
+	go qc.watch(conn)
+	return nil
 }
 
-func (qc *QueueClient) CloseConnection() {
-	defer channel.Close()
-	log.Info().Msg("closing rabbit connection")
+// Close stops the consumers and closes the channels and the connection.
+func (qc *QueueClient) Close() {
+	qc.closeOnce.Do(func() {
+		log.Info().Msg("closing rabbit connection")
+		close(qc.done)
+
+		qc.mu.Lock()
+		if qc.pubCh != nil {
+			qc.pubCh.Close()
+			qc.pubCh = nil
+		}
+		if qc.conn != nil {
+			qc.conn.Close()
+			qc.conn = nil
+		}
+		qc.mu.Unlock()
+
+		qc.wg.Wait()
+	})
 }
 
+// Publish sends a persistent message to the queue.
 func (qc *QueueClient) Publish(channelName string, body []byte) error {
-	ch := qc.connect(channelName)
+	err := qc.publish(qc.queueTopology(channelName), "", channelName, rabbit.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: rabbit.Persistent,
+		Timestamp:    time.Now(),
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Msg(fmt.Sprintf(" [x]-> Publisher: %s - Channel: %s - Body %s\n", qc.serviceName, channelName, string(body)))
+	return nil
+}
 
-	err := ch.PublishWithContext(
+// publish sends the message once the topology it needs is declared on the publisher channel.
+func (qc *QueueClient) publish(t topology, exchange, routingKey string, msg rabbit.Publishing) error {
+	ch, err := qc.publisherChannel(t)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to open publisher channel")
+		return err
+	}
+
+	err = ch.PublishWithContext(
 		context.TODO(),
-		"",          // exchange
-		channelName, // routing key
-		false,       // mandatory
-		false,       // immediate
-		rabbit.Publishing{
-			ContentType: "text/plain",
-			Body:        body,
-		})
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		msg)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to publish msg")
+		qc.resetPublisher(ch)
 		return err
 	}
-	log.Info().Msg(fmt.Sprintf(" [x]-> Publisher: %s - Channel: %s - Body %s\n", qc.serviceName, channelName, string(body)))
 	return nil
 }
 
-func (qc *QueueClient) Consume(channelName string) (<-chan rabbit.Delivery, error) {
-	ch := qc.connect(channelName)
+// Consume calls handle for every delivery of the queue, one at a time. Deliveries left
+// unsettled when the channel drops are redelivered.
+func (qc *QueueClient) Consume(channelName string, handle Handler) error {
+	deliveries, err := qc.deliveries(channelName)
+	if err != nil {
+		return err
+	}
+
+	qc.wg.Add(1)
+	go func() {
+		defer qc.wg.Done()
+		for d := range deliveries {
+			handle(Message{
+				Topic:   channelName,
+				Body:    d.Body,
+				Retries: retryCount(d.Headers),
+				settler: rabbitDelivery{qc: qc, queue: channelName, d: d},
+			})
+		}
+	}()
+	return nil
+}
+
+// deliveries returns the deliveries of the queue. The returned channel survives reconnections
+// and is only closed by Close.
+func (qc *QueueClient) deliveries(channelName string) (<-chan rabbit.Delivery, error) {
+	select {
+	case <-qc.done:
+		return nil, errClientClosed
+	default:
+	}
+
+	out := make(chan rabbit.Delivery)
+	qc.wg.Add(1)
+	go qc.runConsumer(channelName, out)
+	log.Info().Msg(fmt.Sprintf(" <-[x] Consumer: %s - Channel: %s\n", qc.serviceName, channelName))
+	return out, nil
+}
+
+// runConsumer forwards deliveries to out, consuming again every time the channel drops.
+func (qc *QueueClient) runConsumer(channelName string, out chan<- rabbit.Delivery) {
+	defer qc.wg.Done()
+	defer close(out)
+
+	for attempt := 0; ; attempt++ {
+		ch, deliveries, err := qc.startConsumer(channelName)
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to consume from %s", channelName)
+			if !qc.sleep(qc.backoff(attempt)) {
+				return
+			}
+			continue
+		}
+		attempt = 0
+
+		for d := range deliveries {
+			select {
+			case out <- d:
+			case <-qc.done:
+				ch.Close()
+				return
+			}
+		}
+		ch.Close()
 
-	msgs, err := ch.Consume(
+		select {
+		case <-qc.done:
+			return
+		default:
+			log.Warn().Msgf("consumer channel for %s closed, consuming again", channelName)
+		}
+	}
+}
+
+func (qc *QueueClient) startConsumer(channelName string) (amqpChannel, <-chan rabbit.Delivery, error) {
+	conn, err := qc.waitConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := qc.declareTopology(ch, channelName); err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	if err := ch.Qos(qc.Prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+
+	deliveries, err := ch.Consume(
 		channelName, // queue
 		"",          // consumer
-		true,        // auto-ack
+		false,       // auto-ack
 		false,       // exclusive
 		false,       // no-local
 		false,       // no-wait
 		nil,         // args
 	)
-	log.Info().Msg(fmt.Sprintf(" <-[x] Consumer: %s - Channel: %s\n", qc.serviceName, channelName))
-	return msgs, err
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+	return ch, deliveries, nil
 }
 
-func failOnError(err error, msg string) {
-	if err != nil {
-		log.Panic().Err(err).Msg(msg)
+// publisherChannel returns the shared publisher channel, declaring the topology the first time it is used.
+func (qc *QueueClient) publisherChannel(t topology) (amqpChannel, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if qc.conn == nil {
+		return nil, errNotConnected
+	}
+	if qc.pubCh == nil {
+		ch, err := qc.conn.Channel()
+		if err != nil {
+			return nil, err
+		}
+		qc.pubCh = ch
+		qc.declared = make(map[string]bool)
+	}
+	if !qc.declared[t.name] {
+		if err := t.declare(qc.pubCh); err != nil {
+			return nil, err
+		}
+		qc.declared[t.name] = true
+	}
+	return qc.pubCh, nil
+}
+
+// resetPublisher drops a failed publisher channel so the next publish opens a new one.
+func (qc *QueueClient) resetPublisher(ch amqpChannel) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.pubCh == ch {
+		qc.pubCh.Close()
+		qc.pubCh = nil
+	}
+}
+
+// watch waits for the connection to drop and reconnects with backoff until the client is closed.
+func (qc *QueueClient) watch(conn amqpConnection) {
+	defer qc.wg.Done()
+
+	for {
+		closed := conn.NotifyClose(make(chan *rabbit.Error, 1))
+		select {
+		case <-qc.done:
+			return
+		case err := <-closed:
+			log.Error().Msgf("rabbit connection closed: %v", err)
+		}
+		qc.clearConnection()
+
+		for attempt := 0; ; attempt++ {
+			if !qc.sleep(qc.backoff(attempt)) {
+				return
+			}
+			next, err := qc.dial()
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to reconnect to RabbitMQ, attempt %d", attempt+1)
+				continue
+			}
+			conn = next
+			break
+		}
+		select {
+		case <-qc.done:
+			conn.Close()
+			return
+		default:
+		}
+		qc.setConnection(conn)
+		log.Info().Msg("reconnected to RabbitMQ")
+	}
+}
+
+func (qc *QueueClient) setConnection(conn amqpConnection) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.conn = conn
+	close(qc.connected)
+}
+
+func (qc *QueueClient) clearConnection() {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	qc.conn = nil
+	qc.pubCh = nil
+	qc.connected = make(chan struct{})
+}
+
+// currentConnection returns the live connection without waiting for a reconnect.
+func (qc *QueueClient) currentConnection() (amqpConnection, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.conn == nil {
+		return nil, errNotConnected
+	}
+	return qc.conn, nil
+}
+
+// waitConnection blocks until a connection is available or the client is closed.
+func (qc *QueueClient) waitConnection() (amqpConnection, error) {
+	for {
+		qc.mu.Lock()
+		conn, connected := qc.conn, qc.connected
+		qc.mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-connected:
+		case <-qc.done:
+			return nil, errClientClosed
+		}
+	}
+}
+
+func (qc *QueueClient) backoff(attempt int) time.Duration {
+	delay := qc.MinBackoff
+	for i := 0; i < attempt && delay < qc.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > qc.MaxBackoff {
+		delay = qc.MaxBackoff
+	}
+	return delay
+}
+
+// sleep waits for the delay and reports false if the client was closed meanwhile.
+func (qc *QueueClient) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-qc.done:
+		return false
 	}
 }
@@ -0,0 +1,704 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	rabbit "github.com/rabbitmq/amqp091-go"
+)
+
+type (
+	// broker is an in-memory stand-in for RabbitMQ keeping one buffered channel per queue.
+	broker struct {
+		mu        sync.Mutex
+		queues    map[string]chan rabbit.Delivery
+		args      map[string]rabbit.Table
+		bindings  map[binding]bool
+		named     int
+		conns     []*connection
+		dials     int
+		failDials int
+	}
+
+	// binding routes the messages published to exchange with key to queue.
+	binding struct {
+		exchange, key, queue string
+	}
+
+	connection struct {
+		broker    *broker
+		mu        sync.Mutex
+		closed    bool
+		exclusive []string
+		notify    []chan *rabbit.Error
+		channels  []*channel
+	}
+
+	channel struct {
+		conn    *connection
+		closed  chan struct{}
+		once    sync.Once
+		mu      sync.Mutex
+		unacked map[*acker]bool
+	}
+
+	// acker settles a single delivery, routing rejected ones to the dead-letter queue.
+	acker struct {
+		ch       *channel
+		queue    string
+		delivery rabbit.Delivery
+	}
+)
+
+func NewBrokerMock() *broker {
+	return &broker{
+		queues:   make(map[string]chan rabbit.Delivery),
+		args:     make(map[string]rabbit.Table),
+		bindings: make(map[binding]bool),
+	}
+}
+
+func (b *broker) dial() (amqpConnection, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dials++
+	if b.failDials > 0 {
+		b.failDials--
+		return nil, errors.New("connection refused")
+	}
+	conn := &connection{broker: b}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+func (b *broker) queue(name string) chan rabbit.Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		q = make(chan rabbit.Delivery, 100)
+		b.queues[name] = q
+	}
+	return q
+}
+
+// drop simulates the broker going away, failing the next dials.
+func (b *broker) drop(failDials int) {
+	b.mu.Lock()
+	conns := b.conns
+	b.conns = nil
+	b.failDials = failDials
+	b.mu.Unlock()
+	for _, conn := range conns {
+		conn.shutdown(&rabbit.Error{Code: rabbit.ConnectionForced, Reason: "broker restarted"})
+	}
+}
+
+// route delivers the message to the bound queues, or to the queue named by the key on the
+// default exchange, expiring the messages sent to a retry queue right away.
+func (b *broker) route(exchange, key string, msg rabbit.Publishing) {
+	if exchange != "" {
+		b.mu.Lock()
+		var queues []string
+		for bind := range b.bindings {
+			if bind.exchange == exchange && bind.key == key {
+				queues = append(queues, bind.queue)
+			}
+		}
+		b.mu.Unlock()
+		for _, queue := range queues {
+			b.queue(queue) <- rabbit.Delivery{Exchange: exchange, RoutingKey: key, Body: msg.Body}
+		}
+		return
+	}
+
+	b.mu.Lock()
+	args := b.args[key]
+	b.mu.Unlock()
+	if next, ok := args["x-dead-letter-routing-key"].(string); ok && args["x-message-ttl"] != nil && args["x-dead-letter-exchange"] == "" {
+		key = next
+	}
+	b.queue(key) <- rabbit.Delivery{
+		RoutingKey:  key,
+		Headers:     msg.Headers,
+		ContentType: msg.ContentType,
+		Expiration:  msg.Expiration,
+		Body:        msg.Body,
+	}
+}
+
+func (b *broker) queueArgs(queue string) rabbit.Table {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.args[queue]
+}
+
+// deadLetter moves a rejected delivery to the queue bound to the dead-letter exchange.
+func (b *broker) deadLetter(queue string, d rabbit.Delivery) {
+	b.mu.Lock()
+	args := b.args[queue]
+	b.mu.Unlock()
+	if args["x-dead-letter-exchange"] != DeadLetterExchange {
+		return
+	}
+	d.Acknowledger = nil
+	b.queue(DeadLetterQueue(queue)) <- d
+}
+
+// deleteQueue drops an exclusive queue and its bindings.
+func (b *broker) deleteQueue(queue string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.queues, queue)
+	for bind := range b.bindings {
+		if bind.queue == queue {
+			delete(b.bindings, bind)
+		}
+	}
+}
+
+func (b *broker) bound(exchange, key string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for bind := range b.bindings {
+		if bind.exchange == exchange && bind.key == key {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *broker) size(queue string) int {
+	return len(b.queue(queue))
+}
+
+func (b *broker) dialCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dials
+}
+
+func (c *connection) Channel() (amqpChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, rabbit.ErrClosed
+	}
+	ch := &channel{conn: c, closed: make(chan struct{})}
+	c.channels = append(c.channels, ch)
+	return ch, nil
+}
+
+func (c *connection) NotifyClose(receiver chan *rabbit.Error) chan *rabbit.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(receiver)
+		return receiver
+	}
+	c.notify = append(c.notify, receiver)
+	return receiver
+}
+
+func (c *connection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *connection) shutdown(err *rabbit.Error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	notify, channels, exclusive := c.notify, c.channels, c.exclusive
+	c.mu.Unlock()
+
+	for _, ch := range channels {
+		ch.Close()
+	}
+	for _, queue := range exclusive {
+		c.broker.deleteQueue(queue)
+	}
+	for _, receiver := range notify {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+}
+
+func (ch *channel) ExchangeDeclare(string, string, bool, bool, bool, bool, rabbit.Table) error {
+	return nil
+}
+
+func (ch *channel) QueueDeclare(name string, _, _, exclusive, _ bool, args rabbit.Table) (rabbit.Queue, error) {
+	b := ch.conn.broker
+	b.mu.Lock()
+	if name == "" {
+		b.named++
+		name = fmt.Sprintf("amq.gen-%d", b.named)
+	}
+	b.args[name] = args
+	b.mu.Unlock()
+	b.queue(name)
+	if exclusive {
+		ch.conn.mu.Lock()
+		ch.conn.exclusive = append(ch.conn.exclusive, name)
+		ch.conn.mu.Unlock()
+	}
+	return rabbit.Queue{Name: name}, nil
+}
+
+func (ch *channel) QueueBind(queue, key, exchange string, _ bool, _ rabbit.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if exchange != DeadLetterExchange {
+		b.bindings[binding{exchange: exchange, key: key, queue: queue}] = true
+	}
+	return nil
+}
+
+func (ch *channel) QueueUnbind(queue, key, exchange string, _ rabbit.Table) error {
+	b := ch.conn.broker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bindings, binding{exchange: exchange, key: key, queue: queue})
+	return nil
+}
+
+func (ch *channel) Qos(int, int, bool) error { return nil }
+
+func (ch *channel) PublishWithContext(_ context.Context, exchange, key string, _, _ bool, msg rabbit.Publishing) error {
+	select {
+	case <-ch.closed:
+		return rabbit.ErrClosed
+	default:
+	}
+	ch.conn.broker.route(exchange, key, msg)
+	return nil
+}
+
+func (ch *channel) Get(queue string, _ bool) (rabbit.Delivery, bool, error) {
+	select {
+	case d := <-ch.conn.broker.queue(queue):
+		return ch.track(queue, d), true, nil
+	default:
+		return rabbit.Delivery{}, false, nil
+	}
+}
+
+// track keeps the delivery until it is settled, requeueing it if the channel closes first.
+func (ch *channel) track(queue string, d rabbit.Delivery) rabbit.Delivery {
+	a := &acker{ch: ch, queue: queue, delivery: d}
+	ch.mu.Lock()
+	if ch.unacked == nil {
+		ch.unacked = make(map[*acker]bool)
+	}
+	ch.unacked[a] = true
+	ch.mu.Unlock()
+	d.Acknowledger = a
+	return d
+}
+
+func (ch *channel) settle(a *acker) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.unacked[a] {
+		return false
+	}
+	delete(ch.unacked, a)
+	return true
+}
+
+func (ch *channel) Consume(queue, _ string, autoAck, _, _, _ bool, _ rabbit.Table) (<-chan rabbit.Delivery, error) {
+	q := ch.conn.broker.queue(queue)
+	out := make(chan rabbit.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case d := <-q:
+				if !autoAck {
+					d = ch.track(queue, d)
+				}
+				select {
+				case out <- d:
+				case <-ch.closed:
+					if autoAck || ch.settle(d.Acknowledger.(*acker)) {
+						q <- d
+					}
+					return
+				}
+			case <-ch.closed:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (ch *channel) Close() error {
+	ch.once.Do(func() {
+		close(ch.closed)
+		ch.mu.Lock()
+		pending := ch.unacked
+		ch.unacked = nil
+		ch.mu.Unlock()
+		for a := range pending {
+			d := a.delivery
+			d.Redelivered = true
+			ch.conn.broker.queue(a.queue) <- d
+		}
+	})
+	return nil
+}
+
+func (a *acker) Ack(uint64, bool) error {
+	if !a.ch.settle(a) {
+		return errors.New("delivery already settled")
+	}
+	return nil
+}
+
+func (a *acker) Nack(_ uint64, _ bool, requeue bool) error {
+	if !a.ch.settle(a) {
+		return errors.New("delivery already settled")
+	}
+	if requeue {
+		a.ch.conn.broker.queue(a.queue) <- a.delivery
+	} else {
+		a.ch.conn.broker.deadLetter(a.queue, a.delivery)
+	}
+	return nil
+}
+
+func (a *acker) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func newTestClient(b *broker) *QueueClient {
+	qc := NewQueueClient("test", b.dial)
+	qc.MinBackoff = time.Millisecond
+	qc.MaxBackoff = 10 * time.Millisecond
+	return qc
+}
+
+func receive(t *testing.T, msgs <-chan rabbit.Delivery) string {
+	t.Helper()
+	d := receiveDelivery(t, msgs)
+	d.Ack(false)
+	return string(d.Body)
+}
+
+func receiveDelivery(t *testing.T, msgs <-chan rabbit.Delivery) rabbit.Delivery {
+	t.Helper()
+	select {
+	case d, ok := <-msgs:
+		if !ok {
+			t.Fatal("deliveries closed")
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery received")
+	}
+	return rabbit.Delivery{}
+}
+
+// collect returns a handler forwarding the messages to the returned channel.
+func collect() (Handler, <-chan Message) {
+	msgs := make(chan Message, 100)
+	return func(msg Message) { msgs <- msg }, msgs
+}
+
+func receiveMessage(t *testing.T, msgs <-chan Message) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		if err := msg.Ack(); err != nil {
+			t.Errorf("Ack() error = %v", err)
+		}
+		return string(msg.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return ""
+}
+
+// publishEventually retries while the client is reconnecting.
+func publishEventually(t *testing.T, qc *QueueClient, queue, body string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for qc.Publish(queue, []byte(body)) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publish never succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueClient_PublishAndConsume(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	handle, msgs := collect()
+	if err := qc.Consume("chat-channel", handle); err != nil {
+		t.Fatalf("Consume() error = %v", err)
+	}
+	for _, body := range []string{"one", "two", "three"} {
+		if err := qc.Publish("chat-channel", []byte(body)); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+		if got := receiveMessage(t, msgs); got != body {
+			t.Errorf("received %q, want %q", got, body)
+		}
+	}
+	if got := b.dialCount(); got != 1 {
+		t.Errorf("dials = %d, want a single long-lived connection", got)
+	}
+}
+
+func TestQueueClient_ReconnectsAndResumesConsumers(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	msgs, _ := qc.deliveries("broadcast-channel")
+	publishEventually(t, qc, "broadcast-channel", "before")
+	if got := receive(t, msgs); got != "before" {
+		t.Errorf("received %q, want before", got)
+	}
+
+	b.drop(3)
+
+	publishEventually(t, qc, "broadcast-channel", "after")
+	if got := receive(t, msgs); got != "after" {
+		t.Errorf("received %q, want after", got)
+	}
+	if got := b.dialCount(); got < 5 {
+		t.Errorf("dials = %d, want the failed attempts to be retried", got)
+	}
+}
+
+func TestQueueClient_CloseStopsConsumers(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	msgs, _ := qc.deliveries("chat-channel")
+
+	qc.Close()
+
+	select {
+	case _, ok := <-msgs:
+		if ok {
+			t.Errorf("unexpected delivery after close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deliveries not closed after Close")
+	}
+	if err := qc.Publish("chat-channel", []byte("late")); err == nil {
+		t.Errorf("publish after close should fail")
+	}
+	if err := qc.Consume("chat-channel", func(Message) {}); err == nil {
+		t.Errorf("consume after close should fail")
+	}
+}
+
+func TestQueueClient_RetryThenDeadLetter(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	qc.MaxRetries = 2
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	msgs, _ := qc.deliveries("chat-channel")
+	if err := qc.Publish("chat-channel", []byte("poison")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	for attempt := 0; attempt <= qc.MaxRetries; attempt++ {
+		d := receiveDelivery(t, msgs)
+		if got := retryCount(d.Headers); got != attempt {
+			t.Errorf("attempt %d: retry count = %d", attempt, got)
+		}
+		if attempt > 0 {
+			want := (qc.RetryDelay * time.Duration(attempt)).Milliseconds()
+			if ttl := b.queueArgs(retryQueue("chat-channel", attempt))["x-message-ttl"]; ttl != want {
+				t.Errorf("attempt %d: retry queue ttl = %v, want %d", attempt, ttl, want)
+			}
+		}
+		if err := (rabbitDelivery{qc: qc, queue: "chat-channel", d: d}).retry(errors.New("db down")); err != nil {
+			t.Fatalf("Retry() error = %v", err)
+		}
+	}
+
+	waitUntil(t, func() bool { return b.size(DeadLetterQueue("chat-channel")) == 1 })
+	letters, err := qc.DeadLetters("chat-channel", 10)
+	if err != nil {
+		t.Fatalf("DeadLetters() error = %v", err)
+	}
+	if len(letters) != 1 || string(letters[0].Body) != "poison" || letters[0].Retries != 2 || letters[0].LastError != "db down" {
+		t.Errorf("DeadLetters() = %+v", letters)
+	}
+	if got := b.size(DeadLetterQueue("chat-channel")); got != 1 {
+		t.Errorf("inspecting dead letters should leave them in place, %d left", got)
+	}
+
+	replayed, err := qc.Replay("chat-channel", 10)
+	if err != nil || replayed != 1 {
+		t.Fatalf("Replay() = %d, %v", replayed, err)
+	}
+	d := receiveDelivery(t, msgs)
+	if string(d.Body) != "poison" || retryCount(d.Headers) != 0 {
+		t.Errorf("replayed delivery = %q with %d retries", d.Body, retryCount(d.Headers))
+	}
+	d.Ack(false)
+}
+
+func TestQueueClient_UnackedAreRedelivered(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	msgs, _ := qc.deliveries("chat-channel")
+	publishEventually(t, qc, "chat-channel", "pending")
+	receiveDelivery(t, msgs)
+
+	b.drop(0)
+
+	d := receiveDelivery(t, msgs)
+	if string(d.Body) != "pending" || !d.Redelivered {
+		t.Errorf("got %q redelivered=%v, want the unacked message again", d.Body, d.Redelivered)
+	}
+	d.Ack(false)
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before deadline")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueClient_SubscriptionsFanOutPerInstance(t *testing.T) {
+	b := NewBrokerMock()
+	var (
+		subs     []Subscription
+		received []<-chan Message
+	)
+	for i := 0; i < 2; i++ {
+		qc := newTestClient(b)
+		if err := qc.Connect(); err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		defer qc.Close()
+		handle, events := collect()
+		sub, err := qc.Subscribe("chat-events", handle)
+		if err != nil {
+			t.Fatalf("Subscribe() error = %v", err)
+		}
+		sub.Bind("tech")
+		subs = append(subs, sub)
+		received = append(received, events)
+	}
+	waitUntil(t, func() bool { return b.bound("chat-events", "tech") == 2 })
+
+	publisher := newTestClient(b)
+	publisher.Connect()
+	defer publisher.Close()
+
+	if err := publisher.PublishEvent("chat-events", "music", []byte("unbound")); err != nil {
+		t.Fatalf("PublishEvent() error = %v", err)
+	}
+	if err := publisher.PublishEvent("chat-events", "tech", []byte("hello")); err != nil {
+		t.Fatalf("PublishEvent() error = %v", err)
+	}
+	for i, events := range received {
+		if got := receiveMessage(t, events); got != "hello" {
+			t.Errorf("instance %d received %q, want every instance to get hello", i, got)
+		}
+	}
+
+	subs[0].Unbind("tech")
+	waitUntil(t, func() bool { return b.bound("chat-events", "tech") == 1 })
+}
+
+func TestQueueClient_SubscriptionRebindsAfterReconnect(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	handle, events := collect()
+	sub, _ := qc.Subscribe("chat-events", handle)
+	sub.Bind("tech")
+	waitUntil(t, func() bool { return b.bound("chat-events", "tech") == 1 })
+
+	b.drop(2)
+	waitUntil(t, func() bool { return b.bound("chat-events", "tech") == 1 && b.dialCount() >= 4 })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for qc.PublishEvent("chat-events", "tech", []byte("after")) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("publish never succeeded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := receiveMessage(t, events); got != "after" {
+		t.Errorf("received %q, want after", got)
+	}
+}
+
+func TestQueueClient_SyncedOnceBound(t *testing.T) {
+	b := NewBrokerMock()
+	qc := newTestClient(b)
+	if err := qc.Connect(); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer qc.Close()
+
+	handle, events := collect()
+	sub, _ := qc.Subscribe("chat-events", handle)
+	sub.Bind("tech")
+	select {
+	case <-sub.Synced():
+	case <-time.After(5 * time.Second):
+		t.Fatal("binding never synced")
+	}
+	if bound := b.bound("chat-events", "tech"); bound != 1 {
+		t.Fatalf("synced with %d bindings, want the key bound", bound)
+	}
+
+	// the first event published once synced is received
+	qc.PublishEvent("chat-events", "tech", []byte("first"))
+	if got := receiveMessage(t, events); got != "first" {
+		t.Errorf("received %q, want first", got)
+	}
+}
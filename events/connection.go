@@ -0,0 +1,51 @@
+package events
+
+import (
+	"context"
+
+	rabbit "github.com/rabbitmq/amqp091-go"
+)
+
+type (
+	// Dialer opens a new broker connection, it is called again on every reconnect.
+	Dialer func() (amqpConnection, error)
+
+	// amqpConnection is the part of *rabbit.Connection used by the QueueClient.
+	amqpConnection interface {
+		Channel() (amqpChannel, error)
+		NotifyClose(receiver chan *rabbit.Error) chan *rabbit.Error
+		Close() error
+	}
+
+	// amqpChannel is the part of *rabbit.Channel used by the QueueClient.
+	amqpChannel interface {
+		ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args rabbit.Table) error
+		QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args rabbit.Table) (rabbit.Queue, error)
+		QueueBind(name, key, exchange string, noWait bool, args rabbit.Table) error
+		QueueUnbind(name, key, exchange string, args rabbit.Table) error
+		Qos(prefetchCount, prefetchSize int, global bool) error
+		PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg rabbit.Publishing) error
+		Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args rabbit.Table) (<-chan rabbit.Delivery, error)
+		Get(queue string, autoAck bool) (rabbit.Delivery, bool, error)
+		Close() error
+	}
+
+	rabbitConnection struct {
+		*rabbit.Connection
+	}
+)
+
+// Dial returns a Dialer connecting to the RabbitMQ server at url.
+func Dial(url string) Dialer {
+	return func() (amqpConnection, error) {
+		conn, err := rabbit.Dial(url)
+		if err != nil {
+			return nil, err
+		}
+		return rabbitConnection{conn}, nil
+	}
+}
+
+func (c rabbitConnection) Channel() (amqpChannel, error) {
+	return c.Connection.Channel()
+}
@@ -0,0 +1,102 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SchemaVersion is the version of the envelope written by this build.
+const SchemaVersion = 1
+
+// Event types
+const (
+	TypeMessageCreated   = "message.created"
+	TypeMessagePersisted = "message.persisted"
+	TypeMessageReceipt   = "message.receipt"
+	TypeMessageEdited    = "message.edited"
+	TypeMessageDeleted   = "message.deleted"
+	TypeReactionAdded    = "reaction.added"
+	TypeReactionRemoved  = "reaction.removed"
+	TypeThreadReplied    = "thread.replied"
+	TypeMentioned        = "mention.created"
+	TypeReadMarkerMoved  = "read_marker.moved"
+	TypeRoomEvicted      = "room.evicted"
+	TypePresenceJoined   = "presence.joined"
+	TypePresenceLeft     = "presence.left"
+	TypeTypingStarted    = "typing.started"
+	TypeTypingStopped    = "typing.stopped"
+	TypeBotReply         = "bot.reply"
+)
+
+var (
+	ErrMissingType        = errors.New("event without type")
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+)
+
+type (
+	// EventMetadata describes an event independently of its payload.
+	EventMetadata struct {
+		ID   uuid.UUID `json:"id"`
+		Type string    `json:"type"`
+		// Source is the component that published the event.
+		Source string `json:"source"`
+		// CorrelationID is the ID of the event that caused this one, if any.
+		CorrelationID string    `json:"correlation_id,omitempty"`
+		Timestamp     time.Time `json:"timestamp"`
+		Version       int       `json:"version"`
+	}
+
+	// Envelope wraps every message sent through a Broker, so consumers can dispatch by
+	// type and deduplicate by ID.
+	Envelope struct {
+		EventMetadata
+		Payload json.RawMessage `json:"payload"`
+	}
+)
+
+// NewEnvelope wraps the payload in a new event of the given type.
+func NewEnvelope(eventType, source string, payload interface{}) (Envelope, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		EventMetadata: EventMetadata{
+			ID:        uuid.New(),
+			Type:      eventType,
+			Source:    source,
+			Timestamp: time.Now().UTC(),
+			Version:   SchemaVersion,
+		},
+		Payload: body,
+	}, nil
+}
+
+// Encode returns the envelope as sent on the wire.
+func (e Envelope) Encode() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// Decode reads an envelope, rejecting the ones written by a newer schema.
+func Decode(body []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(body, &e); err != nil {
+		return Envelope{}, err
+	}
+	if e.Type == "" {
+		return Envelope{}, ErrMissingType
+	}
+	if e.Version < 1 || e.Version > SchemaVersion {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, e.Version)
+	}
+	return e, nil
+}
+
+// DecodePayload unmarshals the payload into v.
+func (e Envelope) DecodePayload(v interface{}) error {
+	return json.Unmarshal(e.Payload, v)
+}
@@ -0,0 +1,55 @@
+package events
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	valid, _ := NewEnvelope(TypeMessageCreated, "chatrooms", map[string]string{"text": "hi"})
+	validBody, _ := valid.Encode()
+
+	tests := []struct {
+		name    string
+		body    []byte
+		wantErr error
+	}{
+		{
+			name: "Decode - Valid envelope",
+			body: validBody,
+		},
+		{
+			name:    "Decode - Missing type",
+			body:    []byte(`{"id":"7a6a1c6e-3c1b-4b7e-9b1a-0a8f1f2b7c11","version":1,"payload":{}}`),
+			wantErr: ErrMissingType,
+		},
+		{
+			name:    "Decode - Newer version",
+			body:    []byte(`{"id":"7a6a1c6e-3c1b-4b7e-9b1a-0a8f1f2b7c11","type":"message.created","version":2,"payload":{}}`),
+			wantErr: ErrUnsupportedVersion,
+		},
+		{
+			name:    "Decode - Raw chat message",
+			body:    []byte(`{"username":"any_nickname","text":"hi","room":"random"}`),
+			wantErr: ErrMissingType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.body)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.ID != valid.ID || got.Type != TypeMessageCreated || got.Source != "chatrooms" || got.Version != SchemaVersion {
+				t.Errorf("Decode() metadata = %+v, want %+v", got.EventMetadata, valid.EventMetadata)
+			}
+			var payload map[string]string
+			if err := got.DecodePayload(&payload); err != nil || payload["text"] != "hi" {
+				t.Errorf("DecodePayload() = %v, %v", payload, err)
+			}
+		})
+	}
+}
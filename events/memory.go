@@ -0,0 +1,282 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const memoryQueueSize = 1024
+
+type (
+	// MemoryBroker is an in-process Broker for single-binary mode and tests. Nothing survives
+	// a restart and a message left unsettled by its handler is not redelivered.
+	MemoryBroker struct {
+		RetryPolicy
+
+		mu            sync.Mutex
+		queues        map[string]chan memoryItem
+		dead          map[string][]DeadLetter
+		subscriptions map[string]map[*memorySubscription]bool
+
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+
+	memoryItem struct {
+		body      []byte
+		retries   int
+		lastError string
+		timestamp time.Time
+	}
+
+	memoryDelivery struct {
+		broker *MemoryBroker
+		queue  string
+		item   memoryItem
+	}
+
+	memorySubscription struct {
+		broker   *MemoryBroker
+		exchange string
+		events   chan Message
+
+		mu   sync.RWMutex
+		keys map[string]bool
+	}
+)
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		RetryPolicy:   DefaultRetryPolicy(),
+		queues:        make(map[string]chan memoryItem),
+		dead:          make(map[string][]DeadLetter),
+		subscriptions: make(map[string]map[*memorySubscription]bool),
+		done:          make(chan struct{}),
+	}
+}
+
+// Publish queues the message, blocking while the queue is full.
+func (b *MemoryBroker) Publish(queue string, body []byte) error {
+	return b.enqueue(queue, memoryItem{body: body, timestamp: time.Now()})
+}
+
+// Consume calls handle for every message of the queue, one at a time.
+func (b *MemoryBroker) Consume(queue string, handle Handler) error {
+	select {
+	case <-b.done:
+		return errClientClosed
+	default:
+	}
+
+	q := b.queue(queue)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case item := <-q:
+				handle(Message{
+					Topic:   queue,
+					Body:    item.body,
+					Retries: item.retries,
+					settler: memoryDelivery{broker: b, queue: queue, item: item},
+				})
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// PublishEvent hands the event to every subscription of the exchange bound to the key.
+func (b *MemoryBroker) PublishEvent(exchange, key string, body []byte) error {
+	b.mu.Lock()
+	subs := make([]*memorySubscription, 0, len(b.subscriptions[exchange]))
+	for sub := range b.subscriptions[exchange] {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	for _, sub := range subs {
+		if !sub.bound(key) {
+			continue
+		}
+		select {
+		case sub.events <- Message{Topic: key, Body: body}:
+		case <-b.done:
+			return errClientClosed
+		}
+	}
+	return nil
+}
+
+// Subscribe calls handle for the events of the exchange whose key is bound.
+func (b *MemoryBroker) Subscribe(exchange string, handle Handler) (Subscription, error) {
+	sub := &memorySubscription{
+		broker:   b,
+		exchange: exchange,
+		events:   make(chan Message, memoryQueueSize),
+		keys:     make(map[string]bool),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+		return nil, errClientClosed
+	default:
+	}
+	if b.subscriptions[exchange] == nil {
+		b.subscriptions[exchange] = make(map[*memorySubscription]bool)
+	}
+	b.subscriptions[exchange][sub] = true
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			select {
+			case msg := <-sub.events:
+				handle(msg)
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// DeadLetters returns up to limit dead-lettered messages of the queue, leaving them in place.
+func (b *MemoryBroker) DeadLetters(queue string, limit int) ([]DeadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	letters := b.dead[queue]
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return append([]DeadLetter(nil), letters...), nil
+}
+
+// Replay moves up to limit dead-lettered messages back to the queue with a fresh retry budget.
+func (b *MemoryBroker) Replay(queue string, limit int) (int, error) {
+	b.mu.Lock()
+	letters := b.dead[queue]
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	b.dead[queue] = b.dead[queue][len(letters):]
+	b.mu.Unlock()
+
+	for i, letter := range letters {
+		if err := b.enqueue(queue, memoryItem{body: letter.Body, timestamp: letter.Timestamp}); err != nil {
+			return i, err
+		}
+	}
+	return len(letters), nil
+}
+
+// Close stops the consumers and the subscriptions.
+func (b *MemoryBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+	})
+}
+
+func (b *MemoryBroker) queue(name string) chan memoryItem {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q, ok := b.queues[name]
+	if !ok {
+		q = make(chan memoryItem, memoryQueueSize)
+		b.queues[name] = q
+	}
+	return q
+}
+
+func (b *MemoryBroker) enqueue(queue string, item memoryItem) error {
+	select {
+	case b.queue(queue) <- item:
+		return nil
+	case <-b.done:
+		return errClientClosed
+	}
+}
+
+func (b *MemoryBroker) deadLetter(queue string, item memoryItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.dead[queue] = append(b.dead[queue], DeadLetter{
+		Queue:     queue,
+		Body:      item.body,
+		Retries:   item.retries,
+		LastError: item.lastError,
+		Timestamp: item.timestamp,
+	})
+}
+
+func (md memoryDelivery) ack() error {
+	return nil
+}
+
+func (md memoryDelivery) reject() error {
+	md.broker.deadLetter(md.queue, md.item)
+	return nil
+}
+
+// retry queues the message again once the delay is over, or dead-letters it.
+func (md memoryDelivery) retry(cause error) error {
+	b, item := md.broker, md.item
+	if item.retries >= b.MaxRetries {
+		log.Warn().Err(cause).Msgf("dead-lettering message from %s after %d retries", md.queue, item.retries)
+		b.deadLetter(md.queue, item)
+		return nil
+	}
+
+	delay := b.delay(item.retries)
+	item.retries++
+	if cause != nil {
+		item.lastError = cause.Error()
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			b.enqueue(md.queue, item)
+		case <-b.done:
+		}
+	}()
+	return nil
+}
+
+func (s *memorySubscription) Bind(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key] = true
+}
+
+func (s *memorySubscription) Unbind(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
+
+// Synced returns a closed channel, the keys are bound as soon as Bind returns.
+func (s *memorySubscription) Synced() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (s *memorySubscription) bound(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys[key]
+}
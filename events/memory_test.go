@@ -0,0 +1,106 @@
+package events
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestMemoryBroker() *MemoryBroker {
+	b := NewMemoryBroker()
+	b.RetryDelay = time.Millisecond
+	b.MaxRetries = 2
+	return b
+}
+
+func TestMemoryBroker_CompetingConsumers(t *testing.T) {
+	b := newTestMemoryBroker()
+	defer b.Close()
+
+	handle, msgs := collect()
+	for i := 0; i < 3; i++ {
+		if err := b.Consume("chat-channel", handle); err != nil {
+			t.Fatalf("Consume() error = %v", err)
+		}
+	}
+	for _, body := range []string{"one", "two", "three"} {
+		if err := b.Publish("chat-channel", []byte(body)); err != nil {
+			t.Fatalf("Publish() error = %v", err)
+		}
+	}
+
+	got := map[string]int{}
+	for i := 0; i < 3; i++ {
+		got[receiveMessage(t, msgs)]++
+	}
+	for _, body := range []string{"one", "two", "three"} {
+		if got[body] != 1 {
+			t.Errorf("%q handled %d times, want once", body, got[body])
+		}
+	}
+}
+
+func TestMemoryBroker_RetryThenDeadLetter(t *testing.T) {
+	b := newTestMemoryBroker()
+	defer b.Close()
+
+	handle, msgs := collect()
+	b.Consume("chat-channel", handle)
+	b.Publish("chat-channel", []byte("poison"))
+
+	for attempt := 0; attempt <= b.MaxRetries; attempt++ {
+		select {
+		case msg := <-msgs:
+			if msg.Retries != attempt {
+				t.Errorf("attempt %d: retries = %d", attempt, msg.Retries)
+			}
+			msg.Retry(errors.New("db down"))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("attempt %d not delivered", attempt)
+		}
+	}
+
+	letters, _ := b.DeadLetters("chat-channel", 10)
+	if len(letters) != 1 || string(letters[0].Body) != "poison" || letters[0].Retries != 2 || letters[0].LastError != "db down" {
+		t.Fatalf("DeadLetters() = %+v", letters)
+	}
+
+	if replayed, err := b.Replay("chat-channel", 10); err != nil || replayed != 1 {
+		t.Fatalf("Replay() = %d, %v", replayed, err)
+	}
+	if got := receiveMessage(t, msgs); got != "poison" {
+		t.Errorf("replayed %q, want poison", got)
+	}
+	if letters, _ := b.DeadLetters("chat-channel", 10); len(letters) != 0 {
+		t.Errorf("replayed messages should leave the dead letters, %d left", len(letters))
+	}
+}
+
+func TestMemoryBroker_EventsFollowBindings(t *testing.T) {
+	b := newTestMemoryBroker()
+	defer b.Close()
+
+	techHandle, tech := collect()
+	techSub, _ := b.Subscribe("chat-events", techHandle)
+	techSub.Bind("tech")
+	musicHandle, music := collect()
+	musicSub, _ := b.Subscribe("chat-events", musicHandle)
+	musicSub.Bind("music")
+
+	b.PublishEvent("chat-events", "tech", []byte("hello"))
+	if got := receiveMessage(t, tech); got != "hello" {
+		t.Errorf("received %q, want hello", got)
+	}
+
+	techSub.Unbind("tech")
+	b.PublishEvent("chat-events", "tech", []byte("ignored"))
+	b.PublishEvent("chat-events", "music", []byte("song"))
+	if got := receiveMessage(t, music); got != "song" {
+		t.Errorf("received %q, want song", got)
+	}
+	select {
+	case msg := <-tech:
+		t.Errorf("unbound subscription received %q", msg.Body)
+	default:
+	}
+}
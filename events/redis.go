@@ -0,0 +1,386 @@
+package events
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	streamKeyPrefix   = "events:"
+	defaultStreamLen  = 100000
+	streamReadCount   = 20
+	streamReadBlock   = 2 * time.Second
+	busyGroupErrorMsg = "BUSYGROUP"
+
+	bodyField      = "body"
+	retriesField   = "retries"
+	lastErrorField = "last_error"
+	timestampField = "timestamp"
+)
+
+type (
+	// RedisBroker is the Broker backed by redis: work queues are streams read through a
+	// consumer group shared by the instances, and events are Pub/Sub channels named
+	// after the exchange and the key.
+	RedisBroker struct {
+		RedisClient *redis.Client
+		RetryPolicy
+		// MaxLen approximately caps the length of every stream.
+		MaxLen int64
+
+		group    string
+		consumer string
+
+		done      chan struct{}
+		closeOnce sync.Once
+		wg        sync.WaitGroup
+	}
+
+	redisDelivery struct {
+		broker *RedisBroker
+		queue  string
+		msg    redis.XMessage
+	}
+
+	redisSubscription struct {
+		broker  *RedisBroker
+		pubsub  *redis.PubSub
+		prefix  string
+		changed chan struct{}
+		keys    *boundKeys
+	}
+)
+
+// NewRedisBroker returns a broker whose instances share the work queues of the group. The
+// consumer must be unique to the instance and stable across its restarts, so that the messages
+// it left pending are handled again when it comes back.
+func NewRedisBroker(redisClient *redis.Client, group, consumer string) *RedisBroker {
+	return &RedisBroker{
+		RedisClient: redisClient,
+		RetryPolicy: DefaultRetryPolicy(),
+		MaxLen:      defaultStreamLen,
+		group:       group,
+		consumer:    consumer,
+		done:        make(chan struct{}),
+	}
+}
+
+// Publish appends the message to the stream of the queue.
+func (b *RedisBroker) Publish(queue string, body []byte) error {
+	return b.RedisClient.XAdd(b.entry(streamKey(queue), body, 0, "")).Err()
+}
+
+// Consume calls handle for every message of the queue, first the ones this consumer left
+// pending and then the new ones.
+func (b *RedisBroker) Consume(queue string, handle Handler) error {
+	stream := streamKey(queue)
+	err := b.RedisClient.XGroupCreateMkStream(stream, b.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), busyGroupErrorMsg) {
+		return err
+	}
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		// "0" reads the entries delivered to this consumer but never acknowledged, moving past the
+		// ones read so an entry left pending, waiting for its retry or its ack, is handled once.
+		// ">" reads the new entries once none is left.
+		start := "0"
+		for {
+			select {
+			case <-b.done:
+				return
+			default:
+			}
+
+			streams, err := b.RedisClient.XReadGroup(&redis.XReadGroupArgs{
+				Group:    b.group,
+				Consumer: b.consumer,
+				Streams:  []string{stream, start},
+				Count:    streamReadCount,
+				Block:    streamReadBlock,
+			}).Result()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				log.Error().Err(err).Msgf("Failed to read from %s", stream)
+				if !b.sleep(streamReadBlock) {
+					return
+				}
+				continue
+			}
+
+			last := ""
+			for _, s := range streams {
+				for _, msg := range s.Messages {
+					last = msg.ID
+					handle(Message{
+						Topic:   queue,
+						Body:    []byte(stringValue(msg.Values, bodyField)),
+						Retries: intValue(msg.Values, retriesField),
+						settler: redisDelivery{broker: b, queue: queue, msg: msg},
+					})
+				}
+			}
+			if start != ">" {
+				start = last
+				if last == "" {
+					start = ">"
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// PublishEvent publishes the event on the channel of the exchange key.
+func (b *RedisBroker) PublishEvent(exchange, key string, body []byte) error {
+	return b.RedisClient.Publish(exchange+":"+key, body).Err()
+}
+
+// Subscribe calls handle for the events of the exchange whose key is bound.
+// The Pub/Sub connection subscribes again to the bound keys after a reconnection.
+func (b *RedisBroker) Subscribe(exchange string, handle Handler) (Subscription, error) {
+	select {
+	case <-b.done:
+		return nil, errClientClosed
+	default:
+	}
+
+	sub := &redisSubscription{
+		broker:  b,
+		pubsub:  b.RedisClient.Subscribe(),
+		prefix:  exchange + ":",
+		changed: make(chan struct{}, 1),
+		keys:    newBoundKeys(),
+	}
+	events := sub.pubsub.Channel()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer sub.pubsub.Close()
+		subscribed := make(map[string]bool)
+		for {
+			select {
+			case msg, ok := <-events:
+				if !ok {
+					return
+				}
+				handle(Message{Topic: strings.TrimPrefix(msg.Channel, sub.prefix), Body: []byte(msg.Payload)})
+			case <-sub.changed:
+				if err := sub.sync(subscribed); err != nil {
+					log.Error().Err(err).Msgf("Failed to subscribe to %s", exchange)
+					time.AfterFunc(streamReadBlock, sub.notify)
+				}
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// DeadLetters returns up to limit dead-lettered messages of the queue, leaving them in place.
+func (b *RedisBroker) DeadLetters(queue string, limit int) ([]DeadLetter, error) {
+	msgs, err := b.RedisClient.XRangeN(deadLetterKey(queue), "-", "+", int64(limit)).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(msgs))
+	for _, msg := range msgs {
+		letters = append(letters, DeadLetter{
+			Queue:     queue,
+			Body:      []byte(stringValue(msg.Values, bodyField)),
+			Retries:   intValue(msg.Values, retriesField),
+			LastError: stringValue(msg.Values, lastErrorField),
+			Timestamp: time.Unix(0, int64(intValue(msg.Values, timestampField))*int64(time.Millisecond)),
+		})
+	}
+	return letters, nil
+}
+
+// Replay moves up to limit dead-lettered messages back to the queue with a fresh retry budget.
+func (b *RedisBroker) Replay(queue string, limit int) (int, error) {
+	msgs, err := b.RedisClient.XRangeN(deadLetterKey(queue), "-", "+", int64(limit)).Result()
+	if err != nil {
+		return 0, err
+	}
+	for i, msg := range msgs {
+		_, err := b.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.XAdd(b.entry(streamKey(queue), []byte(stringValue(msg.Values, bodyField)), 0, ""))
+			pipe.XDel(deadLetterKey(queue), msg.ID)
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	log.Info().Msgf("replayed %d dead-lettered messages to %s", len(msgs), queue)
+	return len(msgs), nil
+}
+
+// Close stops the consumers and the subscriptions.
+func (b *RedisBroker) Close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.wg.Wait()
+	})
+}
+
+func (b *RedisBroker) entry(stream string, body []byte, retries int, lastError string) *redis.XAddArgs {
+	values := map[string]interface{}{
+		bodyField:      string(body),
+		retriesField:   retries,
+		timestampField: time.Now().UnixNano() / int64(time.Millisecond),
+	}
+	if lastError != "" {
+		values[lastErrorField] = lastError
+	}
+	return &redis.XAddArgs{
+		Stream:       stream,
+		MaxLenApprox: b.MaxLen,
+		Values:       values,
+	}
+}
+
+// sleep waits for the delay and reports false if the broker was closed meanwhile.
+func (b *RedisBroker) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-b.done:
+		return false
+	}
+}
+
+func (rd redisDelivery) ack() error {
+	return rd.broker.RedisClient.XAck(streamKey(rd.queue), rd.broker.group, rd.msg.ID).Err()
+}
+
+// reject moves the message to the dead-letter stream.
+func (rd redisDelivery) reject() error {
+	return rd.moveTo(deadLetterKey(rd.queue), intValue(rd.msg.Values, retriesField), stringValue(rd.msg.Values, lastErrorField))
+}
+
+// retry appends the message again to the stream once the delay is over, or dead-letters it.
+// Until then the entry stays pending, so it is not lost if the instance stops.
+func (rd redisDelivery) retry(cause error) error {
+	b := rd.broker
+	retries := intValue(rd.msg.Values, retriesField)
+	lastError := stringValue(rd.msg.Values, lastErrorField)
+	if cause != nil {
+		lastError = cause.Error()
+	}
+	if retries >= b.MaxRetries {
+		log.Warn().Err(cause).Msgf("dead-lettering message from %s after %d retries", rd.queue, retries)
+		return rd.moveTo(deadLetterKey(rd.queue), retries, lastError)
+	}
+
+	delay := b.delay(retries)
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		if !b.sleep(delay) {
+			return
+		}
+		if err := rd.moveTo(streamKey(rd.queue), retries+1, lastError); err != nil {
+			log.Error().Err(err).Msgf("Failed to retry message from %s", rd.queue)
+		}
+	}()
+	return nil
+}
+
+// moveTo appends the message to the stream and acknowledges the original entry atomically.
+func (rd redisDelivery) moveTo(stream string, retries int, lastError string) error {
+	b := rd.broker
+	_, err := b.RedisClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.XAdd(b.entry(stream, []byte(stringValue(rd.msg.Values, bodyField)), retries, lastError))
+		pipe.XAck(streamKey(rd.queue), b.group, rd.msg.ID)
+		return nil
+	})
+	return err
+}
+
+func (s *redisSubscription) Bind(key string) {
+	s.keys.add(key)
+	s.notify()
+}
+
+func (s *redisSubscription) Unbind(key string) {
+	s.keys.remove(key)
+	s.notify()
+}
+
+// Synced returns a channel closed once the channels of the keys bound so far are subscribed.
+func (s *redisSubscription) Synced() <-chan struct{} {
+	return s.keys.synced()
+}
+
+func (s *redisSubscription) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// sync subscribes and unsubscribes the channels until they match the bound keys.
+func (s *redisSubscription) sync(subscribed map[string]bool) error {
+	wanted, version := s.keys.wanted()
+	var add, remove []string
+	for key := range wanted {
+		if !subscribed[key] {
+			add = append(add, s.prefix+key)
+		}
+	}
+	for key := range subscribed {
+		if !wanted[key] {
+			remove = append(remove, s.prefix+key)
+		}
+	}
+
+	if len(add) > 0 {
+		if err := s.pubsub.Subscribe(add...); err != nil {
+			return err
+		}
+		for _, channel := range add {
+			subscribed[strings.TrimPrefix(channel, s.prefix)] = true
+		}
+	}
+	if len(remove) > 0 {
+		if err := s.pubsub.Unsubscribe(remove...); err != nil {
+			return err
+		}
+		for _, channel := range remove {
+			delete(subscribed, strings.TrimPrefix(channel, s.prefix))
+		}
+	}
+	s.keys.apply(version)
+	return nil
+}
+
+func streamKey(queue string) string {
+	return streamKeyPrefix + queue
+}
+
+func deadLetterKey(queue string) string {
+	return streamKeyPrefix + DeadLetterQueue(queue)
+}
+
+func stringValue(values map[string]interface{}, field string) string {
+	v, _ := values[field].(string)
+	return v
+}
+
+func intValue(values map[string]interface{}, field string) int {
+	n, _ := strconv.Atoi(stringValue(values, field))
+	return n
+}
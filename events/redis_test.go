@@ -0,0 +1,229 @@
+package events
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type (
+	// streamServer is a stand-in for redis speaking just enough RESP to serve one consumer
+	// of a single stream: it keeps the entries not delivered yet and the pending ones.
+	streamServer struct {
+		listener net.Listener
+
+		mu      sync.Mutex
+		bodies  map[string]string
+		fresh   []string
+		pending []string
+		// newReads counts the reads of new entries that found none.
+		newReads int
+	}
+)
+
+func newStreamServer(t *testing.T) *streamServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	s := &streamServer{listener: listener, bodies: make(map[string]string)}
+	go s.serve()
+	return s
+}
+
+func (s *streamServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *streamServer) close() {
+	s.listener.Close()
+}
+
+// add appends an entry, already delivered to the consumer and left pending when pending is set.
+func (s *streamServer) add(id, body string, pending bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[id] = body
+	if pending {
+		s.pending = append(s.pending, id)
+	} else {
+		s.fresh = append(s.fresh, id)
+	}
+}
+
+func (s *streamServer) idleReads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.newReads
+}
+
+func (s *streamServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *streamServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, s.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *streamServer) reply(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "XREADGROUP":
+		// XREADGROUP GROUP group consumer COUNT n BLOCK ms STREAMS stream id
+		return s.read(args[len(args)-2], args[len(args)-1])
+	case "XACK":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		acked := 0
+		for _, id := range args[3:] {
+			for i, pending := range s.pending {
+				if pending == id {
+					s.pending = append(s.pending[:i], s.pending[i+1:]...)
+					acked++
+					break
+				}
+			}
+		}
+		return ":" + strconv.Itoa(acked) + "\r\n"
+	default:
+		return "+OK\r\n"
+	}
+}
+
+// read serves the new entries for ">" and the pending entries past the id otherwise.
+func (s *streamServer) read(stream, start string) string {
+	s.mu.Lock()
+	var ids []string
+	if start == ">" {
+		ids, s.fresh = s.fresh, nil
+		s.pending = append(s.pending, ids...)
+		if len(ids) == 0 {
+			s.newReads++
+		}
+	} else {
+		for _, id := range s.pending {
+			if streamIDAfter(id, start) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	entries := make([]string, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, respArray(bulk(id), respArray(bulk(bodyField), bulk(s.bodies[id]))))
+	}
+	s.mu.Unlock()
+
+	if start == ">" && len(entries) == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return "*-1\r\n"
+	}
+	return respArray(respArray(bulk(stream), respArray(entries...)))
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func respArray(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+// streamIDAfter reports whether the stream entry id comes after start.
+func streamIDAfter(id, start string) bool {
+	sequence := func(id string) (ms, seq int) {
+		parts := strings.SplitN(id, "-", 2)
+		ms, _ = strconv.Atoi(parts[0])
+		if len(parts) == 2 {
+			seq, _ = strconv.Atoi(parts[1])
+		}
+		return
+	}
+	idMs, idSeq := sequence(id)
+	startMs, startSeq := sequence(start)
+	return idMs > startMs || idMs == startMs && idSeq > startSeq
+}
+
+func TestRedisBroker_PendingEntriesHandledOnce(t *testing.T) {
+	server := newStreamServer(t)
+	defer server.close()
+	server.add("1-0", "kept", true)
+	server.add("2-0", "pending", true)
+	server.add("3-0", "new", false)
+
+	redisClient := redis.NewClient(&redis.Options{Addr: server.addr()})
+	defer redisClient.Close()
+	b := NewRedisBroker(redisClient, "chat", "instance-1")
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	err := b.Consume("chat-channel", func(msg Message) {
+		mu.Lock()
+		handled[string(msg.Body)]++
+		mu.Unlock()
+		// the entry stays pending on purpose, as it does while waiting for its retry
+		if string(msg.Body) != "kept" {
+			msg.Ack()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Consume() error = %v", err)
+	}
+	// a few reads of new entries finding none, so a pending entry read again would show
+	waitUntil(t, func() bool { return server.idleReads() >= 3 })
+	b.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, body := range []string{"kept", "pending", "new"} {
+		if handled[body] != 1 {
+			t.Errorf("%q handled %d times, want once", body, handled[body])
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package events
+
+import (
+	"fmt"
+
+	rabbit "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// DeadLetterExchange routes the deliveries rejected by a queue to its dead-letter queue.
+	DeadLetterExchange = "dead-letters"
+	retrySuffix        = ".retry"
+	deadLetterSuffix   = ".dead"
+	retryCountHeader   = "x-retry-count"
+	lastErrorHeader    = "x-last-error"
+)
+
+// DeadLetterQueue returns the name of the queue holding the dead-lettered messages of queueName.
+func DeadLetterQueue(queueName string) string {
+	return queueName + deadLetterSuffix
+}
+
+// rabbitDelivery settles a delivery consumed by the QueueClient.
+type rabbitDelivery struct {
+	qc    *QueueClient
+	queue string
+	d     rabbit.Delivery
+}
+
+func (rd rabbitDelivery) ack() error {
+	return rd.d.Ack(false)
+}
+
+// reject routes the delivery to the dead-letter queue.
+func (rd rabbitDelivery) reject() error {
+	return rd.d.Nack(false, false)
+}
+
+// retry republishes the delivery to the retry queue of its attempt, whose expired messages go back to
+// the queue, or dead-letters it once it has been retried MaxRetries times.
+func (rd rabbitDelivery) retry(cause error) error {
+	qc, d := rd.qc, rd.d
+	retries := retryCount(d.Headers)
+	if retries >= qc.MaxRetries {
+		log.Warn().Err(cause).Msgf("dead-lettering message from %s after %d retries", rd.queue, retries)
+		return d.Nack(false, false)
+	}
+
+	headers := rabbit.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(retries + 1)
+	if cause != nil {
+		headers[lastErrorHeader] = cause.Error()
+	}
+	delay := qc.delay(retries)
+
+	err := qc.publish(qc.queueTopology(rd.queue), "", retryQueue(rd.queue, retries+1), rabbit.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: rabbit.Persistent,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	})
+	if err != nil {
+		// keep the message in the broker, it comes back right away
+		return d.Nack(false, true)
+	}
+	log.Info().Msgf("retrying message from %s in %v, attempt %d", rd.queue, delay, retries+1)
+	return d.Ack(false)
+}
+
+// DeadLetters returns up to limit dead-lettered messages of the queue, leaving them in place.
+func (qc *QueueClient) DeadLetters(channelName string, limit int) ([]DeadLetter, error) {
+	ch, err := qc.adminChannel(channelName)
+	if err != nil {
+		return nil, err
+	}
+	// closing the channel requeues every message fetched without ack
+	defer ch.Close()
+
+	letters := make([]DeadLetter, 0, limit)
+	for len(letters) < limit {
+		d, ok, err := ch.Get(DeadLetterQueue(channelName), false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, DeadLetter{
+			Queue:     channelName,
+			Body:      d.Body,
+			Retries:   retryCount(d.Headers),
+			LastError: lastError(d.Headers),
+			Timestamp: d.Timestamp,
+		})
+	}
+	return letters, nil
+}
+
+// Replay moves up to limit dead-lettered messages back to the queue with a fresh retry budget.
+func (qc *QueueClient) Replay(channelName string, limit int) (int, error) {
+	ch, err := qc.adminChannel(channelName)
+	if err != nil {
+		return 0, err
+	}
+	defer ch.Close()
+
+	replayed := 0
+	for replayed < limit {
+		d, ok, err := ch.Get(DeadLetterQueue(channelName), false)
+		if err != nil {
+			return replayed, err
+		}
+		if !ok {
+			break
+		}
+		err = qc.publish(qc.queueTopology(channelName), "", channelName, rabbit.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: rabbit.Persistent,
+			Timestamp:    d.Timestamp,
+			Body:         d.Body,
+		})
+		if err != nil {
+			return replayed, err
+		}
+		if err := d.Ack(false); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	log.Info().Msgf("replayed %d dead-lettered messages to %s", replayed, channelName)
+	return replayed, nil
+}
+
+// adminChannel opens a short-lived channel to inspect the dead-letter queue.
+func (qc *QueueClient) adminChannel(channelName string) (amqpChannel, error) {
+	conn, err := qc.currentConnection()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := qc.declareTopology(ch, channelName); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (qc *QueueClient) queueTopology(queueName string) topology {
+	return topology{
+		name:    "queue:" + queueName,
+		declare: func(ch amqpChannel) error { return qc.declareTopology(ch, queueName) },
+	}
+}
+
+// retryQueue returns the name of the queue holding the messages of queueName waiting for their attempt.
+func retryQueue(queueName string, attempt int) string {
+	return fmt.Sprintf("%s%s.%d", queueName, retrySuffix, attempt)
+}
+
+// declareTopology declares the durable queue with a retry queue per attempt, whose messages go back
+// to the queue once the delay of the attempt expires, and its dead-letter queue, fed by the rejected
+// messages. RabbitMQ only expires the messages at the head of a queue, so every delay has its own
+// queue, where the messages expire in order.
+func (qc *QueueClient) declareTopology(ch amqpChannel, queueName string) error {
+	err := ch.ExchangeDeclare(
+		DeadLetterExchange, // name
+		"direct",           // kind
+		true,               // durable
+		false,              // auto-delete
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(DeadLetterQueue(queueName), true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.QueueBind(DeadLetterQueue(queueName), queueName, DeadLetterExchange, false, nil); err != nil {
+		return err
+	}
+	for attempt := 1; attempt <= qc.MaxRetries; attempt++ {
+		_, err = ch.QueueDeclare(retryQueue(queueName, attempt), true, false, false, false, rabbit.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queueName,
+			"x-message-ttl":             qc.delay(attempt - 1).Milliseconds(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = ch.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		rabbit.Table{
+			"x-dead-letter-exchange":    DeadLetterExchange,
+			"x-dead-letter-routing-key": queueName,
+		},
+	)
+	return err
+}
+
+func retryCount(headers rabbit.Table) int {
+	switch v := headers[retryCountHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func lastError(headers rabbit.Table) string {
+	v, _ := headers[lastErrorHeader].(string)
+	return v
+}
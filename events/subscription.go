@@ -0,0 +1,216 @@
+package events
+
+import (
+	"fmt"
+
+	rabbit "github.com/rabbitmq/amqp091-go"
+	"github.com/rs/zerolog/log"
+)
+
+// amqpSubscription receives the events published to a topic exchange through a queue owned by
+// this instance. The queue is exclusive, so every instance gets its own copy of each event,
+// and it only receives the routing keys currently bound.
+type amqpSubscription struct {
+	qc       *QueueClient
+	exchange string
+	handle   Handler
+	// changed is signalled when the bound keys have to be synced with the broker
+	changed chan struct{}
+	keys    *boundKeys
+}
+
+// PublishEvent sends a transient event to the topic exchange.
+func (qc *QueueClient) PublishEvent(exchange, routingKey string, body []byte) error {
+	return qc.publish(exchangeTopology(exchange), exchange, routingKey, rabbit.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+	})
+}
+
+// Subscribe starts receiving the events of the exchange. Nothing is delivered until a key is bound.
+// The subscription survives reconnections, binding its keys again on the new queue.
+func (qc *QueueClient) Subscribe(exchange string, handle Handler) (Subscription, error) {
+	select {
+	case <-qc.done:
+		return nil, errClientClosed
+	default:
+	}
+
+	s := &amqpSubscription{
+		qc:       qc,
+		exchange: exchange,
+		handle:   handle,
+		changed:  make(chan struct{}, 1),
+		keys:     newBoundKeys(),
+	}
+	qc.wg.Add(1)
+	go s.run()
+	log.Info().Msg(fmt.Sprintf(" <-[x] Subscriber: %s - Exchange: %s\n", qc.serviceName, exchange))
+	return s, nil
+}
+
+// Bind starts receiving the events published with the routing key. It does not block,
+// the binding is applied in the background and Synced tells when it is.
+func (s *amqpSubscription) Bind(key string) {
+	s.keys.add(key)
+	s.notify()
+}
+
+// Unbind stops receiving the events published with the routing key.
+func (s *amqpSubscription) Unbind(key string) {
+	s.keys.remove(key)
+	s.notify()
+}
+
+// Synced returns a channel closed once the keys bound so far are bound on the queue.
+func (s *amqpSubscription) Synced() <-chan struct{} {
+	return s.keys.synced()
+}
+
+func (s *amqpSubscription) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run hands the events to the handler, declaring a new queue every time the channel drops.
+func (s *amqpSubscription) run() {
+	qc := s.qc
+	defer qc.wg.Done()
+
+	for attempt := 0; ; attempt++ {
+		ch, queue, deliveries, err := s.start()
+		if err != nil {
+			log.Error().Err(err).Msgf("Failed to subscribe to %s", s.exchange)
+			if !qc.sleep(qc.backoff(attempt)) {
+				return
+			}
+			continue
+		}
+		attempt = 0
+
+		bound := make(map[string]bool)
+		if err := s.sync(ch, queue, bound); err == nil {
+			s.forward(ch, queue, deliveries, bound)
+		} else {
+			log.Error().Err(err).Msgf("Failed to bind to %s", s.exchange)
+		}
+		ch.Close()
+
+		select {
+		case <-qc.done:
+			return
+		default:
+			log.Warn().Msgf("subscriber channel for %s closed, subscribing again", s.exchange)
+		}
+	}
+}
+
+// forward handles the events until the channel drops, applying the binding changes meanwhile.
+func (s *amqpSubscription) forward(ch amqpChannel, queue string, deliveries <-chan rabbit.Delivery, bound map[string]bool) {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			s.handle(Message{Topic: d.RoutingKey, Body: d.Body})
+		case <-s.changed:
+			if err := s.sync(ch, queue, bound); err != nil {
+				log.Error().Err(err).Msgf("Failed to bind to %s", s.exchange)
+				return
+			}
+		case <-s.qc.done:
+			return
+		}
+	}
+}
+
+func (s *amqpSubscription) start() (amqpChannel, string, <-chan rabbit.Delivery, error) {
+	conn, err := s.qc.waitConnection()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if err := declareExchange(ch, s.exchange); err != nil {
+		ch.Close()
+		return nil, "", nil, err
+	}
+
+	// a server named queue deleted along with the connection
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		ch.Close()
+		return nil, "", nil, err
+	}
+
+	deliveries, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, "", nil, err
+	}
+	return ch, q.Name, deliveries, nil
+}
+
+// sync binds and unbinds the queue until it matches the wanted keys.
+func (s *amqpSubscription) sync(ch amqpChannel, queue string, bound map[string]bool) error {
+	wanted, version := s.keys.wanted()
+	for key := range wanted {
+		if bound[key] {
+			continue
+		}
+		if err := ch.QueueBind(queue, key, s.exchange, false, nil); err != nil {
+			return err
+		}
+		bound[key] = true
+	}
+	for key := range bound {
+		if wanted[key] {
+			continue
+		}
+		if err := ch.QueueUnbind(queue, key, s.exchange, nil); err != nil {
+			return err
+		}
+		delete(bound, key)
+	}
+	s.keys.apply(version)
+	return nil
+}
+
+func exchangeTopology(exchange string) topology {
+	return topology{
+		name:    "exchange:" + exchange,
+		declare: func(ch amqpChannel) error { return declareExchange(ch, exchange) },
+	}
+}
+
+func declareExchange(ch amqpChannel, exchange string) error {
+	return ch.ExchangeDeclare(
+		exchange, // name
+		"topic",  // kind
+		true,     // durable
+		false,    // auto-delete
+		false,    // internal
+		false,    // no-wait
+		nil,      // arguments
+	)
+}
@@ -0,0 +1,200 @@
+package messages
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+
+	"go-chat/api"
+	"go-chat/auth"
+)
+
+type response struct {
+	Message string `json:"message,omitempty"`
+}
+
+type Handler struct {
+	MessagesMgr interface {
+		ListChatroomMessages(chatroom string, before string, limit int) (api.MessagesPageResponse, *api.APIError)
+		EditMsg(userID, messageID uuid.UUID, body api.EditMessageRequest) (api.MessageResponse, *api.APIError)
+		DeleteMsg(userID, messageID uuid.UUID) *api.APIError
+		ListEdits(userID, messageID uuid.UUID) ([]api.MessageEditResponse, *api.APIError)
+		ListThread(userID, messageID uuid.UUID, after string, limit int) (api.ThreadResponse, *api.APIError)
+		ListMentions(userID uuid.UUID, limit int) ([]api.MentionResponse, *api.APIError)
+		Search(userID uuid.UUID, body api.SearchRequest, limit int) (api.SearchResponse, *api.APIError)
+		MarkMentionsRead(userID uuid.UUID, body api.MarkMentionsReadRequest) (api.MarkMentionsReadResponse, *api.APIError)
+	}
+	Rooms interface {
+		CheckAccess(userID uuid.UUID, roomID string) *api.APIError
+	}
+}
+
+// ListChatroomMessages - returns a page of the chatroom history
+func (h Handler) ListChatroomMessages(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	if err := h.Rooms.CheckAccess(identity.UserID, c.Param("id")); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	limit, ok := pageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	page, err := h.MessagesMgr.ListChatroomMessages(c.Param("id"), c.QueryParam("before"), limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// Edit - replaces the body of a message, for its author or the room moderators
+func (h Handler) Edit(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	messageID, parseErr := uuid.Parse(c.Param("id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+	var editMessageRequest api.EditMessageRequest
+	if err := c.Bind(&editMessageRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := editMessageRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	message, err := h.MessagesMgr.EditMsg(identity.UserID, messageID, editMessageRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, message)
+}
+
+// Delete - deletes a message, for its author or the room moderators
+func (h Handler) Delete(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	messageID, parseErr := uuid.Parse(c.Param("id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+	if err := h.MessagesMgr.DeleteMsg(identity.UserID, messageID); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListEdits - returns the previous bodies of a message, for the room moderators
+func (h Handler) ListEdits(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	messageID, parseErr := uuid.Parse(c.Param("id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+
+	edits, err := h.MessagesMgr.ListEdits(identity.UserID, messageID)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, edits)
+}
+
+// ListThread - returns a message and a page of its replies
+func (h Handler) ListThread(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	messageID, parseErr := uuid.Parse(c.Param("id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+	limit, ok := pageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	thread, err := h.MessagesMgr.ListThread(identity.UserID, messageID, c.QueryParam("after"), limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, thread)
+}
+
+// ListMentions - returns the unread mentions of the user, newest first
+func (h Handler) ListMentions(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	limit, ok := pageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	mentions, err := h.MessagesMgr.ListMentions(identity.UserID, limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, mentions)
+}
+
+// MarkMentionsRead - marks mentions of the user as read, all of them when no message is given
+func (h Handler) MarkMentionsRead(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var markMentionsReadRequest api.MarkMentionsReadRequest
+	if err := c.Bind(&markMentionsReadRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := markMentionsReadRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	marked, err := h.MessagesMgr.MarkMentionsRead(identity.UserID, markMentionsReadRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, marked)
+}
+
+// Search - returns a page of the messages matching a text, out of the rooms the caller can see
+func (h Handler) Search(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	searchRequest := api.SearchRequest{
+		Text:   c.QueryParam("q"),
+		Room:   c.QueryParam("room"),
+		From:   c.QueryParam("from"),
+		Before: c.QueryParam("before"),
+	}
+	if err := searchRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	limit, ok := pageLimit(c.QueryParam("limit"))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, response{Message: "limit must be a positive number"})
+	}
+
+	page, err := h.MessagesMgr.Search(identity.UserID, searchRequest, limit)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, page)
+}
+
+// pageLimit parses the optional page size, capped to MaxPageSize.
+func pageLimit(value string) (int, bool) {
+	if value == "" {
+		return DefaultPageSize, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return 0, false
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	return limit, true
+}
@@ -1,46 +1,563 @@
 package messages
 
 import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
+	"go-chat/api"
 	"go-chat/chatrooms"
 	"go-chat/db"
+	"go-chat/events"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+	cursorSeparator = "|"
+
+	messageNotExistMsg  = "message not exists"
+	notAuthorMsg        = "only the author or the room moderators can do this"
+	notRoomModeratorMsg = "only the room owner or moderators can do this"
 )
 
+var errInvalidCursor = errors.New("invalid cursor")
+
 type (
 	messagesDB interface {
 		Create(user db.User) (uuid.UUID, error)
 	}
+	// roomChecker tells whether a user sees or moderates a room.
+	roomChecker interface {
+		CheckAccess(userID uuid.UUID, roomID string) *api.APIError
+		CanModerate(userID uuid.UUID, roomID string) (bool, *api.APIError)
+	}
+
+	// historyCache keeps the cached room histories in line with the edited and deleted messages, and
+	// holds the messages broadcast before they are stored.
+	historyCache interface {
+		Replay(roomID string) ([]chatrooms.ChatMessage, error)
+		Edit(roomID, messageID, text, editedAt string) error
+		Remove(roomID, messageID string) error
+	}
+
+	// unreadCounter keeps the cached unread counts in line with the stored and deleted messages.
+	unreadCounter interface {
+		Increment(roomID, authorID string) error
+		Forget(roomID string) error
+	}
+
+	eventPublisher interface {
+		PublishEvent(exchange, routingKey string, body []byte) error
+	}
+
 	MessagesMgr struct {
-		MessagesDB *db.MessagesDB
-		UsersDB    *db.UsersDB
+		MessagesDB  *db.MessagesDB
+		ReactionsDB *db.ReactionsDB
+		MentionsDB  *db.MentionsDB
+		UsersDB     *db.UsersDB
+		Rooms       roomChecker
+		History     historyCache
+		Unread      unreadCounter
+		Events      eventPublisher
 	}
 )
 
-func NewMessagesMgr(messagesDB *db.MessagesDB, usersDB *db.UsersDB) *MessagesMgr {
+func NewMessagesMgr(messagesDB *db.MessagesDB, reactionsDB *db.ReactionsDB, mentionsDB *db.MentionsDB, usersDB *db.UsersDB, rooms roomChecker, history historyCache, unread unreadCounter, events eventPublisher) *MessagesMgr {
 	return &MessagesMgr{
-		MessagesDB: messagesDB,
-		UsersDB:    usersDB,
+		MessagesDB:  messagesDB,
+		ReactionsDB: reactionsDB,
+		MentionsDB:  mentionsDB,
+		UsersDB:     usersDB,
+		Rooms:       rooms,
+		History:     history,
+		Unread:      unread,
+		Events:      events,
 	}
 }
 
-func (m *MessagesMgr) SaveMsg(body chatrooms.ChatMessage) (uuid.UUID, error) {
-	user, err := m.UsersDB.GetByNickName(body.Username)
+// SaveMsg stores the chat message and returns the stored row, which carries the canonical timestamp,
+// reporting whether it was stored now rather than by an earlier delivery.
+func (m *MessagesMgr) SaveMsg(body chatrooms.ChatMessage) (db.Message, bool, error) {
+	userID, err := m.senderID(body)
 	if err != nil {
-		return uuid.Nil, err
+		return db.Message{}, false, err
 	}
 	message := db.Message{
-		ID:       uuid.New(),
-		UserID:   user.ID,
+		ID:       messageID(body),
+		ClientID: optionalID(body.ClientID),
+		ParentID: optionalID(body.ParentID),
+		UserID:   userID,
 		Body:     body.Text,
 		Chatroom: string(body.Room),
 	}
-	insertID, err := m.MessagesDB.Create(message)
+	stored, created, err := m.MessagesDB.Create(message)
 	if err != nil {
-		return uuid.Nil, err
+		return db.Message{}, false, err
 	}
 
 	log.Info().Msg("message save ok\n")
-	return insertID, nil
+	return stored, created, nil
+}
+
+// messageID returns the ID given to the message at ingress, so redeliveries are stored once.
+// Messages queued without one get a new ID.
+func messageID(body chatrooms.ChatMessage) uuid.UUID {
+	id, err := uuid.Parse(body.ID)
+	if err != nil {
+		return uuid.New()
+	}
+	return id
+}
+
+// optionalID parses an ID the message may have, such as the one given by its sender.
+func optionalID(value string) *uuid.UUID {
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return nil
+	}
+	return &id
+}
+
+// senderID prefers the user id stamped by the websocket handler and falls back to the nickname.
+func (m *MessagesMgr) senderID(body chatrooms.ChatMessage) (uuid.UUID, error) {
+	if id, err := uuid.Parse(body.UserID); err == nil {
+		return id, nil
+	}
+	user, err := m.UsersDB.GetByNickName(body.Username)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return user.ID, nil
+}
+
+// ListChatroomMessages returns a page of the chatroom history, newest first, starting before the given cursor.
+func (m *MessagesMgr) ListChatroomMessages(chatroom string, before string, limit int) (api.MessagesPageResponse, *api.APIError) {
+	var cursor *db.MessageCursor
+	if before != "" {
+		decoded, err := decodeCursor(before)
+		if err != nil {
+			return api.MessagesPageResponse{}, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: err.Error()}
+		}
+		cursor = &decoded
+	}
+
+	rows, err := m.MessagesDB.ListByChatroom(chatroom, cursor, limit)
+	if err != nil {
+		return api.MessagesPageResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	messages, err := m.toResponses(rows)
+	if err != nil {
+		return api.MessagesPageResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	page := api.MessagesPageResponse{Messages: messages}
+	if len(rows) == limit {
+		last := rows[len(rows)-1]
+		page.NextCursor = encodeCursor(db.MessageCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	return page, nil
+}
+
+// toResponses returns the messages along with their reaction counts and thread summaries.
+func (m *MessagesMgr) toResponses(rows []db.MessageWithAuthor) ([]api.MessageResponse, error) {
+	ids := make([]uuid.UUID, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.ID)
+	}
+	counts, err := m.ReactionsDB.CountByMessages(ids)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := m.MessagesDB.GetThreadStats(ids)
+	if err != nil {
+		return nil, err
+	}
+	reactions := groupReactions(counts)
+	threads := make(map[uuid.UUID]db.ThreadStats, len(stats))
+	for _, thread := range stats {
+		threads[thread.ParentID] = thread
+	}
+
+	messages := make([]api.MessageResponse, 0, len(rows))
+	for _, row := range rows {
+		message := api.MessageResponse{
+			ID:        row.ID,
+			UserID:    row.UserID,
+			NickName:  row.Nickname,
+			Body:      row.Body,
+			Chatroom:  row.Chatroom,
+			ParentID:  row.ParentID,
+			CreatedAt: row.CreatedAt,
+			EditedAt:  row.EditedAt,
+			Reactions: reactions[row.ID],
+		}
+		if thread, ok := threads[row.ID]; ok {
+			lastReplyAt := thread.LastReplyAt
+			message.ReplyCount = thread.ReplyCount
+			message.LastReplyAt = &lastReplyAt
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func groupReactions(counts []db.ReactionCount) map[uuid.UUID][]api.ReactionCountResponse {
+	reactions := make(map[uuid.UUID][]api.ReactionCountResponse)
+	for _, count := range counts {
+		reactions[count.MessageID] = append(reactions[count.MessageID], api.ReactionCountResponse{Emoji: count.Emoji, Count: count.Count})
+	}
+	return reactions
+}
+
+// ThreadRoot returns the first message of the thread of a message of the room, so replies to
+// replies join the same thread.
+func (m *MessagesMgr) ThreadRoot(roomID, messageID string) (string, error) {
+	id, err := uuid.Parse(messageID)
+	if err != nil {
+		return "", chatrooms.ErrUnknownMessage
+	}
+	message, err := m.MessagesDB.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+	if message.ID == uuid.Nil || message.DeletedAt.Valid || message.Chatroom != roomID {
+		return "", chatrooms.ErrUnknownMessage
+	}
+	if message.ParentID != nil {
+		return message.ParentID.String(), nil
+	}
+	return message.ID.String(), nil
+}
+
+// MessageAuthor returns the author of a message of the room, the one its receipts are sent to.
+func (m *MessagesMgr) MessageAuthor(roomID, messageID string) (string, error) {
+	id, err := uuid.Parse(messageID)
+	if err != nil {
+		return "", chatrooms.ErrUnknownMessage
+	}
+	message, err := m.MessagesDB.GetByID(id)
+	if err != nil {
+		return "", err
+	}
+	if message.ID == uuid.Nil {
+		// broadcast before it is stored, the message is in the history of the room already
+		return m.cachedAuthor(roomID, messageID)
+	}
+	if message.DeletedAt.Valid || message.Chatroom != roomID {
+		return "", chatrooms.ErrUnknownMessage
+	}
+	return message.UserID.String(), nil
+}
+
+// cachedAuthor returns the author of a message of the cached history of the room.
+func (m *MessagesMgr) cachedAuthor(roomID, messageID string) (string, error) {
+	cached, err := m.History.Replay(roomID)
+	if err != nil {
+		return "", err
+	}
+	for _, msg := range cached {
+		if msg.ID == messageID && msg.UserID != "" {
+			return msg.UserID, nil
+		}
+	}
+	return "", chatrooms.ErrUnknownMessage
+}
+
+// ListThread returns a message and a page of its replies, oldest first, starting after the given cursor.
+// The thread of a reply is the one of its parent.
+func (m *MessagesMgr) ListThread(userID, messageID uuid.UUID, after string, limit int) (api.ThreadResponse, *api.APIError) {
+	var cursor *db.MessageCursor
+	if after != "" {
+		decoded, err := decodeCursor(after)
+		if err != nil {
+			return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: err.Error()}
+		}
+		cursor = &decoded
+	}
+
+	message, err := m.MessagesDB.GetByID(messageID)
+	if err != nil {
+		return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if message.ParentID != nil {
+		if message, err = m.MessagesDB.GetByID(*message.ParentID); err != nil {
+			return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+	}
+	if message.ID == uuid.Nil || message.DeletedAt.Valid {
+		return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+	if apiErr := m.Rooms.CheckAccess(userID, message.Chatroom); apiErr != nil {
+		return api.ThreadResponse{}, apiErr
+	}
+
+	author, err := m.UsersDB.GetByID(message.UserID)
+	if err != nil {
+		return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	replies, err := m.MessagesDB.ListReplies(message.ID, cursor, limit)
+	if err != nil {
+		return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	rows := append([]db.MessageWithAuthor{{Message: message, Nickname: author.Nickname}}, replies...)
+	messages, err := m.toResponses(rows)
+	if err != nil {
+		return api.ThreadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	thread := api.ThreadResponse{Parent: messages[0], Replies: messages[1:]}
+	if len(replies) == limit {
+		last := replies[len(replies)-1]
+		thread.NextCursor = encodeCursor(db.MessageCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	return thread, nil
+}
+
+// ThreadReply describes the thread a stored reply belongs to, with the users to notify about it.
+func (m *MessagesMgr) ThreadReply(reply db.Message, username string) (chatrooms.ThreadPayload, error) {
+	stats, err := m.MessagesDB.GetThreadStats([]uuid.UUID{*reply.ParentID})
+	if err != nil {
+		return chatrooms.ThreadPayload{}, err
+	}
+	participants, err := m.MessagesDB.ListThreadParticipants(*reply.ParentID)
+	if err != nil {
+		return chatrooms.ThreadPayload{}, err
+	}
+
+	thread := chatrooms.ThreadPayload{
+		ParentID:    reply.ParentID.String(),
+		MessageID:   reply.ID.String(),
+		Room:        reply.Chatroom,
+		UserID:      reply.UserID.String(),
+		Username:    username,
+		LastReplyAt: reply.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if len(stats) == 1 {
+		thread.ReplyCount = stats[0].ReplyCount
+		thread.LastReplyAt = stats[0].LastReplyAt.UTC().Format(time.RFC3339)
+	}
+	for _, participant := range participants {
+		thread.Participants = append(thread.Participants, participant.String())
+	}
+	return thread, nil
+}
+
+// AddReaction stores the reaction to a message of the room and reports whether it is new.
+func (m *MessagesMgr) AddReaction(reaction chatrooms.ReactionPayload) (bool, error) {
+	row, err := m.reactionOf(reaction)
+	if err != nil {
+		return false, err
+	}
+	return m.ReactionsDB.Add(row)
+}
+
+// RemoveReaction deletes the reaction to a message of the room and reports whether there was one.
+func (m *MessagesMgr) RemoveReaction(reaction chatrooms.ReactionPayload) (bool, error) {
+	row, err := m.reactionOf(reaction)
+	if err != nil {
+		return false, err
+	}
+	return m.ReactionsDB.Remove(row)
+}
+
+// reactionOf checks the reaction is to a message of its room that was not deleted.
+func (m *MessagesMgr) reactionOf(reaction chatrooms.ReactionPayload) (db.Reaction, error) {
+	messageID, err := uuid.Parse(reaction.MessageID)
+	if err != nil {
+		return db.Reaction{}, chatrooms.ErrUnknownMessage
+	}
+	userID, err := uuid.Parse(reaction.UserID)
+	if err != nil {
+		return db.Reaction{}, err
+	}
+	message, err := m.MessagesDB.GetByID(messageID)
+	if err != nil {
+		return db.Reaction{}, err
+	}
+	if message.ID == uuid.Nil || message.DeletedAt.Valid || message.Chatroom != reaction.Room {
+		return db.Reaction{}, chatrooms.ErrUnknownMessage
+	}
+	return db.Reaction{MessageID: messageID, UserID: userID, Emoji: reaction.Emoji}, nil
+}
+
+// EditMsg replaces the body of a message and updates the clients connected to its room.
+func (m *MessagesMgr) EditMsg(userID, messageID uuid.UUID, body api.EditMessageRequest) (api.MessageResponse, *api.APIError) {
+	if _, apiErr := m.getChangeable(userID, messageID); apiErr != nil {
+		return api.MessageResponse{}, apiErr
+	}
+
+	edited, err := m.MessagesDB.Edit(messageID, userID, body.Body)
+	if err != nil {
+		return api.MessageResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if edited.ID == uuid.Nil {
+		// deleted meanwhile
+		return api.MessageResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+
+	editedAt := edited.EditedAt.UTC().Format(time.RFC3339)
+	if err := m.History.Edit(edited.Chatroom, edited.ID.String(), edited.Body, editedAt); err != nil {
+		log.Error().Err(err).Msgf("error editing message %s in the history of room %s", edited.ID, edited.Chatroom)
+	}
+	err = m.publishEvent(events.TypeMessageEdited, edited.Chatroom, chatrooms.EditPayload{
+		ID:       edited.ID.String(),
+		Room:     edited.Chatroom,
+		Text:     edited.Body,
+		EditedAt: editedAt,
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("error publishing the edit of message %s", edited.ID)
+	}
+
+	log.Info().Msgf("message %s edited by user %s", edited.ID, userID)
+	author, err := m.UsersDB.GetByID(edited.UserID)
+	if err != nil {
+		log.Error().Err(err).Msgf("error getting author of message %s", edited.ID)
+	}
+	messages, err := m.toResponses([]db.MessageWithAuthor{{Message: edited, Nickname: author.Nickname}})
+	if err != nil {
+		return api.MessageResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	return messages[0], nil
+}
+
+// DeleteMsg deletes a message and removes it from the clients connected to its room.
+func (m *MessagesMgr) DeleteMsg(userID, messageID uuid.UUID) *api.APIError {
+	if _, apiErr := m.getChangeable(userID, messageID); apiErr != nil {
+		return apiErr
+	}
+
+	deleted, err := m.MessagesDB.Delete(messageID, userID)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if deleted.ID == uuid.Nil {
+		return &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+
+	if err := m.History.Remove(deleted.Chatroom, deleted.ID.String()); err != nil {
+		log.Error().Err(err).Msgf("error removing message %s from the history of room %s", deleted.ID, deleted.Chatroom)
+	}
+	if err := m.Unread.Forget(deleted.Chatroom); err != nil {
+		log.Error().Err(err).Msgf("error forgetting the unread counts of room %s", deleted.Chatroom)
+	}
+	err = m.publishEvent(events.TypeMessageDeleted, deleted.Chatroom, chatrooms.DeletePayload{
+		ID:        deleted.ID.String(),
+		Room:      deleted.Chatroom,
+		DeletedAt: time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		log.Error().Err(err).Msgf("error publishing the deletion of message %s", deleted.ID)
+	}
+
+	log.Info().Msgf("message %s deleted by user %s", deleted.ID, userID)
+	return nil
+}
+
+// ListEdits returns the edit history of a message, oldest first, to the moderators of its room.
+func (m *MessagesMgr) ListEdits(userID, messageID uuid.UUID) ([]api.MessageEditResponse, *api.APIError) {
+	message, err := m.MessagesDB.GetByID(messageID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if message.ID == uuid.Nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+	moderator, apiErr := m.Rooms.CanModerate(userID, message.Chatroom)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	if !moderator {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notRoomModeratorMsg}
+	}
+
+	rows, err := m.MessagesDB.ListEdits(messageID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	edits := make([]api.MessageEditResponse, 0, len(rows))
+	for _, row := range rows {
+		edits = append(edits, api.MessageEditResponse{
+			ID:           row.ID,
+			EditorID:     row.EditorID,
+			Action:       row.Action,
+			PreviousBody: row.PreviousBody,
+			CreatedAt:    row.CreatedAt,
+		})
+	}
+	return edits, nil
+}
+
+// getChangeable returns the message when it exists and the user, who can still see its room, may edit
+// or delete it.
+func (m *MessagesMgr) getChangeable(userID, messageID uuid.UUID) (db.Message, *api.APIError) {
+	message, err := m.MessagesDB.GetByID(messageID)
+	if err != nil {
+		return db.Message{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if message.ID == uuid.Nil || message.DeletedAt.Valid {
+		return db.Message{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+	if apiErr := m.Rooms.CheckAccess(userID, message.Chatroom); apiErr != nil {
+		return db.Message{}, apiErr
+	}
+	moderator, apiErr := m.Rooms.CanModerate(userID, message.Chatroom)
+	if apiErr != nil {
+		return db.Message{}, apiErr
+	}
+	if !mayChange(message, userID, moderator) {
+		return db.Message{}, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notAuthorMsg}
+	}
+	return message, nil
+}
+
+// mayChange lets the authors change their own messages and the room moderators any message of the room.
+func mayChange(message db.Message, userID uuid.UUID, moderator bool) bool {
+	return moderator || message.UserID == userID
+}
+
+// publishEvent tells the connected clients of the room about the change.
+func (m *MessagesMgr) publishEvent(eventType, roomID string, payload interface{}) error {
+	envelope, err := events.NewEnvelope(eventType, eventSource, payload)
+	if err != nil {
+		return err
+	}
+	body, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	return m.Events.PublishEvent(chatrooms.EventsExchangeName, roomID, body)
+}
+
+func encodeCursor(cursor db.MessageCursor) string {
+	raw := cursor.CreatedAt.UTC().Format(time.RFC3339Nano) + cursorSeparator + cursor.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (db.MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return db.MessageCursor{}, errInvalidCursor
+	}
+	parts := strings.SplitN(string(raw), cursorSeparator, 2)
+	if len(parts) != 2 {
+		return db.MessageCursor{}, errInvalidCursor
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return db.MessageCursor{}, errInvalidCursor
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return db.MessageCursor{}, errInvalidCursor
+	}
+	return db.MessageCursor{CreatedAt: createdAt, ID: id}, nil
 }
@@ -0,0 +1,62 @@
+package messages
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-chat/db"
+)
+
+func TestCursor_RoundTrip(t *testing.T) {
+	want := db.MessageCursor{CreatedAt: time.Date(2022, 8, 14, 10, 30, 0, 123456000, time.UTC), ID: uuid.New()}
+
+	got, err := decodeCursor(encodeCursor(want))
+	if err != nil {
+		t.Fatalf("decodeCursor() error = %v", err)
+	}
+	if !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID {
+		t.Errorf("decodeCursor() = %v, want %v", got, want)
+	}
+}
+
+func TestDecodeCursor_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{name: "Decode cursor - Not base64", cursor: "***"},
+		{name: "Decode cursor - Missing separator", cursor: "bm8tc2VwYXJhdG9y"},
+		{name: "Decode cursor - Invalid id", cursor: encodeCursor(db.MessageCursor{CreatedAt: time.Now()})[:10]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor); err == nil {
+				t.Errorf("decodeCursor(%q) expected error", tt.cursor)
+			}
+		})
+	}
+}
+
+func TestMayChange(t *testing.T) {
+	author, other := uuid.New(), uuid.New()
+	message := db.Message{ID: uuid.New(), UserID: author}
+	tests := []struct {
+		name      string
+		userID    uuid.UUID
+		moderator bool
+		want      bool
+	}{
+		{name: "May change - Author", userID: author, want: true},
+		{name: "May change - Moderator", userID: other, moderator: true, want: true},
+		{name: "May change - Other member", userID: other, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mayChange(message, tt.userID, tt.moderator); got != tt.want {
+				t.Errorf("mayChange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package messages
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"go-chat/api"
+	"go-chat/chatrooms"
+	"go-chat/db"
+)
+
+// maxMentions is the number of users a message notifies at most, the other mentions stay plain text.
+const maxMentions = 20
+
+// mentionPattern matches @nickname at the start of the text or after a character that cannot be
+// part of a word, so email addresses are not mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])@([\p{L}\p{N}_.\-]+)`)
+
+// parseMentions returns the nicknames mentioned in the text, once each and in order.
+func parseMentions(text string) []string {
+	var nicknames []string
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		// trailing punctuation ends the sentence, not the nickname
+		nickname := strings.TrimRight(match[1], ".-")
+		if nickname == "" || seen[nickname] {
+			continue
+		}
+		seen[nickname] = true
+		nicknames = append(nicknames, nickname)
+		if len(nicknames) == maxMentions {
+			break
+		}
+	}
+	return nicknames
+}
+
+// SaveMentions stores the users mentioned by a stored message and returns the notifications of
+// the new mentions. Unknown nicknames, the author and the users who cannot see the room are left out.
+func (m *MessagesMgr) SaveMentions(message db.Message, author string) ([]chatrooms.MentionPayload, error) {
+	var rows []db.Mention
+	for _, nickname := range parseMentions(message.Body) {
+		user, err := m.UsersDB.GetByNickName(nickname)
+		if err != nil {
+			return nil, err
+		}
+		if user.ID == uuid.Nil || user.ID == message.UserID {
+			continue
+		}
+		if apiErr := m.Rooms.CheckAccess(user.ID, message.Chatroom); apiErr != nil {
+			if apiErr.HTTPStatusCode == http.StatusInternalServerError {
+				return nil, apiErr
+			}
+			continue
+		}
+		rows = append(rows, db.Mention{MessageID: message.ID, UserID: user.ID})
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	created, err := m.MentionsDB.Add(rows)
+	if err != nil {
+		return nil, err
+	}
+	mentions := make([]chatrooms.MentionPayload, 0, len(created))
+	for _, mention := range created {
+		mentions = append(mentions, chatrooms.MentionPayload{
+			MessageID: message.ID.String(),
+			Room:      message.Chatroom,
+			UserID:    mention.UserID.String(),
+			AuthorID:  message.UserID.String(),
+			Author:    author,
+			Text:      message.Body,
+			Timestamp: message.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return mentions, nil
+}
+
+// ListMentions returns the latest unread mentions of the user, newest first.
+func (m *MessagesMgr) ListMentions(userID uuid.UUID, limit int) ([]api.MentionResponse, *api.APIError) {
+	rows, err := m.MentionsDB.ListUnread(userID, limit)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	mentions := make([]api.MentionResponse, 0, len(rows))
+	for _, row := range rows {
+		mentions = append(mentions, api.MentionResponse{
+			Message: api.MessageResponse{
+				ID:        row.ID,
+				UserID:    row.UserID,
+				NickName:  row.Nickname,
+				Body:      row.Body,
+				Chatroom:  row.Chatroom,
+				ParentID:  row.ParentID,
+				CreatedAt: row.CreatedAt,
+				EditedAt:  row.EditedAt,
+			},
+			MentionedAt: row.MentionedAt,
+		})
+	}
+	return mentions, nil
+}
+
+// MarkMentionsRead marks the given mentions of the user as read, all of them when none is given.
+func (m *MessagesMgr) MarkMentionsRead(userID uuid.UUID, body api.MarkMentionsReadRequest) (api.MarkMentionsReadResponse, *api.APIError) {
+	marked, err := m.MentionsDB.MarkRead(userID, body.MessageIDs)
+	if err != nil {
+		return api.MarkMentionsReadResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	return api.MarkMentionsReadResponse{Marked: marked}, nil
+}
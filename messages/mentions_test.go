@@ -0,0 +1,40 @@
+package messages
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{name: "Parse mentions - Start of text", text: "@alice hi", want: []string{"alice"}},
+		{name: "Parse mentions - Several", text: "hi @alice and @bob.", want: []string{"alice", "bob"}},
+		{name: "Parse mentions - Repeated", text: "@alice, @alice!", want: []string{"alice"}},
+		{name: "Parse mentions - Dotted nickname", text: "ping (@jo.doe)", want: []string{"jo.doe"}},
+		{name: "Parse mentions - Email address", text: "write to alice@example.com", want: nil},
+		{name: "Parse mentions - Bare at sign", text: "meet @ noon or @@bob", want: nil},
+		{name: "Parse mentions - Plain text", text: "hello", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseMentions(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMentions(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMentions_Capped(t *testing.T) {
+	var text strings.Builder
+	for i := 0; i < maxMentions+5; i++ {
+		text.WriteString("@user" + strings.Repeat("x", i) + " ")
+	}
+	if got := parseMentions(text.String()); len(got) != maxMentions {
+		t.Errorf("parseMentions() returned %d nicknames, want %d", len(got), maxMentions)
+	}
+}
@@ -1,68 +1,202 @@
 package messages
 
 import (
-	"encoding/json"
+	"time"
 
-	rabbit "github.com/rabbitmq/amqp091-go"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 
-	"go-chat/bot"
 	"go-chat/chatrooms"
+	"go-chat/commands"
+	"go-chat/db"
+	"go-chat/events"
 )
 
-const messagesChannelName = "chat-channel"
+const (
+	eventSource = "messages"
+	botUsername = "Bot"
+)
 
 type (
 	Processor struct {
-		BotMgr      *bot.BotMgr
+		Commands    *commands.Registry
 		MessagesMgr *MessagesMgr
-		publisher   publisher
+		broker      broker
 	}
-	publisher interface {
-		Consume(channelName string) (<-chan rabbit.Delivery, error)
+	broker interface {
+		PublishEvent(exchange, routingKey string, body []byte) error
+		Consume(queue string, handle events.Handler) error
 	}
 )
 
-func NewProcessor(msgMgr *MessagesMgr, botMgr *bot.BotMgr, publisher publisher) *Processor {
+func NewProcessor(msgMgr *MessagesMgr, registry *commands.Registry, broker broker) *Processor {
 	return &Processor{
-		BotMgr:      botMgr,
+		Commands:    registry,
 		MessagesMgr: msgMgr,
-		publisher:   publisher,
+		broker:      broker,
 	}
 }
 
-func (p *Processor) WaitForQueueMsgs() {
-	msgs, err := p.publisher.Consume(messagesChannelName)
+// WaitForQueueMsgs starts handling the messages sent by the chatrooms.
+func (p *Processor) WaitForQueueMsgs() error {
+	log.Info().Msg("Waiting for new messages in message processor")
+	return p.broker.Consume(chatrooms.MessagesChannelName, p.handle)
+}
+
+// handle stores a chat message or runs a command, settling the message once done.
+func (p *Processor) handle(msg events.Message) {
+	log.Printf("Channel: %s - Received a message: %s", chatrooms.MessagesChannelName, msg.Body)
+	envelope, err := events.Decode(msg.Body)
 	if err != nil {
-		log.Error().Err(err)
+		log.Error().Err(err).Msg("failed decoding message")
+		p.settle(msg.Reject())
+		return
+	}
+	if envelope.Type != events.TypeMessageCreated {
+		log.Error().Msgf("unexpected event %s of type %s", envelope.ID, envelope.Type)
+		p.settle(msg.Reject())
+		return
+	}
+	var chatMessage chatrooms.ChatMessage
+	if err := envelope.DecodePayload(&chatMessage); err != nil {
+		log.Error().Err(err).Msg("failed unmarshalling message")
+		p.settle(msg.Reject())
+		return
 	}
 
-	var chatChannel chan struct{}
-
-	go func() {
-		for d := range msgs {
-			log.Printf("Channel: %s - Received a message: %s", messagesChannelName, d.Body)
-			var chatMessage chatrooms.ChatMessage
-			err := json.Unmarshal(d.Body, &chatMessage)
-			if err != nil {
-				log.Error().Err(err).Msg("failed unmarshalling message")
-			}
-			if chatMessage.IsStockCommand() {
-				log.Info().Msg("Calling bot manager")
-				err := p.BotMgr.GetAndPublishStockPrice(chatMessage)
-				if err != nil {
-					log.Error().Err(err)
-				}
-
-			} else {
-				log.Info().Msg("Calling msg manager")
-				p.MessagesMgr.SaveMsg(chatMessage)
+	if chatMessage.IsCommand() {
+		log.Info().Msg("Dispatching command")
+		p.Commands.Dispatch(chatMessage.Text, func(reply commands.Reply) {
+			if err := p.publishReply(envelope.ID.String(), chatMessage, reply); err != nil {
+				log.Error().Err(err).Msg("error publishing command reply")
+				p.settle(msg.Retry(err))
+				return
 			}
+			p.settle(msg.Ack())
+		})
+		return
+	}
 
+	log.Info().Msg("Calling msg manager")
+	stored, created, err := p.MessagesMgr.SaveMsg(chatMessage)
+	if err != nil {
+		log.Error().Err(err).Msg("error saving message")
+		p.settle(msg.Retry(err))
+		return
+	}
+	// only the delivery that stored the message counts it, not the redeliveries
+	if created {
+		if err := p.MessagesMgr.Unread.Increment(stored.Chatroom, stored.UserID.String()); err != nil {
+			log.Error().Err(err).Msgf("error counting message %s as unread", stored.ID)
 		}
-	}()
-	log.Info().Msg("Waiting for new messages in message processor")
-	<-chatChannel
+	}
+	// saving again is a no-op, so a failed notification is retried with the whole message
+	if err := p.publishPersisted(envelope.ID.String(), chatMessage, stored); err != nil {
+		log.Error().Err(err).Msg("error publishing persisted message")
+		p.settle(msg.Retry(err))
+		return
+	}
+	if stored.DeletedAt.Valid {
+		// a redelivery of a message deleted since, nobody is notified of it again
+		p.settle(msg.Ack())
+		return
+	}
+	if stored.ParentID != nil {
+		if err := p.publishThreadReply(stored, chatMessage.Username); err != nil {
+			// the reply reached the room already, only the notification is lost
+			log.Error().Err(err).Msgf("error notifying the thread of message %s", stored.ID)
+		}
+	}
+	if err := p.publishMentions(stored, chatMessage.Username); err != nil {
+		log.Error().Err(err).Msgf("error notifying the users mentioned by message %s", stored.ID)
+	}
+	p.settle(msg.Ack())
+}
+
+// publishPersisted tells the sender the message was stored, with the ID and timestamp it was stored with.
+func (p *Processor) publishPersisted(messageID string, chatMessage chatrooms.ChatMessage, stored db.Message) error {
+	chatMessage.ID = stored.ID.String()
+	chatMessage.Timestamp = stored.CreatedAt.UTC().Format(time.RFC3339Nano)
+	envelope, err := events.NewEnvelope(events.TypeMessagePersisted, eventSource, chatMessage)
+	if err != nil {
+		return err
+	}
+	envelope.CorrelationID = messageID
+	body, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	return p.broker.PublishEvent(chatrooms.EventsExchangeName, chatMessage.Room, body)
+}
+
+// publishThreadReply notifies the participants of the thread the stored message replies to.
+func (p *Processor) publishThreadReply(stored db.Message, username string) error {
+	thread, err := p.MessagesMgr.ThreadReply(stored, username)
+	if err != nil {
+		return err
+	}
+	envelope, err := events.NewEnvelope(events.TypeThreadReplied, eventSource, thread)
+	if err != nil {
+		return err
+	}
+	body, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	return p.broker.PublishEvent(chatrooms.EventsExchangeName, thread.Room, body)
+}
+
+// publishMentions stores the users mentioned by the stored message and notifies them wherever they are connected.
+func (p *Processor) publishMentions(stored db.Message, username string) error {
+	mentions, err := p.MessagesMgr.SaveMentions(stored, username)
+	if err != nil {
+		return err
+	}
+	for _, mention := range mentions {
+		envelope, err := events.NewEnvelope(events.TypeMentioned, eventSource, mention)
+		if err != nil {
+			return err
+		}
+		body, err := envelope.Encode()
+		if err != nil {
+			return err
+		}
+		if err := p.broker.PublishEvent(chatrooms.EventsExchangeName, chatrooms.UserKey(mention.UserID), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishReply sends the command reply to the room, or only to the sender when it is private.
+func (p *Processor) publishReply(commandID string, cmdMsg chatrooms.ChatMessage, reply commands.Reply) error {
+	replyMsg := chatrooms.ChatMessage{
+		ID:        uuid.New().String(),
+		Username:  botUsername,
+		Text:      reply.Text,
+		Room:      cmdMsg.Room,
+		Timestamp: cmdMsg.Timestamp,
+	}
+	if reply.Private {
+		replyMsg.Recipient = cmdMsg.UserID
+	}
+	envelope, err := events.NewEnvelope(events.TypeBotReply, eventSource, replyMsg)
+	if err != nil {
+		return err
+	}
+	envelope.CorrelationID = commandID
+	body, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	return p.broker.PublishEvent(chatrooms.EventsExchangeName, replyMsg.Room, body)
+}
+
+// settle logs a message that could not be acknowledged; the broker redelivers it.
+func (p *Processor) settle(err error) {
+	if err != nil {
+		log.Error().Err(err).Msg("error settling delivery")
+	}
 }
 
 func failOnError(err error, msg string) {
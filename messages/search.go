@@ -0,0 +1,52 @@
+package messages
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"go-chat/api"
+	"go-chat/db"
+)
+
+// Search returns a page of the messages matching the search, newest first, out of the rooms the user can see.
+func (m *MessagesMgr) Search(userID uuid.UUID, body api.SearchRequest, limit int) (api.SearchResponse, *api.APIError) {
+	var cursor *db.MessageCursor
+	if body.Before != "" {
+		decoded, err := decodeCursor(body.Before)
+		if err != nil {
+			return api.SearchResponse{}, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: err.Error()}
+		}
+		cursor = &decoded
+	}
+	if body.Room != "" {
+		if apiErr := m.Rooms.CheckAccess(userID, body.Room); apiErr != nil {
+			return api.SearchResponse{}, apiErr
+		}
+	}
+
+	search := db.MessageSearch{Text: body.Text, Room: body.Room, From: body.From}
+	rows, err := m.MessagesDB.Search(userID, search, cursor, limit)
+	if err != nil {
+		return api.SearchResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	matches := make([]db.MessageWithAuthor, 0, len(rows))
+	for _, row := range rows {
+		matches = append(matches, row.MessageWithAuthor)
+	}
+	messages, err := m.toResponses(matches)
+	if err != nil {
+		return api.SearchResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	page := api.SearchResponse{Results: make([]api.SearchResultResponse, 0, len(rows))}
+	for i, row := range rows {
+		page.Results = append(page.Results, api.SearchResultResponse{Message: messages[i], Snippet: row.Snippet})
+	}
+	if len(rows) == limit {
+		last := rows[len(rows)-1]
+		page.NextCursor = encodeCursor(db.MessageCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	return page, nil
+}
@@ -0,0 +1,268 @@
+package rooms
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+
+	"go-chat/api"
+	"go-chat/auth"
+)
+
+type response struct {
+	Message string `json:"message,omitempty"`
+}
+
+type Handler struct {
+	RoomsMgr interface {
+		Create(ownerID uuid.UUID, body api.CreateRoomRequest) (api.RoomResponse, *api.APIError)
+		List(userID uuid.UUID) ([]api.RoomResponse, *api.APIError)
+		Get(userID uuid.UUID, roomID string) (api.RoomResponse, *api.APIError)
+		Update(userID uuid.UUID, roomID string, body api.UpdateRoomRequest) (api.RoomResponse, *api.APIError)
+		Delete(userID uuid.UUID, roomID string) *api.APIError
+		Invite(inviterID uuid.UUID, roomID string, body api.InviteRequest) *api.APIError
+		Join(userID uuid.UUID, roomID string) (api.MemberResponse, *api.APIError)
+		Leave(userID uuid.UUID, roomID string) *api.APIError
+		ListMembers(userID uuid.UUID, roomID string) ([]api.MemberResponse, *api.APIError)
+		ListOnline(userID uuid.UUID, roomID string) ([]api.OnlineMemberResponse, *api.APIError)
+		UpdateMember(ownerID uuid.UUID, roomID string, memberID uuid.UUID, body api.UpdateMemberRequest) (api.MemberResponse, *api.APIError)
+		RemoveMember(actorID uuid.UUID, roomID string, memberID uuid.UUID) *api.APIError
+		OpenDirect(userID uuid.UUID, body api.OpenDirectRequest) (api.DirectResponse, bool, *api.APIError)
+		ListDirect(userID uuid.UUID) ([]api.DirectResponse, *api.APIError)
+		ListMine(userID uuid.UUID) ([]api.MyRoomResponse, *api.APIError)
+		MarkRead(userID uuid.UUID, roomID string, body api.MarkReadRequest) (api.ReadMarkerResponse, *api.APIError)
+	}
+}
+
+// Create - creates a room owned by the caller
+func (h Handler) Create(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var createRoomRequest api.CreateRoomRequest
+	if err := c.Bind(&createRoomRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := createRoomRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	room, err := h.RoomsMgr.Create(identity.UserID, createRoomRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusCreated, room)
+}
+
+// List - lists the rooms visible to the caller
+func (h Handler) List(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	rooms, err := h.RoomsMgr.List(identity.UserID)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, rooms)
+}
+
+// Get - returns a room
+func (h Handler) Get(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	room, err := h.RoomsMgr.Get(identity.UserID, c.Param("id"))
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, room)
+}
+
+// Update - changes the title, topic or visibility of a room
+func (h Handler) Update(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var updateRoomRequest api.UpdateRoomRequest
+	if err := c.Bind(&updateRoomRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := updateRoomRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	room, err := h.RoomsMgr.Update(identity.UserID, c.Param("id"), updateRoomRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, room)
+}
+
+// Delete - removes a room
+func (h Handler) Delete(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	if err := h.RoomsMgr.Delete(identity.UserID, c.Param("id")); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Invite - invites a user to the room
+func (h Handler) Invite(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var inviteRequest api.InviteRequest
+	if err := c.Bind(&inviteRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := inviteRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	if err := h.RoomsMgr.Invite(identity.UserID, c.Param("id"), inviteRequest); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Join - makes the caller a member of the room
+func (h Handler) Join(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	member, err := h.RoomsMgr.Join(identity.UserID, c.Param("id"))
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, member)
+}
+
+// Leave - removes the caller from the room
+func (h Handler) Leave(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	if err := h.RoomsMgr.Leave(identity.UserID, c.Param("id")); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListMembers - lists the members of the room
+func (h Handler) ListMembers(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	members, err := h.RoomsMgr.ListMembers(identity.UserID, c.Param("id"))
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, members)
+}
+
+// ListOnline - lists the users connected to the room
+func (h Handler) ListOnline(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	members, err := h.RoomsMgr.ListOnline(identity.UserID, c.Param("id"))
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, members)
+}
+
+// UpdateMember - changes the role of a member
+func (h Handler) UpdateMember(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	memberID, parseErr := uuid.Parse(c.Param("user_id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+	var updateMemberRequest api.UpdateMemberRequest
+	if err := c.Bind(&updateMemberRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := updateMemberRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	member, err := h.RoomsMgr.UpdateMember(identity.UserID, c.Param("id"), memberID, updateMemberRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, member)
+}
+
+// RemoveMember - removes a member from the room
+func (h Handler) RemoveMember(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	memberID, parseErr := uuid.Parse(c.Param("user_id"))
+	if parseErr != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: parseErr.Error()})
+	}
+
+	if err := h.RoomsMgr.RemoveMember(identity.UserID, c.Param("id"), memberID); err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// OpenDirect - returns the direct conversation between the caller and the given users, opening it if needed
+func (h Handler) OpenDirect(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var openDirectRequest api.OpenDirectRequest
+	if err := c.Bind(&openDirectRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := openDirectRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	direct, created, err := h.RoomsMgr.OpenDirect(identity.UserID, openDirectRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	if created {
+		return c.JSON(http.StatusCreated, direct)
+	}
+	return c.JSON(http.StatusOK, direct)
+}
+
+// ListDirect - lists the direct conversations of the caller
+func (h Handler) ListDirect(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	directs, err := h.RoomsMgr.ListDirect(identity.UserID)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, directs)
+}
+
+// ListMine - lists the rooms of the caller with their unread counts
+func (h Handler) ListMine(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	rooms, err := h.RoomsMgr.ListMine(identity.UserID)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, rooms)
+}
+
+// MarkRead - moves the read marker of the caller in the room up to a message
+func (h Handler) MarkRead(c echo.Context) error {
+	identity, _ := auth.FromContext(c)
+	var markReadRequest api.MarkReadRequest
+	if err := c.Bind(&markReadRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+	if err := markReadRequest.Check(); err != nil {
+		return c.JSON(http.StatusBadRequest, response{Message: err.Error()})
+	}
+
+	marker, err := h.RoomsMgr.MarkRead(identity.UserID, c.Param("id"), markReadRequest)
+	if err != nil {
+		return c.JSON(err.HTTPStatusCode, err)
+	}
+
+	return c.JSON(http.StatusOK, marker)
+}
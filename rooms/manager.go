@@ -0,0 +1,560 @@
+package rooms
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"go-chat/api"
+	"go-chat/chatrooms"
+	"go-chat/db"
+	"go-chat/events"
+)
+
+const (
+	roomNotExistMsg      = "room not exists"
+	roomAlreadyExistsMsg = "room already exists"
+	notRoomOwnerMsg      = "only the room owner can do this"
+	notModeratorMsg      = "only the room owner or moderators can do this"
+	userNotExistMsg      = "user not exists"
+	alreadyMemberMsg     = "user is already a member"
+	notInvitedMsg        = "an invitation is required to join this room"
+	ownerCannotLeaveMsg  = "the owner cannot leave the room"
+	memberNotExistMsg    = "member not exists"
+	ownerRoleFixedMsg    = "the owner role cannot be changed"
+	directLeaveMsg       = "a direct conversation cannot be left"
+	directAloneMsg       = "a direct conversation needs another participant"
+
+	maxTitleLength = 256
+)
+
+type (
+	// onlineLister returns the users connected to a room on any instance.
+	onlineLister interface {
+		Online(roomID string) ([]chatrooms.PresenceMember, error)
+	}
+
+	// unreadCache keeps the unread counts of the users, by room.
+	unreadCache interface {
+		Get(userID string, roomIDs []string) (map[string]int64, error)
+		Set(userID string, counts map[string]int64) error
+	}
+
+	eventPublisher interface {
+		PublishEvent(exchange, routingKey string, body []byte) error
+	}
+
+	RoomsMgr struct {
+		RoomsDB       *db.RoomsDB
+		MembersDB     *db.MembersDB
+		ReadMarkersDB *db.ReadMarkersDB
+		UsersDB       *db.UsersDB
+		Presence      onlineLister
+		Unread        unreadCache
+		Events        eventPublisher
+	}
+)
+
+func NewRoomsMgr(roomsDB *db.RoomsDB, membersDB *db.MembersDB, readMarkersDB *db.ReadMarkersDB, usersDB *db.UsersDB, presence onlineLister, unread unreadCache, events eventPublisher) *RoomsMgr {
+	return &RoomsMgr{
+		RoomsDB:       roomsDB,
+		MembersDB:     membersDB,
+		ReadMarkersDB: readMarkersDB,
+		UsersDB:       usersDB,
+		Presence:      presence,
+		Unread:        unread,
+		Events:        events,
+	}
+}
+
+func (m *RoomsMgr) Create(ownerID uuid.UUID, body api.CreateRoomRequest) (api.RoomResponse, *api.APIError) {
+	dbRoom, err := m.RoomsDB.GetByID(body.ID)
+	if err != nil {
+		return api.RoomResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if dbRoom.ID != "" {
+		return api.RoomResponse{}, &api.APIError{HTTPStatusCode: http.StatusConflict, Msg: roomAlreadyExistsMsg}
+	}
+
+	room := db.Room{
+		ID:         body.ID,
+		OwnerID:    &ownerID,
+		Title:      body.Title,
+		Topic:      body.Topic,
+		Visibility: body.Visibility,
+	}
+	if room.Visibility == "" {
+		room.Visibility = db.VisibilityPublic
+	}
+	if _, err := m.RoomsDB.Create(room); err != nil {
+		return api.RoomResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	log.Info().Msgf("room %s created", room.ID)
+	return m.Get(ownerID, room.ID)
+}
+
+func (m *RoomsMgr) List(userID uuid.UUID) ([]api.RoomResponse, *api.APIError) {
+	dbRooms, err := m.RoomsDB.ListVisible(userID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	rooms := make([]api.RoomResponse, 0, len(dbRooms))
+	for _, room := range dbRooms {
+		rooms = append(rooms, toResponse(room))
+	}
+	return rooms, nil
+}
+
+func (m *RoomsMgr) Get(userID uuid.UUID, roomID string) (api.RoomResponse, *api.APIError) {
+	room, _, apiErr := m.getVisible(userID, roomID)
+	if apiErr != nil {
+		return api.RoomResponse{}, apiErr
+	}
+	return toResponse(room), nil
+}
+
+func (m *RoomsMgr) Update(userID uuid.UUID, roomID string, body api.UpdateRoomRequest) (api.RoomResponse, *api.APIError) {
+	room, _, apiErr := m.requireRole(userID, roomID, db.RoleOwner)
+	if apiErr != nil {
+		return api.RoomResponse{}, apiErr
+	}
+
+	fields := map[string]interface{}{}
+	if body.Title != nil {
+		fields["title"] = *body.Title
+	}
+	if body.Topic != nil {
+		fields["topic"] = *body.Topic
+	}
+	if body.Visibility != nil {
+		fields["visibility"] = *body.Visibility
+	}
+	if len(fields) > 0 {
+		if err := m.RoomsDB.Update(roomID, fields); err != nil {
+			return api.RoomResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+	}
+
+	if body.Visibility != nil && *body.Visibility == db.VisibilityPrivate && room.Visibility != db.VisibilityPrivate {
+		m.evictNonMembers(roomID)
+	}
+
+	return m.Get(userID, roomID)
+}
+
+func (m *RoomsMgr) Delete(userID uuid.UUID, roomID string) *api.APIError {
+	if _, _, apiErr := m.requireRole(userID, roomID, db.RoleOwner); apiErr != nil {
+		return apiErr
+	}
+	if err := m.RoomsDB.Delete(roomID); err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	m.evict(chatrooms.Eviction{Room: roomID})
+
+	log.Info().Msgf("room %s deleted", roomID)
+	return nil
+}
+
+// CheckAccess allows everybody into public rooms and only members into private ones.
+func (m *RoomsMgr) CheckAccess(userID uuid.UUID, roomID string) *api.APIError {
+	_, _, apiErr := m.getVisible(userID, roomID)
+	return apiErr
+}
+
+// CanModerate reports whether the user moderates the room, i.e. is its owner or one of its moderators.
+func (m *RoomsMgr) CanModerate(userID uuid.UUID, roomID string) (bool, *api.APIError) {
+	_, member, apiErr := m.getVisible(userID, roomID)
+	if apiErr != nil {
+		return false, apiErr
+	}
+	return member.Role == db.RoleOwner || member.Role == db.RoleModerator, nil
+}
+
+// Invite lets the owner or a moderator invite a user to the room.
+func (m *RoomsMgr) Invite(inviterID uuid.UUID, roomID string, body api.InviteRequest) *api.APIError {
+	if _, _, apiErr := m.requireRole(inviterID, roomID, db.RoleOwner, db.RoleModerator); apiErr != nil {
+		return apiErr
+	}
+
+	user, err := m.UsersDB.GetByNickName(body.NickName)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if user.ID == uuid.Nil {
+		return &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: userNotExistMsg}
+	}
+
+	member, err := m.MembersDB.Get(roomID, user.ID)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if member.Role != "" {
+		return &api.APIError{HTTPStatusCode: http.StatusConflict, Msg: alreadyMemberMsg}
+	}
+
+	err = m.MembersDB.Invite(db.RoomInvitation{RoomID: roomID, UserID: user.ID, InvitedBy: inviterID})
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	log.Info().Msgf("user %s invited to room %s", user.ID, roomID)
+	return nil
+}
+
+// Join makes the user a member of a public room, or of a private room the user was invited to.
+func (m *RoomsMgr) Join(userID uuid.UUID, roomID string) (api.MemberResponse, *api.APIError) {
+	room, err := m.RoomsDB.GetByID(roomID)
+	if err != nil {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if room.ID == "" {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: roomNotExistMsg}
+	}
+
+	if room.Visibility != db.VisibilityPublic {
+		accepted, err := m.MembersDB.AcceptInvitation(roomID, userID)
+		if err != nil {
+			return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+		if !accepted {
+			if member, err := m.MembersDB.Get(roomID, userID); err != nil || member.Role == "" {
+				return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notInvitedMsg}
+			}
+		}
+	} else {
+		if err := m.MembersDB.Add(db.RoomMember{RoomID: roomID, UserID: userID, Role: db.RoleMember}); err != nil {
+			return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+	}
+
+	member, err := m.MembersDB.Get(roomID, userID)
+	if err != nil {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	return toMemberResponse(member, ""), nil
+}
+
+func (m *RoomsMgr) Leave(userID uuid.UUID, roomID string) *api.APIError {
+	room, err := m.RoomsDB.GetByID(roomID)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if room.Visibility == db.VisibilityDirect {
+		return &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: directLeaveMsg}
+	}
+
+	member, err := m.MembersDB.Get(roomID, userID)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if member.Role == "" {
+		return &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: memberNotExistMsg}
+	}
+	if member.Role == db.RoleOwner {
+		return &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: ownerCannotLeaveMsg}
+	}
+
+	return m.removeMember(roomID, userID)
+}
+
+func (m *RoomsMgr) ListMembers(userID uuid.UUID, roomID string) ([]api.MemberResponse, *api.APIError) {
+	if _, _, apiErr := m.getVisible(userID, roomID); apiErr != nil {
+		return nil, apiErr
+	}
+
+	dbMembers, err := m.MembersDB.List(roomID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	members := make([]api.MemberResponse, 0, len(dbMembers))
+	for _, member := range dbMembers {
+		members = append(members, toMemberResponse(member.RoomMember, member.Nickname))
+	}
+	return members, nil
+}
+
+// ListOnline returns the users connected to the room, once whatever the number of their connections.
+func (m *RoomsMgr) ListOnline(userID uuid.UUID, roomID string) ([]api.OnlineMemberResponse, *api.APIError) {
+	if _, _, apiErr := m.getVisible(userID, roomID); apiErr != nil {
+		return nil, apiErr
+	}
+
+	online, err := m.Presence.Online(roomID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	members := make([]api.OnlineMemberResponse, 0, len(online))
+	for _, member := range online {
+		memberID, err := uuid.Parse(member.UserID)
+		if err != nil {
+			continue
+		}
+		members = append(members, api.OnlineMemberResponse{UserID: memberID, NickName: member.Username})
+	}
+	return members, nil
+}
+
+// OpenDirect returns the direct conversation between the user and the named users, opening it the
+// first time. It reports whether the conversation was opened.
+func (m *RoomsMgr) OpenDirect(userID uuid.UUID, body api.OpenDirectRequest) (api.DirectResponse, bool, *api.APIError) {
+	participants := []uuid.UUID{userID}
+	for _, nickname := range body.NickNames {
+		user, err := m.UsersDB.GetByNickName(nickname)
+		if err != nil {
+			return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+		if user.ID == uuid.Nil {
+			return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: userNotExistMsg}
+		}
+		participants = append(participants, user.ID)
+	}
+	key, participants := participantsKey(participants)
+	if len(participants) < 2 {
+		return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: directAloneMsg}
+	}
+
+	room, err := m.RoomsDB.GetDirect(key)
+	if err != nil {
+		return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	created := false
+	if room.ID == "" {
+		room = db.Room{
+			ID:         api.DirectRoomPrefix + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Title:      directTitle(body.NickNames),
+			Visibility: db.VisibilityDirect,
+		}
+		if created, err = m.RoomsDB.CreateDirect(room, key, participants); err != nil {
+			return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+		}
+		if !created {
+			// opened concurrently by another participant
+			if room, err = m.RoomsDB.GetDirect(key); err != nil {
+				return api.DirectResponse{}, false, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+			}
+		}
+	}
+
+	direct, apiErr := m.toDirectResponse(room)
+	if apiErr != nil {
+		return api.DirectResponse{}, false, apiErr
+	}
+	if created {
+		log.Info().Msgf("direct conversation %s opened", room.ID)
+	}
+	return direct, created, nil
+}
+
+// ListDirect returns the direct conversations of the user, the latest first.
+func (m *RoomsMgr) ListDirect(userID uuid.UUID) ([]api.DirectResponse, *api.APIError) {
+	dbRooms, err := m.RoomsDB.ListDirect(userID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	directs := make([]api.DirectResponse, 0, len(dbRooms))
+	for _, room := range dbRooms {
+		direct, apiErr := m.toDirectResponse(room)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		directs = append(directs, direct)
+	}
+	return directs, nil
+}
+
+func (m *RoomsMgr) toDirectResponse(room db.Room) (api.DirectResponse, *api.APIError) {
+	dbMembers, err := m.MembersDB.List(room.ID)
+	if err != nil {
+		return api.DirectResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	direct := api.DirectResponse{
+		ID:           room.ID,
+		Title:        room.Title,
+		Participants: make([]api.ParticipantResponse, 0, len(dbMembers)),
+		CreatedAt:    room.CreatedAt,
+	}
+	for _, member := range dbMembers {
+		direct.Participants = append(direct.Participants, api.ParticipantResponse{UserID: member.UserID, NickName: member.Nickname})
+	}
+	return direct, nil
+}
+
+// participantsKey identifies a set of participants whatever their order, it returns them sorted
+// and without duplicates.
+func participantsKey(participants []uuid.UUID) (string, []uuid.UUID) {
+	ids := make([]string, 0, len(participants))
+	seen := make(map[uuid.UUID]bool, len(participants))
+	for _, participant := range participants {
+		if !seen[participant] {
+			seen[participant] = true
+			ids = append(ids, participant.String())
+		}
+	}
+	sort.Strings(ids)
+
+	unique := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		unique = append(unique, uuid.MustParse(id))
+	}
+	return strings.Join(ids, ","), unique
+}
+
+// directTitle names the conversation after the participants invited by its opener.
+func directTitle(nicknames []string) string {
+	title := []rune(strings.Join(nicknames, ", "))
+	if len(title) > maxTitleLength {
+		title = title[:maxTitleLength]
+	}
+	return string(title)
+}
+
+// UpdateMember lets the owner promote or demote a member.
+func (m *RoomsMgr) UpdateMember(ownerID uuid.UUID, roomID string, memberID uuid.UUID, body api.UpdateMemberRequest) (api.MemberResponse, *api.APIError) {
+	if _, _, apiErr := m.requireRole(ownerID, roomID, db.RoleOwner); apiErr != nil {
+		return api.MemberResponse{}, apiErr
+	}
+
+	member, err := m.MembersDB.Get(roomID, memberID)
+	if err != nil {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if member.Role == "" {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: memberNotExistMsg}
+	}
+	if member.Role == db.RoleOwner {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusBadRequest, Msg: ownerRoleFixedMsg}
+	}
+
+	if err := m.MembersDB.UpdateRole(roomID, memberID, body.Role); err != nil {
+		return api.MemberResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	member.Role = body.Role
+	return toMemberResponse(member, ""), nil
+}
+
+// RemoveMember lets the owner remove anybody and moderators remove plain members.
+func (m *RoomsMgr) RemoveMember(actorID uuid.UUID, roomID string, memberID uuid.UUID) *api.APIError {
+	_, actor, apiErr := m.requireRole(actorID, roomID, db.RoleOwner, db.RoleModerator)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	member, err := m.MembersDB.Get(roomID, memberID)
+	if err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if member.Role == "" {
+		return &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: memberNotExistMsg}
+	}
+	if member.Role == db.RoleOwner || (actor.Role == db.RoleModerator && member.Role != db.RoleMember) {
+		return &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notRoomOwnerMsg}
+	}
+
+	return m.removeMember(roomID, memberID)
+}
+
+func (m *RoomsMgr) removeMember(roomID string, userID uuid.UUID) *api.APIError {
+	if err := m.MembersDB.Remove(roomID, userID); err != nil {
+		return &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	room, err := m.RoomsDB.GetByID(roomID)
+	if err == nil && room.Visibility != db.VisibilityPublic {
+		m.evict(chatrooms.Eviction{Room: roomID, Users: []string{userID.String()}})
+	}
+
+	log.Info().Msgf("user %s removed from room %s", userID, roomID)
+	return nil
+}
+
+// evictNonMembers disconnects the clients of a room that just became private.
+func (m *RoomsMgr) evictNonMembers(roomID string) {
+	dbMembers, err := m.MembersDB.List(roomID)
+	if err != nil {
+		log.Error().Err(err).Msgf("error listing members of room %s", roomID)
+		return
+	}
+	members := make([]string, 0, len(dbMembers))
+	for _, member := range dbMembers {
+		members = append(members, member.UserID.String())
+	}
+	m.evict(chatrooms.Eviction{Room: roomID, Members: members})
+}
+
+// evict disconnects the clients that lost access to the room, on every instance they are connected to.
+func (m *RoomsMgr) evict(eviction chatrooms.Eviction) {
+	if err := m.publishEvent(events.TypeRoomEvicted, eviction.Room, eviction); err != nil {
+		log.Error().Err(err).Msgf("error publishing the eviction from room %s", eviction.Room)
+	}
+}
+
+// getVisible hides private rooms from everyone but their members.
+func (m *RoomsMgr) getVisible(userID uuid.UUID, roomID string) (db.Room, db.RoomMember, *api.APIError) {
+	room, err := m.RoomsDB.GetByID(roomID)
+	if err != nil {
+		return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if room.ID == "" {
+		return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: roomNotExistMsg}
+	}
+
+	member, err := m.MembersDB.Get(roomID, userID)
+	if err != nil {
+		return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	if !canSee(room, member) {
+		return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: roomNotExistMsg}
+	}
+	return room, member, nil
+}
+
+// canSee lets everybody see the public rooms, and only their members the private rooms and the
+// direct conversations.
+func canSee(room db.Room, member db.RoomMember) bool {
+	return room.Visibility == db.VisibilityPublic || member.Role != ""
+}
+
+// requireRole returns the room and the membership of the user when it has one of the roles.
+func (m *RoomsMgr) requireRole(userID uuid.UUID, roomID string, roles ...string) (db.Room, db.RoomMember, *api.APIError) {
+	room, member, apiErr := m.getVisible(userID, roomID)
+	if apiErr != nil {
+		return db.Room{}, db.RoomMember{}, apiErr
+	}
+	for _, role := range roles {
+		if member.Role == role {
+			return room, member, nil
+		}
+	}
+	if len(roles) == 1 && roles[0] == db.RoleOwner {
+		return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notRoomOwnerMsg}
+	}
+	return db.Room{}, db.RoomMember{}, &api.APIError{HTTPStatusCode: http.StatusForbidden, Msg: notModeratorMsg}
+}
+
+func toResponse(room db.Room) api.RoomResponse {
+	return api.RoomResponse{
+		ID:         room.ID,
+		OwnerID:    room.OwnerID,
+		Title:      room.Title,
+		Topic:      room.Topic,
+		Visibility: room.Visibility,
+		CreatedAt:  room.CreatedAt,
+	}
+}
+
+func toMemberResponse(member db.RoomMember, nickname string) api.MemberResponse {
+	return api.MemberResponse{
+		UserID:   member.UserID,
+		NickName: nickname,
+		Role:     member.Role,
+		JoinedAt: member.CreatedAt,
+	}
+}
@@ -0,0 +1,45 @@
+package rooms
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"go-chat/db"
+)
+
+func TestParticipantsKey(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+
+	key, participants := participantsKey([]uuid.UUID{alice, bob, alice})
+	reversed, _ := participantsKey([]uuid.UUID{bob, alice})
+	if key != reversed {
+		t.Errorf("participantsKey() = %q and %q, want the same key whatever the order", key, reversed)
+	}
+	if len(participants) != 2 {
+		t.Errorf("participantsKey() participants = %v, want alice and bob once", participants)
+	}
+}
+
+func TestCanSee(t *testing.T) {
+	member := db.RoomMember{Role: db.RoleMember}
+	tests := []struct {
+		name   string
+		room   db.Room
+		member db.RoomMember
+		want   bool
+	}{
+		{name: "Can see - Public room", room: db.Room{Visibility: db.VisibilityPublic}, want: true},
+		{name: "Can see - Private room member", room: db.Room{Visibility: db.VisibilityPrivate}, member: member, want: true},
+		{name: "Can see - Private room outsider", room: db.Room{Visibility: db.VisibilityPrivate}, want: false},
+		{name: "Can see - Direct participant", room: db.Room{Visibility: db.VisibilityDirect}, member: member, want: true},
+		{name: "Can see - Direct outsider", room: db.Room{Visibility: db.VisibilityDirect}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canSee(tt.room, tt.member); got != tt.want {
+				t.Errorf("canSee() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package rooms
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+
+	"go-chat/api"
+	"go-chat/chatrooms"
+	"go-chat/db"
+	"go-chat/events"
+)
+
+const (
+	eventSource = "rooms"
+
+	messageNotExistMsg = "message not exists"
+)
+
+// ListMine returns the rooms the user is a member of or read, with the messages they have not read.
+func (m *RoomsMgr) ListMine(userID uuid.UUID) ([]api.MyRoomResponse, *api.APIError) {
+	dbRooms, err := m.RoomsDB.ListJoined(userID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	markers, err := m.ReadMarkersDB.ListByUser(userID)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+
+	roomIDs := make([]string, 0, len(dbRooms))
+	for _, room := range dbRooms {
+		roomIDs = append(roomIDs, room.ID)
+	}
+	counts, err := m.unreadCounts(userID, roomIDs)
+	if err != nil {
+		return nil, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	byRoom := make(map[string]db.ReadMarker, len(markers))
+	for _, marker := range markers {
+		byRoom[marker.RoomID] = marker
+	}
+
+	rooms := make([]api.MyRoomResponse, 0, len(dbRooms))
+	for _, room := range dbRooms {
+		mine := api.MyRoomResponse{RoomResponse: toResponse(room), Unread: counts[room.ID]}
+		if marker, ok := byRoom[room.ID]; ok {
+			messageID, lastReadAt := marker.MessageID, marker.LastReadAt
+			mine.LastReadMessageID = &messageID
+			mine.LastReadAt = &lastReadAt
+		}
+		rooms = append(rooms, mine)
+	}
+	return rooms, nil
+}
+
+// MarkRead moves the read marker of the user in the room up to the message.
+func (m *RoomsMgr) MarkRead(userID uuid.UUID, roomID string, body api.MarkReadRequest) (api.ReadMarkerResponse, *api.APIError) {
+	if apiErr := m.CheckAccess(userID, roomID); apiErr != nil {
+		return api.ReadMarkerResponse{}, apiErr
+	}
+
+	marker, err := m.advance(userID, roomID, body.MessageID)
+	if errors.Is(err, chatrooms.ErrUnknownMessage) {
+		return api.ReadMarkerResponse{}, &api.APIError{HTTPStatusCode: http.StatusNotFound, Msg: messageNotExistMsg}
+	}
+	if err != nil {
+		return api.ReadMarkerResponse{}, &api.APIError{HTTPStatusCode: http.StatusInternalServerError, Cause: err}
+	}
+	return marker, nil
+}
+
+// AdvanceReadMarker moves the read marker sent by a websocket client, its room already checked.
+func (m *RoomsMgr) AdvanceReadMarker(marker chatrooms.ReadMarkerPayload) error {
+	userID, err := uuid.Parse(marker.UserID)
+	if err != nil {
+		return err
+	}
+	messageID, err := uuid.Parse(marker.MessageID)
+	if err != nil {
+		return chatrooms.ErrUnknownMessage
+	}
+	_, err = m.advance(userID, marker.Room, messageID)
+	return err
+}
+
+// advance moves the read marker forward, counts again what is left unread and tells every connection
+// of the user when the marker moved, so all their devices agree.
+func (m *RoomsMgr) advance(userID uuid.UUID, roomID string, messageID uuid.UUID) (api.ReadMarkerResponse, error) {
+	marker, moved, err := m.ReadMarkersDB.Advance(userID, roomID, messageID)
+	if err != nil {
+		return api.ReadMarkerResponse{}, err
+	}
+	if marker.RoomID == "" {
+		return api.ReadMarkerResponse{}, chatrooms.ErrUnknownMessage
+	}
+	counts, err := m.recount(userID, []string{roomID})
+	if err != nil {
+		return api.ReadMarkerResponse{}, err
+	}
+
+	response := api.ReadMarkerResponse{
+		RoomID:     roomID,
+		MessageID:  marker.MessageID,
+		LastReadAt: marker.LastReadAt,
+		Unread:     counts[roomID],
+	}
+	if moved {
+		err := m.publishEvent(events.TypeReadMarkerMoved, chatrooms.UserKey(userID.String()), chatrooms.ReadMarkerPayload{
+			MessageID: marker.MessageID.String(),
+			Room:      roomID,
+			UserID:    userID.String(),
+			Unread:    response.Unread,
+		})
+		if err != nil {
+			log.Error().Err(err).Msgf("error publishing the read marker of user %s in room %s", userID, roomID)
+		}
+	}
+	return response, nil
+}
+
+// unreadCounts returns the unread counts of the rooms, counting in postgres the ones not cached.
+func (m *RoomsMgr) unreadCounts(userID uuid.UUID, roomIDs []string) (map[string]int64, error) {
+	counts, err := m.Unread.Get(userID.String(), roomIDs)
+	if err != nil {
+		log.Error().Err(err).Msgf("error getting the cached unread counts of user %s", userID)
+		counts = make(map[string]int64, len(roomIDs))
+	}
+	var missing []string
+	for _, roomID := range roomIDs {
+		if _, ok := counts[roomID]; !ok {
+			missing = append(missing, roomID)
+		}
+	}
+	if len(missing) == 0 {
+		return counts, nil
+	}
+
+	recounted, err := m.recount(userID, missing)
+	if err != nil {
+		return nil, err
+	}
+	for roomID, count := range recounted {
+		counts[roomID] = count
+	}
+	return counts, nil
+}
+
+// recount counts in postgres the unread messages of the rooms and caches the counts.
+func (m *RoomsMgr) recount(userID uuid.UUID, roomIDs []string) (map[string]int64, error) {
+	rows, err := m.ReadMarkersDB.CountUnread(userID, roomIDs)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(roomIDs))
+	for _, roomID := range roomIDs {
+		counts[roomID] = 0
+	}
+	for _, row := range rows {
+		counts[row.RoomID] = row.Count
+	}
+	if err := m.Unread.Set(userID.String(), counts); err != nil {
+		log.Error().Err(err).Msgf("error caching the unread counts of user %s", userID)
+	}
+	return counts, nil
+}
+
+// publishEvent sends the event to the instances the routing key is bound on.
+func (m *RoomsMgr) publishEvent(eventType, routingKey string, payload interface{}) error {
+	envelope, err := events.NewEnvelope(eventType, eventSource, payload)
+	if err != nil {
+		return err
+	}
+	body, err := envelope.Encode()
+	if err != nil {
+		return err
+	}
+	return m.Events.PublishEvent(chatrooms.EventsExchangeName, routingKey, body)
+}
@@ -3,7 +3,10 @@ package router
 import (
 	"github.com/labstack/echo"
 
+	"go-chat/admin"
 	"go-chat/chatrooms"
+	"go-chat/messages"
+	"go-chat/rooms"
 	"go-chat/users"
 )
 
@@ -11,13 +14,23 @@ type (
 	APIHandlers struct {
 		UsersHandler     *users.Handler
 		ChatroomsHandler *chatrooms.Handler
+		MessagesHandler  *messages.Handler
+		RoomsHandler     *rooms.Handler
+		AdminHandler     *admin.Handler
+		Authenticate     echo.MiddlewareFunc
+		RequireAdmin     echo.MiddlewareFunc
 	}
 )
 
-func NewAPIHandlers(usersHandler *users.Handler, chatroomsHandler *chatrooms.Handler) *APIHandlers {
+func NewAPIHandlers(usersHandler *users.Handler, chatroomsHandler *chatrooms.Handler, messagesHandler *messages.Handler, roomsHandler *rooms.Handler, adminHandler *admin.Handler, authenticate, requireAdmin echo.MiddlewareFunc) *APIHandlers {
 	return &APIHandlers{
 		UsersHandler:     usersHandler,
 		ChatroomsHandler: chatroomsHandler,
+		MessagesHandler:  messagesHandler,
+		RoomsHandler:     roomsHandler,
+		AdminHandler:     adminHandler,
+		Authenticate:     authenticate,
+		RequireAdmin:     requireAdmin,
 	}
 }
 
@@ -28,10 +41,44 @@ func Router(h *APIHandlers) *echo.Echo {
 	router.File("/login", "public/login_chat.html")
 	// for the chatroom websocket
 	router.File("/chatrooms/:id", "public/chatroom.html")
-	router.GET("/websocket/:id", h.ChatroomsHandler.HandleConnections)
+	router.GET("/websocket/:id", h.ChatroomsHandler.HandleConnections, h.Authenticate)
 
+	// public endpoints
 	router.POST("/api/v1/users", h.UsersHandler.Create)
 	router.POST("/api/v1/users/login", h.UsersHandler.VerifyForLogin)
 
+	// endpoints requiring a session token
+	v1 := router.Group("/api/v1", h.Authenticate)
+	v1.POST("/users/logout", h.UsersHandler.Logout)
+	v1.GET("/users/me/rooms", h.RoomsHandler.ListMine)
+	v1.GET("/users/me/mentions", h.MessagesHandler.ListMentions)
+	v1.POST("/users/me/mentions/read", h.MessagesHandler.MarkMentionsRead)
+	v1.POST("/chatrooms", h.RoomsHandler.Create)
+	v1.GET("/chatrooms", h.RoomsHandler.List)
+	v1.GET("/chatrooms/:id", h.RoomsHandler.Get)
+	v1.PATCH("/chatrooms/:id", h.RoomsHandler.Update)
+	v1.DELETE("/chatrooms/:id", h.RoomsHandler.Delete)
+	v1.POST("/chatrooms/:id/invitations", h.RoomsHandler.Invite)
+	v1.POST("/chatrooms/:id/join", h.RoomsHandler.Join)
+	v1.POST("/chatrooms/:id/leave", h.RoomsHandler.Leave)
+	v1.GET("/chatrooms/:id/members", h.RoomsHandler.ListMembers)
+	v1.GET("/chatrooms/:id/members/online", h.RoomsHandler.ListOnline)
+	v1.PATCH("/chatrooms/:id/members/:user_id", h.RoomsHandler.UpdateMember)
+	v1.DELETE("/chatrooms/:id/members/:user_id", h.RoomsHandler.RemoveMember)
+	v1.GET("/chatrooms/:id/messages", h.MessagesHandler.ListChatroomMessages)
+	v1.POST("/chatrooms/:id/read", h.RoomsHandler.MarkRead)
+	v1.POST("/dms", h.RoomsHandler.OpenDirect)
+	v1.GET("/dms", h.RoomsHandler.ListDirect)
+	v1.PATCH("/messages/:id", h.MessagesHandler.Edit)
+	v1.DELETE("/messages/:id", h.MessagesHandler.Delete)
+	v1.GET("/messages/:id/edits", h.MessagesHandler.ListEdits)
+	v1.GET("/messages/:id/thread", h.MessagesHandler.ListThread)
+	v1.GET("/search", h.MessagesHandler.Search)
+
+	// admin endpoints
+	adminGroup := v1.Group("/admin", h.RequireAdmin)
+	adminGroup.GET("/dead-letters/:queue", h.AdminHandler.ListDeadLetters)
+	adminGroup.POST("/dead-letters/:queue/replay", h.AdminHandler.ReplayDeadLetters)
+
 	return router
 }
@@ -7,6 +7,7 @@ import (
 	"github.com/labstack/echo"
 
 	"go-chat/api"
+	"go-chat/auth"
 )
 
 type response struct {
@@ -20,6 +21,10 @@ type Handler struct {
 		Create(body api.CreateUserRequest) (uuid.UUID, *api.APIError)
 		VerifyForLogin(body api.ValidateUserRequest) (api.ValidatedUserResponse, *api.APIError)
 	}
+	Sessions interface {
+		Issue(identity auth.Identity) (string, error)
+		Revoke(token string) error
+	}
 }
 
 // Create - creates a user
@@ -57,5 +62,20 @@ func (h Handler) VerifyForLogin(c echo.Context) error {
 		return c.JSON(err.HTTPStatusCode, err)
 	}
 
+	token, tokenErr := h.Sessions.Issue(auth.Identity{UserID: b.ID, Nickname: b.NickName})
+	if tokenErr != nil {
+		return c.JSON(http.StatusInternalServerError, response{Message: tokenErr.Error()})
+	}
+	b.Token = token
+
 	return c.JSON(http.StatusOK, b)
 }
+
+// Logout - revokes the session token of the request
+func (h Handler) Logout(c echo.Context) error {
+	if err := h.Sessions.Revoke(auth.TokenFromContext(c)); err != nil {
+		return c.JSON(http.StatusInternalServerError, response{Message: err.Error()})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}